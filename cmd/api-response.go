@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io"
+)
+
+const (
+	// s3Namespace - XML namespace of the S3 API documents.
+	s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+	// iso8601TimeFormat - format of the times in S3 API documents.
+	iso8601TimeFormat = "2006-01-02T15:04:05.000Z"
+
+	// defaultStorageClass - storage class of the objects without one.
+	defaultStorageClass = "STANDARD"
+)
+
+// listBucketResult - ListBucketResult document of a ListObjects response.
+type listBucketResult struct {
+	XMLName xml.Name `xml:"ListBucketResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+
+	Name           string
+	IsTruncated    bool
+	NextMarker     string         `xml:"NextMarker,omitempty"`
+	Contents       []listObject   `xml:"Contents"`
+	CommonPrefixes []commonPrefix `xml:"CommonPrefixes"`
+}
+
+// listObject - Contents entry of a ListBucketResult.
+type listObject struct {
+	Key           string
+	LastModified  string
+	ETag          string
+	Size          int64
+	Owner         *listOwner `xml:"Owner,omitempty"`
+	StorageClass  string
+	RestoreStatus *listRestoreStatus `xml:"RestoreStatus,omitempty"`
+}
+
+// listRestoreStatus - restore status of a listed object archived to a
+// cold storage class.
+type listRestoreStatus struct {
+	IsRestoreInProgress bool
+	RestoreExpiryDate   string `xml:"RestoreExpiryDate,omitempty"`
+}
+
+// listOwner - owner of a listed object.
+type listOwner struct {
+	ID          string
+	DisplayName string
+}
+
+// commonPrefix - CommonPrefixes entry of a ListBucketResult.
+type commonPrefix struct {
+	Prefix string
+}
+
+// MarshalS3XML - marshals the listing into the ListBucketResult document
+// S3 responds to ListObjects with, named after bucket. Times are in UTC
+// with millisecond precision and the ETags quoted the way S3 has them.
+// The restore status is included for the objects being restored or
+// restored from a cold storage class.
+// The request parameters, such as Prefix and MaxKeys, are not known to
+// the listing and left out.
+func (loi ListObjectsInfo) MarshalS3XML(bucket string) ([]byte, error) {
+	result := listBucketResult{
+		Xmlns:       s3Namespace,
+		Name:        bucket,
+		IsTruncated: loi.IsTruncated,
+		NextMarker:  loi.NextMarker,
+	}
+	for _, objInfo := range loi.Objects {
+		obj := listObject{
+			Key:          objInfo.Name,
+			LastModified: objInfo.ModTime.UTC().Format(iso8601TimeFormat),
+			Size:         objInfo.Size,
+			StorageClass: objInfo.StorageClass,
+		}
+		if objInfo.ETag != "" {
+			obj.ETag = "\"" + objInfo.ETag + "\""
+		}
+		if objInfo.Owner != "" {
+			obj.Owner = &listOwner{ID: objInfo.Owner, DisplayName: objInfo.Owner}
+		}
+		if obj.StorageClass == "" {
+			obj.StorageClass = defaultStorageClass
+		}
+		if objInfo.RestoreOngoing || !objInfo.RestoreExpires.IsZero() {
+			obj.RestoreStatus = &listRestoreStatus{IsRestoreInProgress: objInfo.RestoreOngoing}
+			if !objInfo.RestoreExpires.IsZero() {
+				obj.RestoreStatus.RestoreExpiryDate = objInfo.RestoreExpires.UTC().Format(iso8601TimeFormat)
+			}
+		}
+		result.Contents = append(result.Contents, obj)
+	}
+	for _, prefix := range loi.Prefixes {
+		result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: prefix})
+	}
+
+	buf, err := xml.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), buf...), nil
+}
+
+// ndjsonPrefix - NDJSON line of a common prefix.
+type ndjsonPrefix struct {
+	Prefix string `json:"prefix"`
+}
+
+// WriteNDJSON - writes the objects and the prefixes of the listing to w
+// as newline delimited JSON, in the order of their names, one ObjectInfo
+// or {"prefix":...} object per line. Each line is written as encoded,
+// for w to stream them.
+func WriteNDJSON(w io.Writer, loi ListObjectsInfo) error {
+	enc := json.NewEncoder(w)
+	return loi.stream(func(entry ListEntry) error {
+		if entry.IsPrefix {
+			return enc.Encode(ndjsonPrefix{Prefix: entry.Name})
+		}
+		return enc.Encode(entry.Info)
+	})
+}
@@ -2,14 +2,17 @@ package cmd
 
 import (
 	"errors"
+	"fmt"
 	"reflect"
+	"sort"
 	"sync"
 	"time"
 )
 
-// Global lookup timeout.
 const (
-	globalLookupTimeout    = time.Minute * 30 // 30minutes.
+	// DefaultTreeWalkTimeout - time a treeWalk is kept in the pool for
+	// the next page, used when NewTreeWalkPool() is given zero.
+	DefaultTreeWalkTimeout = time.Minute * 30 // 30minutes.
 	treeWalkEntryLimit     = 50
 	treeWalkSameEntryLimit = 4
 )
@@ -20,12 +23,31 @@ type listParams struct {
 	recursive bool
 	marker    string
 	prefix    string
+	walk      string // WalkOptions.poolKey() of the walk.
+}
+
+// Bucket - returns the bucket of the listing.
+func (p listParams) Bucket() string { return p.bucket }
+
+// Prefix - returns the prefix of the listing.
+func (p listParams) Prefix() string { return p.prefix }
+
+// Marker - returns the marker the next page of the listing starts at.
+func (p listParams) Marker() string { return p.marker }
+
+// Recursive - returns whether the listing has no delimiter.
+func (p listParams) Recursive() bool { return p.recursive }
+
+// String - formats the params for diagnostics.
+func (p listParams) String() string {
+	return fmt.Sprintf("bucket %q prefix %q marker %q recursive %v", p.bucket, p.prefix, p.marker, p.recursive)
 }
 
 // errWalkAbort - returned by doTreeWalk() if it returns prematurely.
 // doTreeWalk() can return prematurely if
 // 1) treeWalk is timed out by the timer go-routine.
 // 2) there is an error during tree walk.
+// Cancellation of the walk context is reported as the context error instead.
 var errWalkAbort = errors.New("treeWalk abort")
 
 // treeWalk - represents the go routine that does the file tree walk.
@@ -49,6 +71,9 @@ type TreeWalkPool struct {
 
 // NewTreeWalkPool - initialize new tree walk pool.
 func NewTreeWalkPool(timeout time.Duration) *TreeWalkPool {
+	if timeout <= 0 {
+		timeout = DefaultTreeWalkTimeout
+	}
 	tPool := &TreeWalkPool{
 		pool:    make(map[listParams][]treeWalk),
 		timeOut: timeout,
@@ -56,6 +81,78 @@ func NewTreeWalkPool(timeout time.Duration) *TreeWalkPool {
 	return tPool
 }
 
+// WalkerInfo - a treeWalk parked in a TreeWalkPool, for diagnostics.
+type WalkerInfo struct {
+	Bucket    string
+	Prefix    string
+	Marker    string
+	Recursive bool
+	Age       time.Duration // Time parked so far.
+}
+
+// Inspect - returns a snapshot of the treeWalks parked in the pool,
+// sorted by bucket, prefix, marker, then recursive, the oldest first.
+func (t *TreeWalkPool) Inspect() []WalkerInfo {
+	now := time.Now()
+	var walkers []WalkerInfo
+	t.mu.Lock()
+	for params, walks := range t.pool {
+		for _, walk := range walks {
+			walkers = append(walkers, WalkerInfo{
+				Bucket:    params.bucket,
+				Prefix:    params.prefix,
+				Marker:    params.marker,
+				Recursive: params.recursive,
+				Age:       now.Sub(walk.added),
+			})
+		}
+	}
+	t.mu.Unlock()
+	sort.Slice(walkers, func(i, j int) bool {
+		a, b := walkers[i], walkers[j]
+		switch {
+		case a.Bucket != b.Bucket:
+			return a.Bucket < b.Bucket
+		case a.Prefix != b.Prefix:
+			return a.Prefix < b.Prefix
+		case a.Marker != b.Marker:
+			return a.Marker < b.Marker
+		case a.Recursive != b.Recursive:
+			return !a.Recursive
+		}
+		return a.Age > b.Age
+	})
+	return walkers
+}
+
+// ActiveParams - returns a snapshot of the params of the pooled walks,
+// sorted by bucket, prefix, marker, then recursive, for diagnostics.
+func (t *TreeWalkPool) ActiveParams() []listParams {
+	t.mu.Lock()
+	params := make([]listParams, 0, len(t.pool))
+	for p, walks := range t.pool {
+		if len(walks) > 0 {
+			params = append(params, p)
+		}
+	}
+	t.mu.Unlock()
+	sort.Slice(params, func(i, j int) bool {
+		a, b := params[i], params[j]
+		switch {
+		case a.bucket != b.bucket:
+			return a.bucket < b.bucket
+		case a.prefix != b.prefix:
+			return a.prefix < b.prefix
+		case a.marker != b.marker:
+			return a.marker < b.marker
+		case a.recursive != b.recursive:
+			return !a.recursive
+		}
+		return a.walk < b.walk
+	})
+	return params
+}
+
 // Release - selects a treeWalk from the pool based on the input
 // listParams, removes it from the pool, and returns the TreeWalkResult
 // channel.
@@ -81,6 +178,19 @@ func (t *TreeWalkPool) Release(params listParams) (resultCh chan TreeWalkResult,
 	return walk.resultCh, walk.endWalkCh
 }
 
+// Evict - ends the oldest treeWalk parked under params and removes it
+// from the pool, such as for a client known to have abandoned its
+// listing. The others parked under the same params are left alone.
+// Returns false if params does not have an associated treeWalk.
+func (t *TreeWalkPool) Evict(params listParams) bool {
+	resultCh, endWalkCh := t.Release(params)
+	if resultCh == nil {
+		return false
+	}
+	close(endWalkCh)
+	return true
+}
+
 // Set - adds a treeWalk to the treeWalkPool.
 // Also starts a timer go-routine that ends when:
 //  1. time.After() expires after t.timeOut seconds.
@@ -165,6 +275,7 @@ func (t *TreeWalkPool) Set(params listParams, resultCh chan TreeWalkResult, endW
 			// end the treeWalk go-routine.
 			t.mu.Lock()
 			defer t.mu.Unlock()
+			var found bool
 			walks, ok := t.pool[params]
 			if ok {
 				// Trick of filtering without allocating
@@ -174,6 +285,8 @@ func (t *TreeWalkPool) Set(params listParams, resultCh chan TreeWalkResult, endW
 				for _, walk := range walks {
 					if !reflect.DeepEqual(walk, walkInfo) {
 						nwalks = append(nwalks, walk)
+					} else {
+						found = true
 					}
 				}
 				if len(nwalks) == 0 {
@@ -186,6 +299,12 @@ func (t *TreeWalkPool) Set(params listParams, resultCh chan TreeWalkResult, endW
 					t.pool[params] = nwalks
 				}
 			}
+			// The treeWalk might have been handed out by Release() or
+			// invalidated by Set() while we waited for the lock, in
+			// which case it is no longer ours to end.
+			if !found {
+				return
+			}
 			// Signal the treeWalk go-routine to die.
 			close(endWalkCh)
 		case <-endTimerCh:
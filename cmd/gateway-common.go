@@ -4,6 +4,21 @@ var (
 	// ListObjects function alias.
 	ListObjects = listObjects
 
+	// ListObjectsWithResolver function alias.
+	ListObjectsWithResolver = listObjectsWithResolver
+
+	// ListObjectsWithOptions function alias.
+	ListObjectsWithOptions = listObjectsWithOptions
+
+	// ListObjectsWithCursor function alias.
+	ListObjectsWithCursor = listObjectsWithCursor
+
+	// FilterMatchingPrefix function alias.
+	FilterMatchingPrefix = filterMatchingPrefix
+
 	// FilterListEntries function alias.
 	FilterListEntries = filterListEntries
+
+	// FilterListEntriesWithOptions function alias.
+	FilterListEntriesWithOptions = filterListEntriesWithOptions
 )
@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemBackend - in-memory backend of a bucket, a reference implementation
+// of the functions the listings walk and resolve the keys with, and a
+// backend for tests and examples. The directories are the prefixes of
+// the keys up to a separator, keys ending with one are the objects
+// of directories, listed as empty directories unless keys are under
+// them. The bucket arguments name the bucket of the ObjectInfo returned.
+// It is safe for concurrent use.
+type MemBackend struct {
+	// Separator is the path separator of the directories in place of
+	// SlashSeparator, for the listings with the same WalkOptions.Separator.
+	// It is set before the backend is used.
+	Separator string
+
+	mu      sync.RWMutex
+	objects map[string]ObjectInfo
+	keys    []string // Keys of objects, sorted.
+}
+
+// NewMemBackend - returns a MemBackend holding objects, by their names.
+func NewMemBackend(objects ...ObjectInfo) *MemBackend {
+	b := &MemBackend{objects: make(map[string]ObjectInfo, len(objects))}
+	for _, objInfo := range objects {
+		b.objects[objInfo.Name] = objInfo
+	}
+	for name := range b.objects {
+		b.keys = append(b.keys, name)
+	}
+	sort.Strings(b.keys)
+	return b
+}
+
+// Put - adds the object, or replaces the one of the same name.
+func (b *MemBackend) Put(objInfo ObjectInfo) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.objects[objInfo.Name]; !ok {
+		i := sort.SearchStrings(b.keys, objInfo.Name)
+		b.keys = append(b.keys, "")
+		copy(b.keys[i+1:], b.keys[i:])
+		b.keys[i] = objInfo.Name
+	}
+	b.objects[objInfo.Name] = objInfo
+}
+
+// Keys - returns the names of the objects, sorted.
+func (b *MemBackend) Keys() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return append([]string(nil), b.keys...)
+}
+
+// separator - returns the path separator of the directories.
+func (b *MemBackend) separator() string {
+	if b.Separator == "" {
+		return SlashSeparator
+	}
+	return b.Separator
+}
+
+// Delete - removes the object name, if any.
+func (b *MemBackend) Delete(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.objects[name]; !ok {
+		return
+	}
+	delete(b.objects, name)
+	i := sort.SearchStrings(b.keys, name)
+	b.keys = append(b.keys[:i], b.keys[i+1:]...)
+}
+
+// ListDir - ListDirFunc of the backend, the entries are sorted with the
+// directories named with a trailing separator.
+func (b *MemBackend) ListDir(bucket, prefixDir, prefixEntry string) (emptyDir bool, entries []*Entry, delayIsLeaf bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	start := prefixDir + prefixEntry
+	for _, key := range b.keys[sort.SearchStrings(b.keys, start):] {
+		if !HasPrefix(key, start) {
+			break
+		}
+		if key == prefixDir {
+			// The object of the directory itself.
+			continue
+		}
+		name := key[len(prefixDir):]
+		if i := strings.Index(name, b.separator()); i != -1 {
+			name = name[:i+len(b.separator())]
+		}
+		// Cutting the keys at the separator keeps them in order, the
+		// keys of a directory are adjacent.
+		if len(entries) > 0 && entries[len(entries)-1].Name == name {
+			continue
+		}
+		info := ObjectInfo{Bucket: bucket, Name: prefixDir + name, IsDir: true}
+		if objInfo, ok := b.objects[prefixDir+name]; ok {
+			info = objInfo
+			info.Bucket = bucket
+		}
+		entries = append(entries, &Entry{Name: name, Info: &info})
+	}
+	return len(entries) == 0 && prefixEntry == "", entries, false
+}
+
+// IsLeaf - IsLeafFunc of the backend, the names of directories end with
+// the separator.
+func (b *MemBackend) IsLeaf(bucket, name string) bool {
+	return !HasSuffix(name, b.separator())
+}
+
+// IsLeafDir - IsLeafDirFunc of the backend, returns true if no keys are
+// under the directory name.
+func (b *MemBackend) IsLeafDir(bucket, name string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	i := sort.SearchStrings(b.keys, name)
+	if i < len(b.keys) && b.keys[i] == name {
+		i++
+	}
+	return i == len(b.keys) || !HasPrefix(b.keys[i], name)
+}
+
+// GetObjectInfo - GetObjectInfoFunc of the backend, resolving the keys
+// to their objects, the ones of directories as directories, and the
+// directories without objects to their names. The keys are translated
+// to the separator of the backend. The listed info is not relied on,
+// the objects deleted since are not found.
+func (b *MemBackend) GetObjectInfo(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	path := name
+	if b.separator() != SlashSeparator {
+		path = strings.ReplaceAll(name, SlashSeparator, b.separator())
+	}
+	if objInfo, ok := b.objects[path]; ok {
+		objInfo.Bucket, objInfo.Name = bucket, name
+		objInfo.IsDir = HasSuffix(path, b.separator())
+		return objInfo, nil
+	}
+	if HasSuffix(path, b.separator()) {
+		if i := sort.SearchStrings(b.keys, path); i < len(b.keys) && HasPrefix(b.keys[i], path) {
+			return ObjectInfo{Bucket: bucket, Name: name, IsDir: true}, nil
+		}
+	}
+	return ObjectInfo{}, os.ErrNotExist
+}
+
+// ListBackend - returns the backend to list through with tpool, which
+// may be nil, resolving objects and directories with GetObjectInfo.
+func (b *MemBackend) ListBackend(tpool *TreeWalkPool) ListBackend {
+	return ListBackend{
+		Pool:      tpool,
+		ListDir:   b.ListDir,
+		IsLeaf:    b.IsLeaf,
+		IsLeafDir: b.IsLeafDir,
+		Resolver:  funcResolver{getObjInfo: b.GetObjectInfo, getObjectInfoDirs: []GetObjectInfoFunc{b.GetObjectInfo}},
+	}
+}
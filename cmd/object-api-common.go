@@ -2,39 +2,144 @@ package cmd
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	errgroup "github.com/zhaohuxing/s3/pkg/sync"
 )
 
-func listObjectsNonSlash(ctx context.Context, bucket, prefix, marker, delimiter string, maxKeys int, tpool *TreeWalkPool, listDir ListDirFunc, isLeaf IsLeafFunc, isLeafDir IsLeafDirFunc, getObjInfo func(context.Context, string, string, *ObjectInfo) (ObjectInfo, error), getObjectInfoDirs ...func(context.Context, string, string, *ObjectInfo) (ObjectInfo, error)) (loi ListObjectsInfo, err error) {
+// resolveObject - resolves the ObjectInfo of a leaf entry, substituting
+// a placeholder for entries which can not be stat'ed when requested.
+func resolveObject(ctx context.Context, bucket string, entry *Entry, resolver InfoResolver, opts ListOptions) (ObjectInfo, error) {
+	if opts.ExistsHint != nil && !opts.ExistsHint(entry.Name) {
+		return ObjectInfo{}, os.ErrNotExist
+	}
+	if opts.namesOnly() {
+		return ObjectInfo{Bucket: bucket, Name: entry.Name}, nil
+	}
+	cacheKey := statCacheKey{bucket, entry.Name, opts.FetchRetention, opts.FetchOwner, opts.Projection}
+	if opts.StatCache != nil {
+		if objInfo, ok := opts.StatCache.get(cacheKey); ok {
+			return objInfo, nil
+		}
+	}
+	if opts.Metrics != nil {
+		opts.Metrics.IncObjInfoCalls()
+	}
+	objInfo, err := statEntry(ctx, entry.Name, opts, func(ctx context.Context) (ObjectInfo, error) {
+		return resolver.ResolveObject(ctx, bucket, entry.Name, entry.Info)
+	})
+	opts.omitUnrequested(&objInfo)
+	if err == nil {
+		carrySys(&objInfo, entry.Info)
+	}
+	if err == nil && opts.StatCache != nil {
+		opts.StatCache.put(cacheKey, objInfo)
+	}
+	if err != nil && opts.PlaceholderOnENOTSUP && errors.Is(err, syscall.ENOTSUP) {
+		// Replace links to external file systems with empty objects.
+		return ObjectInfo{
+			Bucket:  bucket,
+			Name:    entry.Name,
+			ModTime: time.Now().UTC(),
+		}, nil
+	}
+	return objInfo, err
+}
+
+// statEntry - resolves the ObjectInfo of name through resolve, within
+// the global bound set by SetGlobalStatConcurrency, giving up on it
+// after opts.StatTimeout, if set, even if resolve does not return then.
+// The entries given up on are left out as if deleted in the interim
+// period, or fail the listing with ErrStatTimeout with
+// opts.StatTimeoutFatal.
+func statEntry(ctx context.Context, name string, opts ListOptions, resolve func(ctx context.Context) (ObjectInfo, error)) (ObjectInfo, error) {
+	release, err := acquireStat(ctx)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if opts.StatTimeout <= 0 {
+		defer release()
+		return resolve(ctx)
+	}
+	statCtx, cancel := context.WithTimeout(ctx, opts.StatTimeout)
+	defer cancel()
+
+	type stat struct {
+		objInfo ObjectInfo
+		err     error
+	}
+	// Buffered for resolve to return after being given up on.
+	statCh := make(chan stat, 1)
+	go func() {
+		// A stat given up on holds its slot until it returns.
+		defer release()
+		var s stat
+		defer func() { statCh <- s }()
+		defer recoverBackendPanic(&s.err)
+		s.objInfo, s.err = resolve(statCtx)
+	}()
+	select {
+	case s := <-statCh:
+		if !errors.Is(s.err, context.DeadlineExceeded) || ctx.Err() != nil {
+			return s.objInfo, s.err
+		}
+	case <-statCtx.Done():
+		if err := ctx.Err(); err != nil {
+			return ObjectInfo{}, err
+		}
+	}
+	if opts.StatTimeoutFatal {
+		return ObjectInfo{}, fmt.Errorf("%s: %w", name, ErrStatTimeout)
+	}
+	return ObjectInfo{}, os.ErrNotExist
+}
+
+func listObjectsNonSlash(ctx context.Context, bucket, prefix, marker, delimiter string, maxKeys int, tpool *TreeWalkPool, listDir ListDirFunc, isLeaf IsLeafFunc, isLeafDir IsLeafDirFunc, resolver InfoResolver, opts ListOptions) (loi ListObjectsInfo, err error) {
 	endWalkCh := make(chan struct{})
 	defer close(endWalkCh)
 	recursive := true
-	walkResultCh := startTreeWalk(ctx, bucket, prefix, "", recursive, listDir, isLeaf, isLeafDir, endWalkCh)
+	walkResultCh := startTreeWalk(ctx, bucket, prefix, "", recursive, listDir, isLeaf, isLeafDir, opts.WalkOptions, endWalkCh)
 
-	var objInfos []ObjectInfo
+	var listed int
+	var lastName string
 	var eof bool
-	var prevPrefix string
+	// The walk starts over from the first key, the prefixes up to the
+	// marker are folded as well.
+	prefixes := foldedPrefixes{caseInsensitive: opts.CaseInsensitive}
 
 	for {
-		if len(objInfos) == maxKeys {
+		if listed == maxKeys {
 			break
 		}
+		if err := ctx.Err(); err != nil {
+			return loi, err
+		}
+		walkStart := time.Now()
 		result, ok := <-walkResultCh
+		opts.Timing.add(time.Since(walkStart), 0, 0)
 		if !ok {
 			eof = true
 			break
 		}
+		if result.err != nil {
+			return loi, result.err
+		}
 
 		var objInfo ObjectInfo
 		var err error
 
 		index := strings.Index(strings.TrimPrefix(result.entry.Name, prefix), delimiter)
-		if index == -1 {
-			objInfo, err = getObjInfo(ctx, bucket, result.entry.Name, result.entry.Info)
+		isPrefix := index != -1
+		if !isPrefix {
+			statStart := time.Now()
+			objInfo, err = resolveObject(ctx, bucket, result.entry, resolver, opts)
+			opts.Timing.add(0, time.Since(statStart), 1)
 			if err != nil {
 				// Ignore errFileNotFound as the object might have got
 				// deleted in the interim period of listing and getObjectInfo(),
@@ -44,62 +149,348 @@ func listObjectsNonSlash(ctx context.Context, bucket, prefix, marker, delimiter
 				}
 				return loi, err
 			}
+			if !opts.accepts(&objInfo) {
+				continue
+			}
 		} else {
 			index = len(prefix) + index + len(delimiter)
 			currPrefix := result.entry.Name[:index]
-			if currPrefix == prevPrefix {
+			if result.entry.Name <= marker && !prefixListedBefore(currPrefix, marker) {
+				// Listed for the keys after the marker within it, if any.
+				continue
+			}
+			if !prefixes.add(currPrefix) {
 				continue
 			}
-			prevPrefix = currPrefix
 
 			objInfo = ObjectInfo{
 				Bucket: bucket,
 				Name:   currPrefix,
 				IsDir:  true,
 			}
+			if opts.SynthesizeDirStat {
+				// The first key under the prefix.
+				synthesizeDirStat(&objInfo, result.entry.Info)
+			}
 		}
 
-		if objInfo.Name <= marker {
+		if isPrefix && prefixListedBefore(objInfo.Name, marker) || !isPrefix && objInfo.Name <= marker {
 			continue
 		}
 
-		objInfos = append(objInfos, objInfo)
+		listed++
+		lastName = objInfo.Name
+		switch {
+		case opts.Stream != nil:
+			// Handed over as listed rather than held for the page.
+			entry := ListEntry{Name: objInfo.Name, IsPrefix: objInfo.IsDir, Info: &objInfo}
+			if objInfo.IsDir && !opts.SynthesizeDirStat {
+				entry.Info = nil
+			}
+			if err = opts.Stream(entry); err != nil {
+				return loi, err
+			}
+		case objInfo.IsDir:
+			loi.addPrefix(objInfo, opts)
+		default:
+			loi.Objects = append(loi.Objects, objInfo)
+		}
 		if result.end {
 			eof = true
 			break
 		}
 	}
+	loi.KeyCount = listed
 
-	result := ListObjectsInfo{}
-	for _, objInfo := range objInfos {
-		if objInfo.IsDir {
-			result.Prefixes = append(result.Prefixes, objInfo.Name)
+	if !eof {
+		loi.IsTruncated = true
+		loi.NextMarker = lastName
+		// Not told apart, the walk is not by directory.
+		loi.ObjectsTruncated, loi.PrefixesTruncated = true, true
+	}
+
+	return loi, nil
+}
+
+// listObjects - lists the objects using getObjInfo to resolve leaf
+// entries and getObjectInfoDirs, tried in order, to resolve directory
+// entries.
+//
+// Deprecated: use listObjectsWithOptions() with an InfoResolver instead.
+func listObjects(
+	ctx context.Context, bucket, prefix, marker, delimiter string, maxKeys int,
+	tpool *TreeWalkPool,
+	listDir ListDirFunc, isLeaf IsLeafFunc, isLeafDir IsLeafDirFunc,
+	getObjInfo GetObjectInfoFunc,
+	getObjectInfoDirs ...GetObjectInfoFunc) (loi ListObjectsInfo, err error) {
+	resolver := funcResolver{getObjInfo: getObjInfo, getObjectInfoDirs: getObjectInfoDirs}
+	return listObjectsWithResolver(ctx, bucket, prefix, marker, delimiter, maxKeys, tpool, listDir, isLeaf, isLeafDir, resolver, ListOptions{})
+}
+
+// listObjectsWithResolver - lists the objects, resolving the ObjectInfo
+// of the walked entries through resolver, opts tunes the listing. The
+// positional arguments take precedence over their fields in opts.
+func listObjectsWithResolver(
+	ctx context.Context, bucket, prefix, marker, delimiter string, maxKeys int,
+	tpool *TreeWalkPool,
+	listDir ListDirFunc, isLeaf IsLeafFunc, isLeafDir IsLeafDirFunc,
+	resolver InfoResolver, opts ListOptions) (loi ListObjectsInfo, err error) {
+	// With max keys of zero we have reached eof, return right here.
+	if maxKeys == 0 {
+		return loi, nil
+	}
+
+	opts.Delimiter, opts.Marker, opts.MaxKeys = delimiter, marker, maxKeys
+	backend := ListBackend{
+		Pool:      tpool,
+		ListDir:   listDir,
+		IsLeaf:    isLeaf,
+		IsLeafDir: isLeafDir,
+		Resolver:  resolver,
+	}
+	return listObjectsWithOptions(ctx, bucket, prefix, opts, backend)
+}
+
+// listObjectsWithOptions - lists the objects under prefix as described
+// by opts, walking and resolving them through backend.
+func listObjectsWithOptions(ctx context.Context, bucket, prefix string, opts ListOptions, backend ListBackend) (loi ListObjectsInfo, err error) {
+	if err = opts.validate(); err != nil {
+		return loi, err
+	}
+	if opts.Metrics != nil {
+		defer func(start time.Time) {
+			opts.Metrics.ObserveListLatency(time.Since(start))
+		}(time.Now())
+	}
+
+	if opts.FetchRetention {
+		ctx = context.WithValue(ctx, fetchRetentionKey{}, true)
+	}
+	if opts.FetchOwner {
+		ctx = context.WithValue(ctx, fetchOwnerKey{}, true)
+	}
+	if opts.Projection != 0 {
+		ctx = context.WithValue(ctx, projectionKey{}, opts.Projection)
+	}
+
+	marker := opts.Marker
+	if marker == "" {
+		marker = opts.StartAfter
+	}
+
+	if opts.CollapseSlashes {
+		prefix, marker = collapseSlashes(prefix), collapseSlashes(marker)
+	}
+	opts.foldSuffix = opts.CaseInsensitive
+
+	aliased := opts.Alias.External != "" && HasPrefix(prefix, opts.Alias.External)
+	if aliased {
+		switch {
+		case HasPrefix(marker, opts.Alias.External):
+			marker = opts.Alias.toInternal(marker)
+		case marker < opts.Alias.External:
+			// Ahead of all the keys under the alias.
+			marker = ""
+		default:
+			// Past all the keys under the alias.
+			return loi, nil
+		}
+		prefix = opts.Alias.toInternal(prefix)
+	}
+
+	if opts.Stream != nil {
+		// Streamed keys are named and encoded like the keys of the result.
+		stream, alias, encodingType := opts.Stream, opts.Alias, opts.EncodingType
+		strip, delimiter := opts.StripDelimiterFromPrefixes, opts.Delimiter
+		opts.Stream = func(entry ListEntry) error {
+			if aliased {
+				entry.Name = alias.toExternal(entry.Name)
+			}
+			if strip && entry.IsPrefix {
+				entry.Name = strings.TrimSuffix(entry.Name, delimiter)
+			}
+			entry.Name = s3EncodeName(entry.Name, encodingType)
+			if entry.Info != nil {
+				entry.Info.Name = entry.Name
+			}
+			return stream(entry)
+		}
+	}
+
+	if opts.Delimiter != SlashSeparator && opts.Delimiter != "" {
+		loi, err = listObjectsNonSlash(ctx, bucket, prefix, marker, opts.Delimiter, opts.MaxKeys,
+			backend.Pool, backend.ListDir, backend.IsLeaf, backend.IsLeafDir, backend.Resolver, opts)
+	} else {
+		loi, err = doListObjects(ctx, bucket, prefix, marker, opts.Delimiter, opts.MaxKeys,
+			backend.Pool, backend.ListDir, backend.IsLeaf, backend.IsLeafDir, backend.Resolver, opts)
+	}
+	if err != nil {
+		return loi, err
+	}
+	if opts.Stream == nil {
+		loi.KeyCount = len(loi.Objects) + len(loi.Prefixes)
+	} else if err = loi.stream(opts.Stream); err != nil {
+		// The page of the other delimiters, resolved at once.
+		return loi, err
+	}
+	if aliased {
+		loi = loi.alias(opts.Alias)
+	}
+	if opts.Merged {
+		loi.merge()
+	}
+	if opts.StripDelimiterFromPrefixes {
+		// After merging, for the prefixes to keep their order.
+		loi = loi.stripDelimiter(opts.Delimiter)
+	}
+	return loi.encode(opts.EncodingType), nil
+}
+
+// listExactKey - lists prefix as a key of its own, from a single listDir
+// call of its parent directory rather than a walk. The listing filters
+// of the backend apply like they do to the walk, and the other keys
+// sharing the prefix tell whether the listing is truncated. Returns
+// false if there is no such object.
+func listExactKey(ctx context.Context, bucket, prefix string, listDir ListDirFunc, isLeaf IsLeafFunc, resolver InfoResolver, opts ListOptions) (loi ListObjectsInfo, found bool, err error) {
+	prefixDir, name := "", opts.fromSlash(prefix)
+	if i := strings.LastIndex(name, opts.separator()); i >= 0 {
+		prefixDir, name = name[:i+1], name[i+1:]
+	}
+	if err = opts.waitListDir(ctx, nil); err != nil {
+		return loi, false, err
+	}
+	emptyDir, entries, delayIsLeaf := listDir(bucket, prefixDir, name)
+	if opts.Metrics != nil {
+		opts.Metrics.IncDirsWalked()
+	}
+	if emptyDir {
+		return loi, false, nil
+	}
+	var entry *Entry
+	for _, e := range trimLeadingSeparators(entries, opts.separator()) {
+		if !HasPrefix(e.Name, name) {
 			continue
 		}
-		result.Objects = append(result.Objects, objInfo)
+		// Objects listed with a trailing separator are leaves to tell apart.
+		if e.Name == name || delayIsLeaf && e.Name == name+opts.separator() &&
+			isLeaf(bucket, opts.join(prefixDir, e.Name)) {
+			entry = e
+			continue
+		}
+		loi.IsTruncated, loi.ObjectsTruncated = true, true
+	}
+	if entry == nil {
+		return loi, false, nil
+	}
+	objInfo, err := resolveObject(ctx, bucket, &Entry{Name: prefix, Info: entry.Info}, resolver, opts)
+	if err != nil || objInfo.IsDir || !opts.accepts(&objInfo) {
+		// Left to the walk, which tells the errors to ignore.
+		return ListObjectsInfo{}, false, nil
 	}
+	loi.Objects = []ObjectInfo{objInfo}
+	if loi.IsTruncated {
+		loi.NextMarker = prefix
+	}
+	return loi, true, nil
+}
 
-	if !eof {
-		result.IsTruncated = true
-		if len(objInfos) > 0 {
-			result.NextMarker = objInfos[len(objInfos)-1].Name
+// listPrefixDir - returns the keys under prefix in the directory of
+// prefix, with a trailing slash for the directories, as listed by a
+// single listDir call rather than a walk.
+func listPrefixDir(ctx context.Context, bucket, prefix string, listDir ListDirFunc, isLeaf IsLeafFunc, opts ListOptions) ([]string, error) {
+	prefixDir, entryPrefixMatch := "", opts.fromSlash(prefix)
+	if i := strings.LastIndex(entryPrefixMatch, opts.separator()); i >= 0 {
+		prefixDir, entryPrefixMatch = entryPrefixMatch[:i+1], entryPrefixMatch[i+1:]
+	}
+	if err := opts.waitListDir(ctx, nil); err != nil {
+		return nil, err
+	}
+	_, entries, delayIsLeaf := listDir(bucket, prefixDir, entryPrefixMatch)
+	if opts.Metrics != nil {
+		opts.Metrics.IncDirsWalked()
+	}
+	var names []string
+	for _, entry := range trimLeadingSeparators(entries, opts.separator()) {
+		name := opts.join(prefixDir, entry.Name)
+		if opts.isExcluded(name) {
+			continue
+		}
+		isDir := HasSuffix(name, opts.separator())
+		if delayIsLeaf {
+			isDir = !isLeaf(bucket, name)
 		}
+		name = strings.TrimSuffix(name, opts.separator())
+		if isDir {
+			name += opts.separator()
+		}
+		names = append(names, opts.toSlash(name))
 	}
+	return names, nil
+}
 
-	return result, nil
+// prefetchListDir - lists the directory of prefix, the first one a walk
+// for prefix lists, returning nil if nothing is listed. Otherwise the
+// listing is handed over to the walk rather than listed twice.
+func prefetchListDir(ctx context.Context, bucket, prefix string, listDir ListDirFunc, opts ListOptions) (*prefetchedDir, error) {
+	p := &prefetchedDir{entryPrefixMatch: opts.fromSlash(prefix)}
+	if i := strings.LastIndex(p.entryPrefixMatch, opts.separator()); i >= 0 {
+		p.prefixDir, p.entryPrefixMatch = p.entryPrefixMatch[:i+1], p.entryPrefixMatch[i+1:]
+	}
+	if err := opts.waitListDir(ctx, nil); err != nil {
+		return nil, err
+	}
+	p.emptyDir, p.entries, p.delayIsLeaf = listDir(bucket, p.prefixDir, p.entryPrefixMatch)
+	if p.emptyDir || len(p.entries) == 0 {
+		if opts.Metrics != nil {
+			opts.Metrics.IncDirsWalked()
+		}
+		return nil, nil
+	}
+	return p, nil
 }
 
-func listObjects(
+// addPrecedingPrefixes - adds the common prefixes up to marker, listed on
+// the previous pages, to prefixes. They are the directories listed by the
+// walk ahead of the marker.
+func addPrecedingPrefixes(ctx context.Context, bucket, prefix, marker string, listDir ListDirFunc, isLeaf IsLeafFunc, prefixes *foldedPrefixes, opts ListOptions) error {
+	names, err := listPrefixDir(ctx, bucket, prefix, listDir, isLeaf, opts)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if HasSuffix(name, SlashSeparator) && prefixListedBefore(name, marker) {
+			prefixes.add(name)
+		}
+	}
+	return nil
+}
+
+// setTruncatedKinds - tells whether objects, prefixes or both follow
+// the truncated page of a "/" delimited listing ending at marker.
+func (loi *ListObjectsInfo) setTruncatedKinds(ctx context.Context, bucket, prefix, marker string, listDir ListDirFunc, isLeaf IsLeafFunc, opts ListOptions) error {
+	names, err := listPrefixDir(ctx, bucket, prefix, listDir, isLeaf, opts)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name <= marker || name == prefix {
+			continue
+		}
+		if HasSuffix(name, SlashSeparator) {
+			loi.PrefixesTruncated = true
+		} else {
+			loi.ObjectsTruncated = true
+		}
+	}
+	return nil
+}
+
+// doListObjects - lists the objects for delimiters "" and SlashSeparator.
+func doListObjects(
 	ctx context.Context, bucket, prefix, marker, delimiter string, maxKeys int,
 	tpool *TreeWalkPool,
 	listDir ListDirFunc, isLeaf IsLeafFunc, isLeafDir IsLeafDirFunc,
-	getObjInfo func(context.Context, string, string, *ObjectInfo) (ObjectInfo, error),
-	getObjectInfoDirs ...func(context.Context, string, string, *ObjectInfo,
-	) (ObjectInfo, error)) (loi ListObjectsInfo, err error) {
-	if delimiter != SlashSeparator && delimiter != "" {
-		return listObjectsNonSlash(ctx, bucket, prefix, marker, delimiter, maxKeys, tpool, listDir, isLeaf, isLeafDir, getObjInfo, getObjectInfoDirs...)
-	}
-
+	resolver InfoResolver, opts ListOptions) (loi ListObjectsInfo, err error) {
 	// Marker is set validate pre-condition.
 	if marker != "" {
 		// Marker not common with prefix is not implemented. Send an empty response
@@ -108,11 +499,6 @@ func listObjects(
 		}
 	}
 
-	// With max keys of zero we have reached eof, return right here.
-	if maxKeys == 0 {
-		return loi, nil
-	}
-
 	// For delimiter and prefix as '/' we do not list anything at all
 	// since according to s3 spec we stop at the 'delimiter'
 	// along // with the prefix. On a flat namespace with 'prefix'
@@ -122,9 +508,16 @@ func listObjects(
 		return loi, nil
 	}
 
-	// Over flowing count - reset to maxObjectList.
-	if maxKeys < 0 || maxKeys > maxObjectList {
-		maxKeys = maxObjectList
+	// Listing a single key with the exact key as prefix is a common way
+	// of checking for its existence, try the key itself before walking.
+	// The names alone of ListKeys() do not tell whether it exists.
+	_, namesOnly := resolver.(keyResolver)
+	if delimiter == "" && maxKeys == 1 && marker == "" && prefix != "" && !namesOnly && opts.endBefore == "" &&
+		!HasSuffix(prefix, SlashSeparator) && !opts.isExcluded(opts.fromSlash(prefix)) && opts.matchesSuffix(prefix) && !opts.isFolderPlaceholder(prefix) && opts.checkKey(prefix) == nil {
+		loi, found, err := listExactKey(ctx, bucket, prefix, listDir, isLeaf, resolver, opts)
+		if err != nil || found {
+			return loi, err
+		}
 	}
 
 	// Default is recursive, if delimiter is set then list non recursive.
@@ -133,57 +526,273 @@ func listObjects(
 		recursive = false
 	}
 
-	walkResultCh, endWalkCh := tpool.Release(listParams{bucket, recursive, marker, prefix})
+	// Without a pool every page starts a walk of its own.
+	walkKey, pooled := opts.poolKey()
+	if !pooled {
+		tpool = nil
+	}
+	var walkResultCh chan TreeWalkResult
+	var endWalkCh chan struct{}
+	// The walks skipping the directory of the marker start afresh.
+	if tpool != nil && !(opts.SkipMarkerSubtree && marker != "") {
+		walkResultCh, endWalkCh = tpool.Release(listParams{bucket, recursive, marker, prefix, walkKey})
+		if walkResultCh == nil && marker != "" {
+			// The client switched between "/" and no delimiter with the
+			// marker of the other, the walk parked for it is of no use.
+			tpool.Evict(listParams{bucket, !recursive, marker, prefix, walkKey})
+		}
+	}
 	if walkResultCh == nil {
+		// Spare the walk to an empty bucket or prefix. The listings
+		// checked for changes are left to the walk.
+		if !opts.CheckDirChanges {
+			if opts.prefetched, err = prefetchListDir(ctx, bucket, prefix, listDir, opts); err != nil || opts.prefetched == nil {
+				return loi, err
+			}
+		}
 		endWalkCh = make(chan struct{})
-		walkResultCh = startTreeWalk(ctx, bucket, prefix, marker, recursive, listDir, isLeaf, isLeafDir, endWalkCh)
+		// The walk may be saved in the pool for the next page, so it
+		// must outlive the context of this request.
+		if recursive && opts.resumeDir != "" {
+			walkResultCh = resumeTreeWalk(context.WithoutCancel(ctx), bucket, prefix, opts.resumeDir, strings.TrimPrefix(marker, opts.resumeDir),
+				listDir, isLeaf, isLeafDir, opts.WalkOptions, endWalkCh)
+		} else {
+			walkResultCh = startTreeWalk(context.WithoutCancel(ctx), bucket, prefix, marker, recursive, listDir, isLeaf, isLeafDir, opts.WalkOptions, endWalkCh)
+		}
 	}
 
 	var eof bool
 	var nextMarker string
 
-	// List until maxKeys requested.
-	g := errgroup.WithNErrs(maxKeys).WithConcurrency(10)
-	ctx, cancel := g.WithCancelOnError(ctx)
+	// List until maxKeys requested. The entries left out of the listing,
+	// deleted in the interim period for instance, do not count toward
+	// maxKeys, so keep walking until the page is full. Neither do the
+	// directories which might have vanished, listed as plain ones.
+	var objInfos []ObjectInfo
+	var vanished int
+	var deadline chan struct{}
+	if opts.FirstByteDeadline > 0 {
+		deadline = make(chan struct{})
+		timer := time.AfterFunc(opts.FirstByteDeadline, func() { close(deadline) })
+		defer timer.Stop()
+	}
+rounds:
+	for !eof && len(objInfos)-vanished < maxKeys {
+		if len(objInfos) > 0 {
+			select {
+			case <-deadline:
+				break rounds
+			default:
+			}
+		}
+		var found []ObjectInfo
+		var n int
+		found, n, eof, err = resolveWalkResults(ctx, bucket, walkResultCh, maxKeys-len(objInfos)+vanished, resolver, opts, deadline)
+		if err == nil {
+			// Do not swallow a cancellation which raced with the end of the page.
+			err = ctx.Err()
+		}
+		if err != nil {
+			// The walk is not reused, make sure it ends.
+			close(endWalkCh)
+			return loi, err
+		}
+		objInfos = append(objInfos, found...)
+		vanished += n
+	}
+	if len(objInfos) > 0 {
+		nextMarker = objInfos[len(objInfos)-1].Name
+	}
+
+	// Save list routine for the next marker if we haven't reached EOF.
+	params := listParams{bucket, recursive, nextMarker, prefix, walkKey}
+	if !eof {
+		if tpool != nil && !opts.lastPage {
+			tpool.Set(params, walkResultCh, endWalkCh)
+		} else {
+			close(endWalkCh)
+		}
+	} else if opts.endBefore != "" {
+		// The walk might have gone on past the end of the listing.
+		close(endWalkCh)
+	}
+
+	result := ListObjectsInfo{}
+	prefixes := foldedPrefixes{caseInsensitive: opts.CaseInsensitive}
+	if opts.CaseInsensitive && delimiter == SlashSeparator && marker != "" {
+		// Fold the prefixes against the ones of the previous pages.
+		if err = addPrecedingPrefixes(ctx, bucket, prefix, marker, listDir, isLeaf, &prefixes, opts); err != nil {
+			return loi, err
+		}
+	}
+	for _, objInfo := range objInfos {
+		if objInfo.IsDir && delimiter == SlashSeparator && objInfo.Name != prefix {
+			if prefixes.add(objInfo.Name) {
+				result.addPrefix(objInfo, opts)
+			}
+			continue
+		}
+		// The placeholder object of a directory is a prefix as well.
+		if opts.ExplicitDirObjects && delimiter == SlashSeparator && objInfo.Name != prefix &&
+			HasSuffix(objInfo.Name, SlashSeparator) && prefixes.add(objInfo.Name) {
+			result.addPrefix(objInfo, opts)
+		}
+		result.Objects = append(result.Objects, objInfo)
+	}
+
+	if !eof {
+		result.IsTruncated = true
+		if len(objInfos) > 0 {
+			result.NextMarker = objInfos[len(objInfos)-1].Name
+		}
+		if delimiter != SlashSeparator {
+			result.ObjectsTruncated = true
+		} else if err = result.setTruncatedKinds(ctx, bucket, prefix, result.NextMarker, listDir, isLeaf, opts); err != nil {
+			return loi, err
+		}
+	}
+
+	// Success.
+	return result, nil
+}
+
+// synthesizeDirStat - fills the ModTime of a directory lacking one from
+// the listed info, of the directory or of the first key under it.
+func synthesizeDirStat(objInfo, listed *ObjectInfo) {
+	if objInfo.ModTime.IsZero() && listed != nil {
+		objInfo.ModTime = listed.ModTime
+	}
+}
+
+// carrySys - carries the backend specific details listed with an entry
+// over to its resolved ObjectInfo, unless resolving set them.
+func carrySys(objInfo, listed *ObjectInfo) {
+	if objInfo.Sys == nil && listed != nil {
+		objInfo.Sys = listed.Sys
+	}
+}
+
+// resolveWalkResults - resolves the ObjectInfo of the next n entries of
+// the walk in parallel, returning the ones found in walk order along
+// with whether the walk has ended and how many of them are directories
+// which might have vanished. Fewer entries are read once deadline is
+// closed.
+func resolveWalkResults(ctx context.Context, bucket string, walkResultCh <-chan TreeWalkResult, n int, resolver InfoResolver, opts ListOptions, deadline <-chan struct{}) (objInfos []ObjectInfo, vanished int, eof bool, err error) {
+	var walkErr error
+	concurrency := opts.Concurrency
+	if opts.AdaptiveConcurrency != nil {
+		concurrency = opts.AdaptiveConcurrency.Concurrency()
+		defer opts.AdaptiveConcurrency.adapt()
+	}
+	g := errgroup.WithNErrs(n).WithConcurrency(concurrency)
+	gctx, cancel := g.WithCancelOnError(ctx)
 	defer cancel()
 
-	objInfoFound := make([]*ObjectInfo, maxKeys)
-	var i int
-	for i = 0; i < maxKeys; i++ {
+	objInfoFound := make([]*ObjectInfo, n)
+	var vanishedDirs atomic.Int64
+	var walkTime time.Duration
+	var statStart, statEnd time.Time
+	var stats int
+	defer func() {
+		var statTime time.Duration
+		if stats > 0 {
+			statTime = statEnd.Sub(statStart)
+		}
+		opts.Timing.add(walkTime, statTime, stats)
+	}()
+	// The entries are resolved in the errgroup, timed from the first one.
+	resolve := func(fn func() error, i int) {
+		if stats == 0 {
+			statStart = time.Now()
+		}
+		stats++
+		g.Go(fn, i)
+	}
+	for i := 0; i < n; i++ {
 		i := i
-		walkResult, ok := <-walkResultCh
+		var walkResult TreeWalkResult
+		var ok, expired bool
+		// Past the deadline the round ends with the entries read so far,
+		// at least one for the page to make progress.
+		var deadlineCh <-chan struct{}
+		if i > 0 {
+			deadlineCh = deadline
+		}
+		walkStart := time.Now()
+		select {
+		case walkResult, ok = <-walkResultCh:
+		case <-gctx.Done():
+			walkResult, ok = TreeWalkResult{err: gctx.Err()}, true
+		case <-deadlineCh:
+			expired = true
+		}
+		walkTime += time.Since(walkStart)
+		if expired {
+			break
+		}
 		if !ok {
 			// Closed channel.
 			eof = true
 			break
 		}
+		if walkResult.err != nil {
+			walkErr = walkResult.err
+			break
+		}
+		if opts.endBefore != "" && walkResult.entry.Name >= opts.endBefore {
+			// Past the end of the listing, the walk is read no further.
+			eof = true
+			break
+		}
 
-		if HasSuffix(walkResult.entry.Name, SlashSeparator) {
-			g.Go(func() error {
-				for _, getObjectInfoDir := range getObjectInfoDirs {
-					objInfo, err := getObjectInfoDir(ctx, bucket, walkResult.entry.Name, walkResult.entry.Info)
-					if err == nil {
-						objInfoFound[i] = &objInfo
-						// Done...
+		if HasSuffix(walkResult.entry.Name, SlashSeparator) && opts.skipsDirStat() {
+			// Listed by name, the walk has told it is a directory.
+			objInfoFound[i] = &ObjectInfo{
+				Bucket: bucket,
+				Name:   walkResult.entry.Name,
+				IsDir:  true,
+			}
+			carrySys(objInfoFound[i], walkResult.entry.Info)
+		} else if HasSuffix(walkResult.entry.Name, SlashSeparator) {
+			resolve(func() (err error) {
+				defer recoverBackendPanic(&err)
+				if opts.Metrics != nil {
+					opts.Metrics.IncObjInfoCalls()
+				}
+				defer opts.AdaptiveConcurrency.observe(time.Now())
+				objInfo, err := statEntry(gctx, walkResult.entry.Name, opts, func(ctx context.Context) (ObjectInfo, error) {
+					return resolver.ResolveDir(ctx, bucket, walkResult.entry.Name, walkResult.entry.Info)
+				})
+				opts.omitUnrequested(&objInfo)
+				if err != nil {
+					if err == errSkipEntry {
 						return nil
 					}
-
-					// Add temp, may be overridden,
+					// The directory might have got deleted in the interim
+					// period, list it as a plain directory.
 					if err == syscall.ENOENT || os.IsNotExist(err) {
-						objInfoFound[i] = &ObjectInfo{
+						objInfo = ObjectInfo{
 							Bucket: bucket,
 							Name:   walkResult.entry.Name,
 							IsDir:  true,
 						}
-						continue
+						vanishedDirs.Add(1)
+					} else {
+						return err
 					}
-					return err
 				}
+				if opts.SynthesizeDirStat {
+					synthesizeDirStat(&objInfo, walkResult.entry.Info)
+				}
+				carrySys(&objInfo, walkResult.entry.Info)
+				objInfoFound[i] = &objInfo
 				return nil
 			}, i)
 		} else {
-			g.Go(func() error {
-				objInfo, err := getObjInfo(ctx, bucket, walkResult.entry.Name, walkResult.entry.Info)
+			resolve(func() (err error) {
+				defer recoverBackendPanic(&err)
+				defer opts.AdaptiveConcurrency.observe(time.Now())
+				objInfo, err := resolveObject(gctx, bucket, walkResult.entry, resolver, opts)
 				if err != nil {
 					// Ignore errFileNotFound as the object might have got
 					// deleted in the interim period of listing and getObjectInfo(),
@@ -193,6 +802,9 @@ func listObjects(
 					}
 					return err
 				}
+				if !opts.accepts(&objInfo) {
+					return nil
+				}
 				objInfoFound[i] = &objInfo
 				return nil
 			}, i)
@@ -203,41 +815,18 @@ func listObjects(
 			break
 		}
 	}
-	if err := g.WaitErr(); err != nil {
-		return loi, err
+	err = g.WaitErr()
+	statEnd = time.Now()
+	if err == nil {
+		err = walkErr
 	}
-	// Copy found objects
-	objInfos := make([]ObjectInfo, 0, i+1)
-	for _, objInfo := range objInfoFound {
-		if objInfo == nil {
-			continue
-		}
-		objInfos = append(objInfos, *objInfo)
-		nextMarker = objInfo.Name
-	}
-
-	// Save list routine for the next marker if we haven't reached EOF.
-	params := listParams{bucket, recursive, nextMarker, prefix}
-	if !eof {
-		tpool.Set(params, walkResultCh, endWalkCh)
-	}
-
-	result := ListObjectsInfo{}
-	for _, objInfo := range objInfos {
-		if objInfo.IsDir && delimiter == SlashSeparator && objInfo.Name != prefix {
-			result.Prefixes = append(result.Prefixes, objInfo.Name)
-			continue
-		}
-		result.Objects = append(result.Objects, objInfo)
+	if err != nil {
+		return nil, 0, false, err
 	}
-
-	if !eof {
-		result.IsTruncated = true
-		if len(objInfos) > 0 {
-			result.NextMarker = objInfos[len(objInfos)-1].Name
+	for _, objInfo := range objInfoFound {
+		if objInfo != nil {
+			objInfos = append(objInfos, *objInfo)
 		}
 	}
-
-	// Success.
-	return result, nil
+	return objInfos, int(vanishedDirs.Load()), eof, nil
 }
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// AdaptiveConcurrency - adapts the number of objects resolved in parallel
+// by the listings to the latency of resolving them, between Min and Max.
+// After each round of resolutions it goes up by one when they took less
+// than Target on average, and halves when they took longer. It may be
+// shared by listings to adapt them as a whole.
+type AdaptiveConcurrency struct {
+	Min    int
+	Max    int
+	Target time.Duration
+
+	mu      sync.Mutex
+	limit   int
+	latency time.Duration // Sum of the latencies observed since adapt().
+	samples int
+}
+
+// bounds - returns Min and Max, at least one and Min respectively.
+func (a *AdaptiveConcurrency) bounds() (int, int) {
+	lo := max(a.Min, 1)
+	return lo, max(a.Max, lo)
+}
+
+// Concurrency - returns the number of objects resolved in parallel.
+func (a *AdaptiveConcurrency) Concurrency() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	lo, hi := a.bounds()
+	a.limit = min(max(a.limit, lo), hi)
+	return a.limit
+}
+
+// observe - observes the latency of a resolution started at start.
+func (a *AdaptiveConcurrency) observe(start time.Time) {
+	if a == nil {
+		return
+	}
+	latency := time.Since(start)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.latency += latency
+	a.samples++
+}
+
+// adapt - adapts the concurrency to the latencies observed so far.
+func (a *AdaptiveConcurrency) adapt() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.samples == 0 {
+		return
+	}
+	lo, hi := a.bounds()
+	if a.latency/time.Duration(a.samples) < a.Target {
+		a.limit++
+	} else {
+		a.limit /= 2
+	}
+	a.limit = min(max(a.limit, lo), hi)
+	a.latency, a.samples = 0, 0
+}
+
+// globalStatSem - bounds the number of objects resolved in parallel by
+// all the listings together, nil when unbounded.
+var globalStatSem struct {
+	mu sync.RWMutex
+	ch chan struct{}
+}
+
+// SetGlobalStatConcurrency - bounds the number of objects resolved in
+// parallel by all the listings of the process together to n, on top of
+// the concurrency of each listing. Zero or negative values, the
+// default, lift the bound. The objects being resolved at the time count
+// towards the bound they were started with.
+func SetGlobalStatConcurrency(n int) {
+	globalStatSem.mu.Lock()
+	defer globalStatSem.mu.Unlock()
+	if n <= 0 {
+		globalStatSem.ch = nil
+		return
+	}
+	globalStatSem.ch = make(chan struct{}, n)
+}
+
+// acquireStat - waits for a slot to resolve an object in, returning the
+// function releasing it.
+func acquireStat(ctx context.Context) (func(), error) {
+	globalStatSem.mu.RLock()
+	sem := globalStatSem.ch
+	globalStatSem.mu.RUnlock()
+	if sem == nil {
+		return func() {}, nil
+	}
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+)
+
+// ListCursor - position of a listing which, unlike the walks parked in a
+// TreeWalkPool, survives process restarts. PrefixDir is the directory the
+// walk starts from, Dir the directory below it the walk was in and Marker
+// the last name listed in Dir. Recursive walks resume right in Dir.
+type ListCursor struct {
+	PrefixDir string `json:"d"`
+	Dir       string `json:"w,omitempty"`
+	Marker    string `json:"m"`
+	Recursive bool   `json:"r"`
+}
+
+// EncodeCursor - encodes the cursor into an opaque URL safe string.
+func EncodeCursor(cursor ListCursor) string {
+	buf, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// DecodeCursor - decodes a cursor encoded by EncodeCursor().
+func DecodeCursor(s string) (cursor ListCursor, err error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor, ErrInvalidCursor
+	}
+	if err = json.Unmarshal(buf, &cursor); err != nil {
+		return cursor, ErrInvalidCursor
+	}
+	return cursor, nil
+}
+
+// listCursorPrefixDir - the directory a walk for prefix starts from.
+func listCursorPrefixDir(prefix string) string {
+	return prefix[:strings.LastIndex(prefix, SlashSeparator)+1]
+}
+
+// listCursorDir - the directory of name, a key or a directory below it.
+func listCursorDir(name string) string {
+	return name[:strings.LastIndex(strings.TrimSuffix(name, SlashSeparator), SlashSeparator)+1]
+}
+
+// listObjectsWithCursor - like listObjectsWithResolver() but resumes
+// from and returns opaque cursors instead of markers. An empty cursor
+// starts the listing, an empty nextCursor means there is nothing left.
+func listObjectsWithCursor(
+	ctx context.Context, bucket, prefix, cursor, delimiter string, maxKeys int,
+	tpool *TreeWalkPool,
+	listDir ListDirFunc, isLeaf IsLeafFunc, isLeafDir IsLeafDirFunc,
+	resolver InfoResolver, opts ListOptions) (loi ListObjectsInfo, nextCursor string, err error) {
+	c := ListCursor{
+		PrefixDir: listCursorPrefixDir(prefix),
+		Recursive: delimiter != SlashSeparator,
+	}
+	if cursor != "" {
+		resumed, err := DecodeCursor(cursor)
+		if err != nil {
+			return loi, "", err
+		}
+		// The cursor must come from a listing of the same kind.
+		if resumed.PrefixDir != c.PrefixDir || resumed.Recursive != c.Recursive ||
+			!HasPrefix(resumed.PrefixDir+resumed.Dir+resumed.Marker, prefix) ||
+			resumed.Dir != listCursorDir(resumed.Dir+resumed.Marker) {
+			return loi, "", ErrInvalidCursor
+		}
+		c.Dir, c.Marker = resumed.Dir, resumed.Marker
+	}
+
+	marker := ""
+	if c.Marker != "" {
+		marker = c.PrefixDir + c.Dir + c.Marker
+		if c.Dir != "" {
+			opts.resumeDir = c.PrefixDir + c.Dir
+		}
+	}
+	loi, err = listObjectsWithResolver(ctx, bucket, prefix, marker, delimiter, maxKeys, tpool, listDir, isLeaf, isLeafDir, resolver, opts)
+	if err != nil || !loi.IsTruncated || loi.NextMarker == "" {
+		return loi, "", err
+	}
+	name := strings.TrimPrefix(loi.NextMarker, c.PrefixDir)
+	c.Dir = listCursorDir(name)
+	c.Marker = strings.TrimPrefix(name, c.Dir)
+	return loi, EncodeCursor(c), nil
+}
@@ -1,6 +1,10 @@
 package cmd
 
-import "time"
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+)
 
 type ObjectInfo struct {
 	// Name of the bucket.
@@ -57,6 +61,50 @@ type ObjectInfo struct {
 
 	// Specify object storage class
 	StorageClass string
+
+	// Identity of the stored data, such as device and inode on FS
+	// backends, shared by the names hard linked to the same data.
+	Identity string
+
+	// Owner of the object, such as the ID of its user on FS backends.
+	// Listed with FetchOwner only.
+	Owner string
+
+	// Object lock retention mode, GOVERNANCE or COMPLIANCE, and the date
+	// until which the object is retained. Listed with FetchRetention only.
+	RetentionMode string
+	RetainUntil   time.Time
+
+	// User defined metadata, such as the tags of the object.
+	UserDefined map[string]string
+
+	// Backend specific details, such as the link count, inode and mode
+	// bits of the file on FS backends, as with os.FileInfo.Sys(). Carried
+	// over untouched from the info listed with the entry when resolving
+	// does not set it, and left out of the JSON encoding.
+	Sys interface{} `json:"-"`
+}
+
+// Projection - the fields of ObjectInfo listed on top of the names, as
+// a set of the Project flags. The zero Projection lists all of them.
+type Projection uint
+
+const (
+	// ProjectName lists the names alone, unless along with other fields.
+	ProjectName Projection = 1 << iota
+	// ProjectSize lists Size.
+	ProjectSize
+	// ProjectModTime lists ModTime.
+	ProjectModTime
+	// ProjectETag lists ETag and InnerETag.
+	ProjectETag
+	// ProjectMetadata lists UserDefined.
+	ProjectMetadata
+)
+
+// Has - returns true if the projection lists field.
+func (p Projection) Has(field Projection) bool {
+	return p == 0 || p&field != 0
 }
 
 // ListObjectsInfo - container for list objects.
@@ -75,9 +123,434 @@ type ListObjectsInfo struct {
 	//       MinIO always returns NextMarker.
 	NextMarker string
 
+	// ObjectsTruncated and PrefixesTruncated tell whether objects or
+	// common prefixes follow a truncated listing, or both, such as for
+	// clients showing "more files" apart from "more folders". Listings
+	// with a "/" delimiter tell them apart from the directory listing,
+	// listed once more for truncated pages, and with no delimiter set
+	// ObjectsTruncated alone. Listings with other delimiters set both.
+	ObjectsTruncated  bool
+	PrefixesTruncated bool
+
 	// List of objects info for this request.
 	Objects []ObjectInfo
 
 	// List of prefixes for this request.
 	Prefixes []string
+
+	// PrefixInfos holds the stat of each of Prefixes, in the same order,
+	// with ListOptions.SynthesizeDirStat.
+	PrefixInfos []ObjectInfo
+
+	// KeyCount is the number of keys returned, objects and prefixes.
+	KeyCount int
+
+	// Entries lists the objects and the prefixes together in the order
+	// of their names, with ListOptions.Merged. NextMarker resumes it.
+	Entries []ListEntry
+}
+
+// ListEntry - an object or a prefix of a merged listing.
+type ListEntry struct {
+	Name     string
+	IsPrefix bool
+	Info     *ObjectInfo // Nil for prefixes, unless their stat is listed.
+}
+
+// ListOptions - parameters and optional behaviour of a listing.
+type ListOptions struct {
+	// Delimiter groups the keys into common prefixes, empty to list
+	// all the keys recursively. It is a single character, unless
+	// MultiCharDelimiter allows longer ones, and not white space.
+	Delimiter          string
+	MultiCharDelimiter bool
+
+	// Marker is the key after which the listing starts, StartAfter
+	// is used instead when Marker is empty. The markers carry over
+	// between delimiters: a marker within a common prefix, such as the
+	// one of a listing without a delimiter, lists the prefix when keys
+	// follow the marker in it, while a marker naming a common prefix, as
+	// the pages of delimited listings end with, continues past all of it.
+	Marker     string
+	StartAfter string
+
+	// MaxKeys is the maximum number of keys returned, zero, negative
+	// or over flowing values list up to DefaultMaxObjectList keys.
+	MaxKeys int
+
+	// EncodingType "url" URL encodes the keys in the result.
+	EncodingType string
+
+	// Concurrency is the number of objects resolved in parallel, zero
+	// or negative values resolve DefaultListConcurrency at a time.
+	Concurrency int
+
+	// AdaptiveConcurrency, when set, adapts the number of objects
+	// resolved in parallel to their latency, in place of Concurrency.
+	AdaptiveConcurrency *AdaptiveConcurrency
+
+	WalkOptions
+
+	// PlaceholderOnENOTSUP lists entries whose stat fails with ENOTSUP,
+	// such as links to external file systems, as empty objects instead
+	// of failing the listing.
+	PlaceholderOnENOTSUP bool
+
+	// CaseInsensitive folds the common prefixes differing in case only,
+	// such as "Photos/" and "photos/", into the first of them in listing
+	// order, across pages as well. Paging a "/" delimited listing lists
+	// the directory once more per page, for the prefixes of the previous
+	// pages.
+	CaseInsensitive bool
+
+	// Accept, when set, filters the objects of the listing, such as on
+	// their size. Rejected objects do not count toward MaxKeys. It must
+	// be safe for concurrent use.
+	Accept func(info *ObjectInfo) bool
+
+	// TagMatch, when set, lists the objects whose UserDefined metadata
+	// holds all of its keys with the same values alone. Like with Accept,
+	// the other objects do not count toward MaxKeys.
+	TagMatch map[string]string
+
+	// ExistsHint, when set, is consulted before resolving an object, such
+	// as against a bloom filter of the existing keys. The objects it says
+	// do not exist are left out without being resolved, like the objects
+	// deleted in the interim period of listing. It must be safe for
+	// concurrent use.
+	ExistsHint func(name string) bool
+
+	// Merged lists the objects and the prefixes in ListObjectsInfo.Entries
+	// as well, for the clients rendering folders and files together.
+	Merged bool
+
+	// StripDelimiterFromPrefixes lists the prefixes without the trailing
+	// delimiter, "a1" rather than "a1/", for the tools wanting the bare
+	// folder names. S3 keeps it, as is the default. The prefixes stay in
+	// the order of their names with the delimiter, and NextMarker keeps
+	// it to resume the listing with.
+	StripDelimiterFromPrefixes bool
+
+	// FirstByteDeadline, when set, ends the page early once it is past
+	// and at least one object was listed, for the interactive clients
+	// which want the first keys fast. The page is truncated with a
+	// NextMarker as usual, and the walk resumes with the next page. It
+	// applies to the listings with a "/" or no delimiter.
+	FirstByteDeadline time.Duration
+
+	// StatTimeout, when set, bounds the time resolving the ObjectInfo of
+	// each entry takes, such as for network file systems which may hang.
+	// The entries taking longer are left out, the directories listed as
+	// plain ones, unless StatTimeoutFatal fails the listing with
+	// ErrStatTimeout instead. Resolvers are handed a context with the
+	// deadline, the listing does not wait for them past it either way.
+	StatTimeout      time.Duration
+	StatTimeoutFatal bool
+
+	// Timing, when set, receives the time spent walking and resolving
+	// the entries of the listing.
+	Timing *ListTiming
+
+	// StatCache, when set, caches the ObjectInfo of the objects across
+	// the listings sharing it, for them to be resolved once per TTL.
+	StatCache *StatCache
+
+	// FetchRetention lists the object lock retention of the objects.
+	// Resolvers tell it is requested with RetentionRequested() and may
+	// skip the extra cost of resolving it otherwise.
+	FetchRetention bool
+
+	// FetchOwner lists the owner of the objects, like fetch-owner does
+	// for ListObjectsV2. Resolvers tell it is requested with
+	// OwnerRequested() and may skip the extra cost of resolving it
+	// otherwise.
+	FetchOwner bool
+
+	// Projection, when set, lists only the fields of the objects it has,
+	// leaving the others zero, such as to spare the memory of listing
+	// millions of keys. Resolvers tell the fields requested with
+	// ProjectionRequested() and may skip the extra cost of resolving the
+	// others. With ProjectName alone the objects are listed by the names
+	// the backend lists without being resolved at all, unless Accept or
+	// TagMatch are set. Accept and TagMatch see the projected objects.
+	Projection Projection
+
+	// SynthesizeDirStat lists the stat of the common prefixes of "/" and
+	// other delimiters in ListObjectsInfo.PrefixInfos, synthesized from
+	// the listing of the backend for the prefixes lacking a directory
+	// object with a modification time, as told by the resolver: their
+	// ModTime is the one of the first key under them as listed.
+	SynthesizeDirStat bool
+
+	// SkipDirStat lists the common prefixes of "/" listings by the names
+	// the backend lists alone, without resolving them through ResolveDir,
+	// for the folder listings which need no more. Directories deleted in
+	// the interim period are listed all the same. It is ignored with
+	// SynthesizeDirStat, which needs their stat.
+	SkipDirStat bool
+
+	// Stream, when set, is handed the objects and the prefixes of the
+	// page in the order of their names in place of ListObjectsInfo, which
+	// is left without them. Listings with delimiters other than "/" hand
+	// them over as they walk, holding none of the page in memory, while
+	// the others resolve the page at once first. An error ends the
+	// listing with it.
+	Stream func(entry ListEntry) error
+
+	// Alias, when set, walks the listings of prefixes under its External
+	// prefix under its Internal prefix instead, with the keys and the
+	// markers named under External.
+	Alias PrefixAlias
+
+	lastPage  bool   // No page follows, end the walk rather than pooling it.
+	resumeDir string // Directory of the marker to resume a new walk from.
+	endBefore string // Key the listing ends before, if set.
+}
+
+// PrefixAlias - an External prefix the keys under the Internal prefix
+// of the backend are listed under, such as the alias of a bucket.
+type PrefixAlias struct {
+	External string
+	Internal string
+}
+
+// toInternal - returns name, under External, under Internal instead.
+func (a PrefixAlias) toInternal(name string) string {
+	return a.Internal + name[len(a.External):]
+}
+
+// toExternal - returns name, under Internal, under External instead.
+func (a PrefixAlias) toExternal(name string) string {
+	if !HasPrefix(name, a.Internal) {
+		return name
+	}
+	return a.External + name[len(a.Internal):]
+}
+
+// alias - returns the listing with its keys named under alias.External.
+func (loi ListObjectsInfo) alias(alias PrefixAlias) ListObjectsInfo {
+	for i := range loi.Objects {
+		loi.Objects[i].Name = alias.toExternal(loi.Objects[i].Name)
+	}
+	for i := range loi.Prefixes {
+		loi.Prefixes[i] = alias.toExternal(loi.Prefixes[i])
+	}
+	for i := range loi.PrefixInfos {
+		loi.PrefixInfos[i].Name = alias.toExternal(loi.PrefixInfos[i].Name)
+	}
+	loi.NextMarker = alias.toExternal(loi.NextMarker)
+	return loi
+}
+
+// stripDelimiter - trims the trailing delimiter off the prefixes.
+func (loi ListObjectsInfo) stripDelimiter(delimiter string) ListObjectsInfo {
+	for i := range loi.Prefixes {
+		loi.Prefixes[i] = strings.TrimSuffix(loi.Prefixes[i], delimiter)
+	}
+	for i := range loi.PrefixInfos {
+		loi.PrefixInfos[i].Name = strings.TrimSuffix(loi.PrefixInfos[i].Name, delimiter)
+	}
+	for i := range loi.Entries {
+		if loi.Entries[i].IsPrefix {
+			loi.Entries[i].Name = strings.TrimSuffix(loi.Entries[i].Name, delimiter)
+		}
+	}
+	return loi
+}
+
+// accepts - returns true if the object is to be listed, as told by
+// Accept and TagMatch.
+func (opts *ListOptions) accepts(info *ObjectInfo) bool {
+	for key, value := range opts.TagMatch {
+		if v, ok := info.UserDefined[key]; !ok || v != value {
+			return false
+		}
+	}
+	return opts.Accept == nil || opts.Accept(info)
+}
+
+// omitUnrequested - clears the fields of objInfo the listing did not
+// request, which resolvers may fill regardless.
+func (opts *ListOptions) omitUnrequested(objInfo *ObjectInfo) {
+	if !opts.FetchRetention {
+		objInfo.RetentionMode, objInfo.RetainUntil = "", time.Time{}
+	}
+	if !opts.FetchOwner {
+		objInfo.Owner = ""
+	}
+	if !opts.Projection.Has(ProjectSize) {
+		objInfo.Size = 0
+	}
+	if !opts.Projection.Has(ProjectModTime) {
+		objInfo.ModTime = time.Time{}
+	}
+	if !opts.Projection.Has(ProjectETag) {
+		objInfo.ETag, objInfo.InnerETag = "", ""
+	}
+	if !opts.Projection.Has(ProjectMetadata) {
+		objInfo.UserDefined = nil
+	}
+}
+
+// namesOnly - returns true if the objects are listed by their names
+// alone, without being resolved.
+func (opts *ListOptions) namesOnly() bool {
+	return opts.Projection == ProjectName && opts.Accept == nil && opts.TagMatch == nil
+}
+
+// skipsDirStat - returns true if the directories are listed without
+// being resolved.
+func (opts *ListOptions) skipsDirStat() bool {
+	return opts.SkipDirStat && !opts.SynthesizeDirStat && opts.Delimiter == SlashSeparator
+}
+
+// validate - validates the options, normalizing the ones with defaults.
+func (opts *ListOptions) validate() error {
+	if opts.EncodingType != "" && !strings.EqualFold(opts.EncodingType, "url") {
+		return ErrInvalidEncodingType
+	}
+	if d := opts.Delimiter; d != "" && strings.TrimSpace(d) == "" ||
+		utf8.RuneCountInString(d) > 1 && !opts.MultiCharDelimiter {
+		return ErrInvalidDelimiter
+	}
+	// Over flowing count - reset to DefaultMaxObjectList.
+	if opts.MaxKeys <= 0 || opts.MaxKeys > DefaultMaxObjectList {
+		opts.MaxKeys = DefaultMaxObjectList
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultListConcurrency
+	}
+	return nil
+}
+
+// ListBackend - the backend a listing walks and resolves the entries of.
+type ListBackend struct {
+	// Pool parks the walks of truncated pages for the pages following
+	// them. When nil, every page starts a walk of its own and ends it.
+	Pool *TreeWalkPool
+
+	ListDir   ListDirFunc
+	IsLeaf    IsLeafFunc
+	IsLeafDir IsLeafDirFunc
+	Resolver  InfoResolver
+}
+
+// encode - returns the listing with its keys encoded as requested by
+// the encoding type.
+func (loi ListObjectsInfo) encode(encodingType string) ListObjectsInfo {
+	if encodingType == "" {
+		return loi
+	}
+	for i := range loi.Objects {
+		loi.Objects[i].Name = s3EncodeName(loi.Objects[i].Name, encodingType)
+	}
+	for i := range loi.Prefixes {
+		loi.Prefixes[i] = s3EncodeName(loi.Prefixes[i], encodingType)
+	}
+	for i := range loi.PrefixInfos {
+		loi.PrefixInfos[i].Name = s3EncodeName(loi.PrefixInfos[i].Name, encodingType)
+	}
+	for i := range loi.Entries {
+		// The Info of objects is shared with Objects, of prefixes with
+		// PrefixInfos.
+		loi.Entries[i].Name = s3EncodeName(loi.Entries[i].Name, encodingType)
+	}
+	loi.NextMarker = s3EncodeName(loi.NextMarker, encodingType)
+	return loi
+}
+
+// merge - fills Entries with the objects and the prefixes, merged in
+// the order of their names. Both are sorted already.
+func (loi *ListObjectsInfo) merge() {
+	loi.Entries = make([]ListEntry, 0, len(loi.Objects)+len(loi.Prefixes))
+	var i, j int
+	for i < len(loi.Objects) || j < len(loi.Prefixes) {
+		if j == len(loi.Prefixes) || i < len(loi.Objects) && loi.Objects[i].Name < loi.Prefixes[j] {
+			loi.Entries = append(loi.Entries, ListEntry{Name: loi.Objects[i].Name, Info: &loi.Objects[i]})
+			i++
+			continue
+		}
+		loi.Entries = append(loi.Entries, ListEntry{Name: loi.Prefixes[j], IsPrefix: true, Info: loi.prefixInfo(j)})
+		j++
+	}
+}
+
+// stream - hands the objects and the prefixes over to stream, in the
+// order of their names, leaving the listing without them.
+func (loi *ListObjectsInfo) stream(stream func(entry ListEntry) error) error {
+	loi.KeyCount += len(loi.Objects) + len(loi.Prefixes)
+	loi.merge()
+	for _, entry := range loi.Entries {
+		if err := stream(entry); err != nil {
+			return err
+		}
+	}
+	loi.Objects, loi.Prefixes, loi.PrefixInfos, loi.Entries = nil, nil, nil, nil
+	return nil
+}
+
+// prefixInfo - returns the stat of the i-th prefix, nil if not listed
+// for every prefix.
+func (loi *ListObjectsInfo) prefixInfo(i int) *ObjectInfo {
+	if len(loi.PrefixInfos) == len(loi.Prefixes) {
+		return &loi.PrefixInfos[i]
+	}
+	return nil
+}
+
+// addPrefix - adds the common prefix of objInfo, with its stat when
+// requested.
+func (loi *ListObjectsInfo) addPrefix(objInfo ObjectInfo, opts ListOptions) {
+	loi.Prefixes = append(loi.Prefixes, objInfo.Name)
+	if opts.SynthesizeDirStat {
+		objInfo.IsDir = true
+		loi.PrefixInfos = append(loi.PrefixInfos, objInfo)
+	}
+}
+
+// appendPrefix - appends the i-th prefix of from, with its stat if listed.
+func (loi *ListObjectsInfo) appendPrefix(from *ListObjectsInfo, i int) {
+	loi.Prefixes = append(loi.Prefixes, from.Prefixes[i])
+	if info := from.prefixInfo(i); info != nil {
+		loi.PrefixInfos = append(loi.PrefixInfos, *info)
+	}
+}
+
+// prefixListedBefore - returns true if the common prefix was listed on
+// the pages up to marker. A marker within the prefix, such as the one of
+// a listing without a delimiter, leaves it to the keys after the marker,
+// while a marker naming the prefix itself is past all of its keys.
+func prefixListedBefore(prefix, marker string) bool {
+	return prefix == marker || prefix < marker && !HasPrefix(marker, prefix)
+}
+
+// foldedPrefixes - the common prefixes of a page, folded by case when
+// requested.
+type foldedPrefixes struct {
+	caseInsensitive bool
+	last            string
+	seen            map[string]struct{}
+}
+
+// add - returns false if prefix, or a case variant of it when folding
+// by case, was already added.
+func (f *foldedPrefixes) add(prefix string) bool {
+	if !f.caseInsensitive {
+		// The walk is sorted, repeated prefixes are adjacent.
+		if prefix == f.last {
+			return false
+		}
+		f.last = prefix
+		return true
+	}
+	// Case variants need not be adjacent, "Photos/" < "Zebra/" < "photos/".
+	prefix = strings.ToLower(prefix)
+	if _, ok := f.seen[prefix]; ok {
+		return false
+	}
+	if f.seen == nil {
+		f.seen = make(map[string]struct{})
+	}
+	f.seen[prefix] = struct{}{}
+	return true
 }
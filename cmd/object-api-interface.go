@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+)
+
+// InfoResolver - resolves the ObjectInfo of the entries found by the
+// tree walk. ResolveObject is called for leaf entries and ResolveDir
+// for directory entries (names ending with SlashSeparator).
+//
+// Returning an error satisfying os.IsNotExist() from ResolveObject drops
+// the entry from the listing, since the object might have got deleted in
+// the interim period of listing. Returning such an error from ResolveDir
+// lists the entry as a plain directory instead, which does not count
+// toward maxKeys as it might have vanished as well.
+type InfoResolver interface {
+	ResolveObject(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error)
+	ResolveDir(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error)
+}
+
+// fetchRetentionKey - context key marking the listings which requested
+// the object lock retention of the objects.
+type fetchRetentionKey struct{}
+
+// RetentionRequested - returns true if the listing resolving the entry
+// requested the object lock retention with ListOptions.FetchRetention.
+func RetentionRequested(ctx context.Context) bool {
+	requested, _ := ctx.Value(fetchRetentionKey{}).(bool)
+	return requested
+}
+
+// fetchOwnerKey - context key marking the listings which requested the
+// owner of the objects.
+type fetchOwnerKey struct{}
+
+// OwnerRequested - returns true if the listing resolving the entry
+// requested the owner of the objects with ListOptions.FetchOwner.
+func OwnerRequested(ctx context.Context) bool {
+	requested, _ := ctx.Value(fetchOwnerKey{}).(bool)
+	return requested
+}
+
+// projectionKey - context key of the projection of the listings which
+// requested one.
+type projectionKey struct{}
+
+// ProjectionRequested - returns the fields of the objects the listing
+// resolving the entry requested with ListOptions.Projection, the zero
+// Projection of all of them if none.
+func ProjectionRequested(ctx context.Context) Projection {
+	projection, _ := ctx.Value(projectionKey{}).(Projection)
+	return projection
+}
+
+// GetObjectInfoFunc - function used to resolve the ObjectInfo of an entry.
+type GetObjectInfoFunc func(ctx context.Context, bucket, object string, info *ObjectInfo) (ObjectInfo, error)
+
+// errSkipEntry - returned by funcResolver.ResolveDir() when no directory
+// resolvers are configured, the entry is left out of the listing.
+var errSkipEntry = errors.New("skip entry")
+
+// funcResolver - adapts the function based getObjInfo/getObjectInfoDirs
+// arguments of listObjects() to the InfoResolver interface.
+type funcResolver struct {
+	getObjInfo        GetObjectInfoFunc
+	getObjectInfoDirs []GetObjectInfoFunc
+}
+
+func (r funcResolver) ResolveObject(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	return r.getObjInfo(ctx, bucket, name, info)
+}
+
+// ResolveDir - tries each of the directory resolvers in order, the first
+// one which succeeds wins.
+func (r funcResolver) ResolveDir(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	err := errSkipEntry
+	for _, getObjectInfoDir := range r.getObjectInfoDirs {
+		var objInfo ObjectInfo
+		objInfo, err = getObjectInfoDir(ctx, bucket, name, info)
+		if err == nil {
+			return objInfo, nil
+		}
+		if err == syscall.ENOENT || os.IsNotExist(err) {
+			// May be overridden by the next resolver.
+			continue
+		}
+		return objInfo, err
+	}
+	return ObjectInfo{}, err
+}
+
+// KeyRangeScanner - scans the keys of the backends keeping them in a
+// sorted index, such as a B-tree or an LSM tree, in place of a walk.
+type KeyRangeScanner interface {
+	// Scan calls fn with the keys of bucket from start on, start
+	// included, in sorted order until fn returns false or the keys
+	// run out.
+	Scan(ctx context.Context, bucket, start string, fn func(key string) bool) error
+}
@@ -0,0 +1,655 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	errgroup "github.com/zhaohuxing/s3/pkg/sync"
+)
+
+// NextPrefix - returns the first common prefix under prefix which sorts
+// after marker, along with whether more common prefixes follow it. The
+// walk is non-recursive and stops as soon as the answer is known, so
+// it is cheap enough to expand a folder tree lazily one entry at a time.
+func NextPrefix(ctx context.Context, bucket, prefix, marker string, listDir ListDirFunc, isLeafDir IsLeafDirFunc) (string, bool, error) {
+	// Marker not common with prefix is not implemented.
+	if marker != "" && !HasPrefix(marker, prefix) {
+		return "", false, nil
+	}
+
+	endWalkCh := make(chan struct{})
+	defer close(endWalkCh)
+	// Only directories matter, tell them apart by their trailing slash.
+	isLeaf := func(bucket, name string) bool {
+		return !HasSuffix(name, SlashSeparator)
+	}
+	walkResultCh := startTreeWalk(ctx, bucket, prefix, marker, false, listDir, isLeaf, isLeafDir, WalkOptions{}, endWalkCh)
+
+	var nextPrefix string
+	for walkResult := range walkResultCh {
+		if walkResult.err != nil {
+			return "", false, walkResult.err
+		}
+		if !HasSuffix(walkResult.entry.Name, SlashSeparator) {
+			continue
+		}
+		if nextPrefix != "" {
+			// Found one more, no need to walk any further.
+			return nextPrefix, true, nil
+		}
+		nextPrefix = walkResult.entry.Name
+		if walkResult.end {
+			break
+		}
+	}
+	return nextPrefix, false, nil
+}
+
+// PrefixHasObjects - returns true if any object exists under prefix,
+// recursively. The walk ends at the first one, without resolving it, so
+// it is cheap enough to check ahead of expensive operations. Empty
+// directories are not objects.
+func PrefixHasObjects(ctx context.Context, bucket, prefix string, listDir ListDirFunc, isLeaf IsLeafFunc, isLeafDir IsLeafDirFunc) (bool, error) {
+	endWalkCh := make(chan struct{})
+	defer close(endWalkCh)
+	walkResultCh := startTreeWalk(ctx, bucket, prefix, "", true, listDir, isLeaf, isLeafDir, WalkOptions{}, endWalkCh)
+	for walkResult := range walkResultCh {
+		if walkResult.err != nil {
+			return false, walkResult.err
+		}
+		if !HasSuffix(walkResult.entry.Name, SlashSeparator) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ListUniqueByIdentity - recursively lists all the objects under prefix,
+// leaving out the objects whose Identity was already listed under an
+// earlier name. Objects without an Identity are always listed.
+func ListUniqueByIdentity(ctx context.Context, bucket, prefix string, tpool *TreeWalkPool, listDir ListDirFunc, isLeaf IsLeafFunc, isLeafDir IsLeafDirFunc, resolver InfoResolver, opts ListOptions) ([]ObjectInfo, error) {
+	var objInfos []ObjectInfo
+	seen := make(map[string]struct{})
+	var marker string
+	for {
+		loi, err := listObjectsWithResolver(ctx, bucket, prefix, marker, "", DefaultMaxObjectList, tpool, listDir, isLeaf, isLeafDir, resolver, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, objInfo := range loi.Objects {
+			if objInfo.Identity != "" {
+				if _, ok := seen[objInfo.Identity]; ok {
+					continue
+				}
+				seen[objInfo.Identity] = struct{}{}
+			}
+			objInfos = append(objInfos, objInfo)
+		}
+		if !loi.IsTruncated {
+			return objInfos, nil
+		}
+		marker = loi.NextMarker
+	}
+}
+
+// ListUpTo - recursively lists the objects under prefix by pages of
+// pageSize, reusing the walks of tpool across them, and stops once total
+// objects were listed.
+func ListUpTo(ctx context.Context, total, pageSize int, bucket, prefix string, tpool *TreeWalkPool, listDir ListDirFunc, isLeaf IsLeafFunc, isLeafDir IsLeafDirFunc, resolver InfoResolver, opts ListOptions) ([]ObjectInfo, error) {
+	var objInfos []ObjectInfo
+	var marker string
+	for len(objInfos) < total {
+		maxKeys := pageSize
+		if remaining := total - len(objInfos); maxKeys <= 0 || maxKeys >= remaining {
+			// Nobody resumes the walk after the total.
+			maxKeys, opts.lastPage = remaining, true
+		}
+		loi, err := listObjectsWithResolver(ctx, bucket, prefix, marker, "", maxKeys, tpool, listDir, isLeaf, isLeafDir, resolver, opts)
+		if err != nil {
+			return nil, err
+		}
+		objInfos = append(objInfos, loi.Objects...)
+		if !loi.IsTruncated {
+			break
+		}
+		marker = loi.NextMarker
+	}
+	return objInfos, nil
+}
+
+// ListObjectsBatched - recursively lists all the objects under prefix,
+// handing them over to onBatch by batches of batchSize, the last batch
+// with the objects left over, such as for bulk inserts downstream. The
+// objects are streamed through ListOptions.Stream page after page, the
+// batches are not reused. An error of onBatch ends the listing with it.
+// Walks are not reused across pages, for none to outlive the listing.
+func ListObjectsBatched(ctx context.Context, bucket, prefix string, batchSize int, listDir ListDirFunc, isLeaf IsLeafFunc, isLeafDir IsLeafDirFunc, resolver InfoResolver, opts ListOptions, onBatch func([]ObjectInfo) error) error {
+	if batchSize <= 0 || onBatch == nil {
+		return errInvalidArgument
+	}
+	batch := make([]ObjectInfo, 0, batchSize)
+	opts.Stream = func(entry ListEntry) error {
+		batch = append(batch, *entry.Info)
+		if len(batch) < batchSize {
+			return nil
+		}
+		full := batch
+		batch = make([]ObjectInfo, 0, batchSize)
+		return onBatch(full)
+	}
+	var marker string
+	for {
+		loi, err := listObjectsWithResolver(ctx, bucket, prefix, marker, "", DefaultMaxObjectList, nil, listDir, isLeaf, isLeafDir, resolver, opts)
+		if err != nil {
+			return err
+		}
+		if !loi.IsTruncated {
+			break
+		}
+		marker = loi.NextMarker
+	}
+	if len(batch) > 0 {
+		return onBatch(batch)
+	}
+	return nil
+}
+
+// ListRange - recursively lists the objects under prefix with names
+// strictly between startExclusive and endExclusive, such as for the
+// workers of a parallel scan each owning a range of keys. Either bound
+// may be empty for the range to be open on that side. The pages are
+// continued with NextMarker in place of startExclusive, the walk ends
+// at endExclusive rather than going on past it.
+func ListRange(ctx context.Context, bucket, prefix, startExclusive, endExclusive string, maxKeys int, tpool *TreeWalkPool, listDir ListDirFunc, isLeaf IsLeafFunc, isLeafDir IsLeafDirFunc, resolver InfoResolver, opts ListOptions) (ListObjectsInfo, error) {
+	if endExclusive != "" && endExclusive <= prefix {
+		// Ahead of all the keys under prefix.
+		return ListObjectsInfo{}, nil
+	}
+	if startExclusive != "" && !HasPrefix(startExclusive, prefix) {
+		if startExclusive > prefix {
+			// Past all the keys under prefix.
+			return ListObjectsInfo{}, nil
+		}
+		startExclusive = ""
+	}
+	opts.endBefore = endExclusive
+	return listObjectsWithResolver(ctx, bucket, prefix, startExclusive, "", maxKeys, tpool, listDir, isLeaf, isLeafDir, resolver, opts)
+}
+
+// defaultClaimSample - number of keys ClaimRange splits by default.
+const defaultClaimSample = 1000
+
+// ClaimRange - returns the range of keys under prefix owned by worker
+// workerN out of totalWorkers, for the workers to list disjoint ranges
+// covering all of the keys, such as with ListRange. The first sample
+// keys, 1000 if zero, are split into totalWorkers runs of about the same
+// size, the last worker owns the keys past them as well. The range is
+// the keys strictly between startMarker and endBefore, either of which
+// is empty for the range to be open on that side. All the workers have
+// to split the same keys for the ranges to be disjoint, ClaimRange is
+// meant to be called for all of them at once, or over keys which do not
+// change in the interim period.
+func ClaimRange(ctx context.Context, bucket, prefix string, workerN, totalWorkers, sample int, listDir ListDirFunc, isLeaf IsLeafFunc, isLeafDir IsLeafDirFunc) (startMarker, endBefore string, err error) {
+	if totalWorkers <= 0 || workerN < 0 || workerN >= totalWorkers {
+		return "", "", errInvalidArgument
+	}
+	if sample <= 0 {
+		sample = defaultClaimSample
+	}
+	keys, _, _, _, err := ListKeys(ctx, bucket, prefix, "", "", sample, listDir, isLeaf, isLeafDir)
+	if err != nil {
+		return "", "", err
+	}
+	// The last key of the run of each worker, none when it is empty.
+	lastKey := func(n int) string {
+		if i := n * len(keys) / totalWorkers; i > 0 {
+			return keys[i-1]
+		}
+		return ""
+	}
+	startMarker = lastKey(workerN)
+	if workerN < totalWorkers-1 {
+		// Right after the last key of the run, included.
+		endBefore = lastKey(workerN+1) + "\x00"
+	}
+	return startMarker, endBefore, nil
+}
+
+// ListGroupedByTopPrefix - recursively lists the objects under prefix
+// grouped by the first segment of their names below prefix, such as the
+// tenants of a partitioned bucket. The objects right under prefix are
+// groups of their own. The walk stops ahead of the object opening one
+// group more than maxGroups, unless maxGroups is zero or negative.
+func ListGroupedByTopPrefix(ctx context.Context, bucket, prefix string, maxGroups int, listDir ListDirFunc, isLeaf IsLeafFunc, isLeafDir IsLeafDirFunc, getObjInfo GetObjectInfoFunc) (map[string][]ObjectInfo, error) {
+	endWalkCh := make(chan struct{})
+	defer close(endWalkCh)
+	walkResultCh := startTreeWalk(ctx, bucket, prefix, "", true, listDir, isLeaf, isLeafDir, WalkOptions{}, endWalkCh)
+
+	groups := make(map[string][]ObjectInfo)
+	for walkResult := range walkResultCh {
+		if walkResult.err != nil {
+			return nil, walkResult.err
+		}
+		name := walkResult.entry.Name
+		if HasSuffix(name, SlashSeparator) {
+			// An empty directory.
+			continue
+		}
+		group := strings.TrimPrefix(name, prefix)
+		if i := strings.Index(group, SlashSeparator); i >= 0 {
+			group = group[:i]
+		}
+		if _, ok := groups[group]; !ok && maxGroups > 0 && len(groups) == maxGroups {
+			break
+		}
+		objInfo, err := getObjInfo(ctx, bucket, name, walkResult.entry.Info)
+		if err != nil {
+			// The object might have got deleted in the interim period.
+			if err == syscall.ENOENT || os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		carrySys(&objInfo, walkResult.entry.Info)
+		groups[group] = append(groups[group], objInfo)
+	}
+	return groups, nil
+}
+
+// keyResolver - resolves entries to their names alone, without any
+// call to the backend.
+type keyResolver struct{}
+
+func (keyResolver) ResolveObject(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	return ObjectInfo{Bucket: bucket, Name: name}, nil
+}
+
+func (keyResolver) ResolveDir(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	return ObjectInfo{Bucket: bucket, Name: name, IsDir: true}, nil
+}
+
+// ListKeys - walks and paginates exactly like listObjects, but returns
+// the raw sorted key names without resolving their ObjectInfo, for the
+// callers which batch the stat calls on their own. Walks are not reused
+// across pages.
+func ListKeys(ctx context.Context, bucket, prefix, marker, delimiter string, maxKeys int, listDir ListDirFunc, isLeaf IsLeafFunc, isLeafDir IsLeafDirFunc) (keys []string, prefixes []string, nextMarker string, truncated bool, err error) {
+	loi, err := listObjectsWithResolver(ctx, bucket, prefix, marker, delimiter, maxKeys, nil, listDir, isLeaf, isLeafDir, keyResolver{}, ListOptions{})
+	if err != nil {
+		return nil, nil, "", false, err
+	}
+	for _, objInfo := range loi.Objects {
+		keys = append(keys, objInfo.Name)
+	}
+	return keys, loi.Prefixes, loi.NextMarker, loi.IsTruncated, nil
+}
+
+// Autocomplete - returns up to limit of the keys and the folders right
+// under the folder of partial which start with it, in order, such as
+// the suggestions of a search box. Folders end with SlashSeparator. The
+// walk is bounded by limit and resolves none of them.
+func Autocomplete(ctx context.Context, bucket, partial string, limit int, listDir ListDirFunc, isLeaf IsLeafFunc, isLeafDir IsLeafDirFunc) ([]string, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	keys, prefixes, _, _, err := ListKeys(ctx, bucket, partial, "", SlashSeparator, limit, listDir, isLeaf, isLeafDir)
+	if err != nil {
+		return nil, err
+	}
+	names := append(keys, prefixes...)
+	sort.Strings(names)
+	return names, nil
+}
+
+// ListObjectsMultiPrefix - lists the first page of each of the prefixes
+// at once, up to maxKeysPerPrefix keys each, returning the results by
+// prefix. The prefixes are listed concurrently and independently of
+// each other, the first error fails the whole listing.
+func ListObjectsMultiPrefix(ctx context.Context, bucket string, prefixes []string, delimiter string, maxKeysPerPrefix int, tpool *TreeWalkPool, listDir ListDirFunc, isLeaf IsLeafFunc, isLeafDir IsLeafDirFunc, resolver InfoResolver, opts ListOptions) (map[string]ListObjectsInfo, error) {
+	g := errgroup.WithNErrs(len(prefixes)).WithConcurrency(4)
+	gctx, cancel := g.WithCancelOnError(ctx)
+	defer cancel()
+
+	results := make([]ListObjectsInfo, len(prefixes))
+	for i, prefix := range prefixes {
+		i, prefix := i, prefix
+		g.Go(func() (err error) {
+			results[i], err = listObjectsWithResolver(gctx, bucket, prefix, "", delimiter, maxKeysPerPrefix,
+				tpool, listDir, isLeaf, isLeafDir, resolver, opts)
+			return err
+		}, i)
+	}
+	if err := g.WaitErr(); err != nil {
+		return nil, err
+	}
+
+	loiByPrefix := make(map[string]ListObjectsInfo, len(prefixes))
+	for i, prefix := range prefixes {
+		loiByPrefix[prefix] = results[i]
+	}
+	return loiByPrefix, nil
+}
+
+// folderResolver - resolves objects through getObjInfo and directories
+// to their names alone.
+type folderResolver struct {
+	keyResolver
+	getObjInfo GetObjectInfoFunc
+}
+
+func (r folderResolver) ResolveObject(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	return r.getObjInfo(ctx, bucket, name, info)
+}
+
+// ListFolder - lists a single folder, like "ls" does, separating the
+// files from the subdirectories. The folder is the root when empty and
+// is taken as a directory otherwise, with or without a trailing slash.
+// Walks are not reused across pages.
+func ListFolder(ctx context.Context, bucket, folder, marker string, maxKeys int, listDir ListDirFunc, isLeaf IsLeafFunc, isLeafDir IsLeafDirFunc, getObjInfo GetObjectInfoFunc) (files []ObjectInfo, subdirs []string, nextMarker string, truncated bool, err error) {
+	if folder != "" && !HasSuffix(folder, SlashSeparator) {
+		folder += SlashSeparator
+	}
+	resolver := folderResolver{getObjInfo: getObjInfo}
+	loi, err := listObjectsWithResolver(ctx, bucket, folder, marker, SlashSeparator, maxKeys, nil, listDir, isLeaf, isLeafDir, resolver, ListOptions{})
+	if err != nil {
+		return nil, nil, "", false, err
+	}
+	return loi.Objects, loi.Prefixes, loi.NextMarker, loi.IsTruncated, nil
+}
+
+// ListChangedSince - recursively lists the objects under prefix modified
+// at or after since, for incremental syncs. The objects are paginated by
+// marker like listObjects, and dropped ones do not count toward maxKeys.
+// nextSince is the latest modification time seen on the page, not
+// before since, and is the floor of the next sync once the listing is
+// no longer truncated. Walks are not reused across pages.
+func ListChangedSince(ctx context.Context, bucket, prefix string, since time.Time, marker string, maxKeys int, listDir ListDirFunc, isLeaf IsLeafFunc, isLeafDir IsLeafDirFunc, getObjInfo GetObjectInfoFunc) (objInfos []ObjectInfo, nextMarker string, truncated bool, nextSince time.Time, err error) {
+	var mu sync.Mutex
+	nextSince = since
+	opts := ListOptions{
+		// Objects are resolved concurrently.
+		Accept: func(info *ObjectInfo) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			if info.ModTime.After(nextSince) {
+				nextSince = info.ModTime
+			}
+			return !info.ModTime.Before(since)
+		},
+	}
+	resolver := funcResolver{getObjInfo: getObjInfo}
+	loi, err := listObjectsWithResolver(ctx, bucket, prefix, marker, "", maxKeys, nil, listDir, isLeaf, isLeafDir, resolver, opts)
+	if err != nil {
+		return nil, "", false, since, err
+	}
+	return loi.Objects, loi.NextMarker, loi.IsTruncated, nextSince, nil
+}
+
+// DedupListing - merges the listings a and b of the same prefix, such as
+// a cached one and a fresh one, leaving out the objects and prefixes of
+// b listed by a already. The result is truncated if either listing is,
+// and then resumes from the earliest NextMarker of the truncated ones,
+// so that nothing is skipped, while some entries may be listed again.
+func DedupListing(a, b ListObjectsInfo) ListObjectsInfo {
+	var loi ListObjectsInfo
+	var i, j int
+	for i < len(a.Objects) || j < len(b.Objects) {
+		switch {
+		case j == len(b.Objects) || i < len(a.Objects) && a.Objects[i].Name < b.Objects[j].Name:
+			loi.Objects = append(loi.Objects, a.Objects[i])
+			i++
+		case i == len(a.Objects) || b.Objects[j].Name < a.Objects[i].Name:
+			loi.Objects = append(loi.Objects, b.Objects[j])
+			j++
+		default:
+			loi.Objects = append(loi.Objects, a.Objects[i])
+			i++
+			j++
+		}
+	}
+	i, j = 0, 0
+	for i < len(a.Prefixes) || j < len(b.Prefixes) {
+		switch {
+		case j == len(b.Prefixes) || i < len(a.Prefixes) && a.Prefixes[i] < b.Prefixes[j]:
+			loi.appendPrefix(&a, i)
+			i++
+		case i == len(a.Prefixes) || b.Prefixes[j] < a.Prefixes[i]:
+			loi.appendPrefix(&b, j)
+			j++
+		default:
+			loi.appendPrefix(&a, i)
+			i++
+			j++
+		}
+	}
+	loi.KeyCount = len(loi.Objects) + len(loi.Prefixes)
+
+	for _, l := range []ListObjectsInfo{a, b} {
+		if !l.IsTruncated {
+			continue
+		}
+		if !loi.IsTruncated || l.NextMarker < loi.NextMarker {
+			loi.NextMarker = l.NextMarker
+		}
+		loi.IsTruncated = true
+		loi.ObjectsTruncated = loi.ObjectsTruncated || l.ObjectsTruncated
+		loi.PrefixesTruncated = loi.PrefixesTruncated || l.PrefixesTruncated
+	}
+	if len(a.Entries) > 0 || len(b.Entries) > 0 {
+		loi.merge()
+	}
+	return loi
+}
+
+// WalkFull - recursively walks prefix in a single pass, sending the files
+// to files and the directories, empty ones included, to dirs as they are
+// found, each directory ahead of its contents. The files are described
+// by the listing of the backend alone. The walk stops at the first error,
+// sent to errs, and all the channels are closed once it is over. files
+// and dirs must be drained concurrently, unless ctx is canceled.
+func WalkFull(ctx context.Context, bucket, prefix string, listDir ListDirFunc, isLeaf IsLeafFunc, isLeafDir IsLeafDirFunc) (<-chan ObjectInfo, <-chan string, <-chan error) {
+	files := make(chan ObjectInfo)
+	dirs := make(chan string)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(dirs)
+		defer close(files)
+
+		endWalkCh := make(chan struct{})
+		defer close(endWalkCh)
+		walkResultCh := startTreeWalk(ctx, bucket, prefix, "", true, listDir, isLeaf, isLeafDir, WalkOptions{DirsFirst: true}, endWalkCh)
+		for walkResult := range walkResultCh {
+			if walkResult.err != nil {
+				errs <- walkResult.err
+				return
+			}
+			name := walkResult.entry.Name
+			if HasSuffix(name, SlashSeparator) {
+				select {
+				case <-ctx.Done():
+					errs <- ctx.Err()
+					return
+				case dirs <- name:
+				}
+				continue
+			}
+			objInfo := ObjectInfo{Name: name}
+			if walkResult.entry.Info != nil {
+				objInfo = *walkResult.entry.Info
+				objInfo.Name = name
+			}
+			objInfo.Bucket = bucket
+			select {
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			case files <- objInfo:
+			}
+		}
+	}()
+	return files, dirs, errs
+}
+
+// DiffKind - how a key differs between two listings.
+type DiffKind int
+
+const (
+	// DiffAdded - the key is in the second listing alone.
+	DiffAdded DiffKind = iota + 1
+	// DiffRemoved - the key is in the first listing alone.
+	DiffRemoved
+	// DiffChanged - the key is in both listings, with a different size,
+	// modification time or ETag.
+	DiffChanged
+)
+
+// DiffEntry - a key differing between two listings, with its ObjectInfo
+// in each of them, nil in the one it is missing from.
+type DiffEntry struct {
+	Name string
+	Kind DiffKind
+	A, B *ObjectInfo
+}
+
+// DiffListings - diffs the listings a and b, such as of a source and a
+// destination, both sorted by name as listings and walks are, sending
+// the keys differing between them in order. The keys listed alike are
+// left out. Both listings are read to the end, and the returned channel
+// must be drained, it is closed once they are.
+func DiffListings(a, b <-chan ObjectInfo) <-chan DiffEntry {
+	diffs := make(chan DiffEntry)
+	go func() {
+		defer close(diffs)
+		objA, okA := <-a
+		objB, okB := <-b
+		for okA || okB {
+			switch {
+			case !okB || okA && objA.Name < objB.Name:
+				infoA := objA
+				diffs <- DiffEntry{Name: objA.Name, Kind: DiffRemoved, A: &infoA}
+				objA, okA = <-a
+			case !okA || objB.Name < objA.Name:
+				infoB := objB
+				diffs <- DiffEntry{Name: objB.Name, Kind: DiffAdded, B: &infoB}
+				objB, okB = <-b
+			default:
+				if objA.Size != objB.Size || !objA.ModTime.Equal(objB.ModTime) || objA.ETag != objB.ETag {
+					infoA, infoB := objA, objB
+					diffs <- DiffEntry{Name: objA.Name, Kind: DiffChanged, A: &infoA, B: &infoB}
+				}
+				objA, okA = <-a
+				objB, okB = <-b
+			}
+		}
+	}()
+	return diffs
+}
+
+// NextPrefixMarker - returns the smallest key sorting after all the
+// keys under prefix, its lexicographic successor, to list past them with
+// as the marker, such as "a10" for "a1/". The listing starts after the
+// marker, a key equal to it is left out as well. Trailing 0xff bytes roll
+// over, and there is no successor, empty, when prefix is all of them.
+func NextPrefixMarker(prefix string) string {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			return prefix[:i] + string([]byte{prefix[i] + 1})
+		}
+	}
+	return ""
+}
+
+// ListFromSortedSource - lists the objects under prefix by range scans
+// of source in place of a tree walk, grouping the keys by delimiter and
+// paginating them by marker like listObjects. The scan seeks past the
+// keys of each common prefix rather than reading them, and the objects
+// are resolved through getObjInfo one at a time.
+func ListFromSortedSource(ctx context.Context, bucket, prefix, marker, delimiter string, maxKeys int, source KeyRangeScanner, getObjInfo GetObjectInfoFunc) (loi ListObjectsInfo, err error) {
+	// With max keys of zero we have reached eof, return right here.
+	if maxKeys == 0 {
+		return loi, nil
+	}
+	// Over flowing count - reset to DefaultMaxObjectList.
+	if maxKeys < 0 || maxKeys > DefaultMaxObjectList {
+		maxKeys = DefaultMaxObjectList
+	}
+
+	var listed int
+	start := max(prefix, marker)
+	for {
+		// Set when the scan stops to seek past a common prefix.
+		var seek string
+		var resolveErr error
+		scanErr := source.Scan(ctx, bucket, start, func(key string) bool {
+			if resolveErr = ctx.Err(); resolveErr != nil {
+				return false
+			}
+			if key <= marker {
+				return true
+			}
+			if !HasPrefix(key, prefix) {
+				// Past the keys under prefix.
+				return false
+			}
+
+			name, isPrefix := key, false
+			if delimiter != "" {
+				if i := strings.Index(key[len(prefix):], delimiter); i != -1 {
+					name, isPrefix = key[:len(prefix)+i+len(delimiter)], true
+				}
+			}
+			if isPrefix && (prefixListedBefore(name, marker) || name == loi.NextMarker) {
+				// Inside a common prefix listed already.
+				seek = NextPrefixMarker(name)
+				return seek == ""
+			}
+			if listed == maxKeys {
+				loi.IsTruncated = true
+				return false
+			}
+
+			if isPrefix {
+				loi.Prefixes = append(loi.Prefixes, name)
+			} else {
+				objInfo, err := getObjInfo(ctx, bucket, key, nil)
+				if err != nil {
+					// The object might have got deleted in the interim
+					// period of scanning and getObjInfo().
+					if err == syscall.ENOENT || os.IsNotExist(err) {
+						return true
+					}
+					resolveErr = err
+					return false
+				}
+				loi.Objects = append(loi.Objects, objInfo)
+			}
+			listed++
+			loi.NextMarker = name
+			if isPrefix {
+				seek = NextPrefixMarker(name)
+				return seek == ""
+			}
+			return true
+		})
+		if scanErr != nil {
+			return ListObjectsInfo{}, scanErr
+		}
+		if resolveErr != nil {
+			return ListObjectsInfo{}, resolveErr
+		}
+		if seek == "" {
+			break
+		}
+		start = seek
+	}
+	loi.KeyCount = listed
+	if !loi.IsTruncated {
+		loi.NextMarker = ""
+	}
+	return loi, nil
+}
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"sync"
+	"time"
+)
+
+// MetricsSink - receives the metrics of the listings, such as to feed
+// Prometheus collectors. It must be safe for concurrent use.
+type MetricsSink interface {
+	// IncDirsWalked is called for each directory listed by the walk.
+	IncDirsWalked()
+	// IncObjInfoCalls is called for each entry resolved to its ObjectInfo.
+	IncObjInfoCalls()
+	// ObserveListLatency is called with the duration of each listing.
+	ObserveListLatency(d time.Duration)
+}
+
+// Counter - a counter, as implemented by prometheus.Counter.
+type Counter interface {
+	Inc()
+}
+
+// Observer - a distribution of values, as implemented by
+// prometheus.Histogram and prometheus.Summary.
+type Observer interface {
+	Observe(float64)
+}
+
+// CounterSink - MetricsSink adapter to counters and observers, such as
+// the Prometheus ones, without depending on them. Nil fields are not
+// fed. For instance:
+//
+//	sink := CounterSink{
+//		DirsWalked:   dirsWalkedCounter,   // prometheus.Counter
+//		ObjInfoCalls: objInfoCallsCounter, // prometheus.Counter
+//		ListLatency:  listLatencyHistogram, // prometheus.Histogram, seconds
+//	}
+type CounterSink struct {
+	DirsWalked   Counter
+	ObjInfoCalls Counter
+	ListLatency  Observer
+}
+
+func (s CounterSink) IncDirsWalked() {
+	if s.DirsWalked != nil {
+		s.DirsWalked.Inc()
+	}
+}
+
+func (s CounterSink) IncObjInfoCalls() {
+	if s.ObjInfoCalls != nil {
+		s.ObjInfoCalls.Inc()
+	}
+}
+
+// ObserveListLatency - observes the duration in seconds, the base unit
+// of time of Prometheus.
+func (s CounterSink) ObserveListLatency(d time.Duration) {
+	if s.ListLatency != nil {
+		s.ListLatency.Observe(d.Seconds())
+	}
+}
+
+// ListTiming - breakdown of the time spent by the listings it is set
+// for. WalkDuration is the time spent waiting on the walk for the
+// entries, StatDuration the wall-clock time of resolving them, from the
+// first resolution of each round of them to the last one ending, which
+// overlaps the walk read meanwhile. StatCount counts the entries
+// resolved. The listings sharing it, such as the pages of a listing,
+// add up to it, it is read once they returned.
+type ListTiming struct {
+	WalkDuration time.Duration
+	StatDuration time.Duration
+	StatCount    int
+
+	mu sync.Mutex
+}
+
+// add - adds the time spent by a round of a listing.
+func (t *ListTiming) add(walk, stat time.Duration, stats int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.WalkDuration += walk
+	t.StatDuration += stat
+	t.StatCount += stats
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// statCacheKey - key of the ObjectInfo cached for an object, along with
+// the optional fields requested when resolving it.
+type statCacheKey struct {
+	bucket, name               string
+	fetchRetention, fetchOwner bool
+	projection                 Projection
+}
+
+// statCacheEntry - ObjectInfo cached until expires.
+type statCacheEntry struct {
+	key     statCacheKey
+	objInfo ObjectInfo
+	expires time.Time
+}
+
+// StatCache - caches the ObjectInfo of the objects resolved by listings
+// for a TTL, sparing the stat of the objects of the stable directories
+// listed again. It holds up to a maximum number of objects, evicting the
+// least recently cached first, and may be shared by listings. The
+// objects failing to resolve are not cached.
+type StatCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[statCacheKey]*list.Element
+	lru     *list.List // Of *statCacheEntry, most recently cached first.
+}
+
+// NewStatCache - returns a StatCache keeping the objects for ttl, up to
+// maxEntries of them.
+func NewStatCache(ttl time.Duration, maxEntries int) *StatCache {
+	return &StatCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[statCacheKey]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// Len - returns the number of objects cached, expired ones included
+// until they are looked up or evicted.
+func (c *StatCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// get - returns the ObjectInfo cached for key, if not expired.
+func (c *StatCache) get(key statCacheKey) (ObjectInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return ObjectInfo{}, false
+	}
+	entry := elem.Value.(*statCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return ObjectInfo{}, false
+	}
+	return entry.objInfo, true
+}
+
+// put - caches objInfo for key, evicting the least recently cached
+// objects over the limit.
+func (c *StatCache) put(key statCacheKey, objInfo ObjectInfo) {
+	if c.maxEntries <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.lru.Remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(&statCacheEntry{key: key, objInfo: objInfo, expires: time.Now().Add(c.ttl)})
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*statCacheEntry).key)
+	}
+}
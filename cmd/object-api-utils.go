@@ -1,11 +1,26 @@
 package cmd
 
-import "path"
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	slashSeparator     = "/"
+	SlashSeparator     = "/"
+	maxObjectKeyLength = 1024
+	maxRecursionDepth  = 1000
+)
 
 const (
-	slashSeparator = "/"
-	SlashSeparator = "/"
-	maxObjectList  = 45000
+	// DefaultMaxObjectList - maximum number of keys of a listing page,
+	// used when the requested one is zero or over it.
+	DefaultMaxObjectList = 45000
+
+	// DefaultListConcurrency - number of objects of a listing page
+	// resolved in parallel, used when ListOptions.Concurrency is zero.
+	DefaultListConcurrency = 10
 )
 
 // pathJoin - like path.Join() but retains trailing SlashSeparator of the last element
@@ -18,3 +33,37 @@ func pathJoin(elem ...string) string {
 	}
 	return path.Join(elem...) + trailingSlash
 }
+
+// collapseSlashes - collapses the runs of SlashSeparator in name into
+// single ones.
+func collapseSlashes(name string) string {
+	for strings.Contains(name, SlashSeparator+SlashSeparator) {
+		name = strings.ReplaceAll(name, SlashSeparator+SlashSeparator, SlashSeparator)
+	}
+	return name
+}
+
+// s3URLEncode - URL encodes s the way S3 does for the "url" encoding
+// type, leaving the unreserved characters and SlashSeparator as is.
+func s3URLEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3EncodeName - encodes name as requested by the encoding type.
+func s3EncodeName(name, encodingType string) string {
+	if strings.EqualFold(encodingType, "url") {
+		return s3URLEncode(name)
+	}
+	return name
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// treeWalkSubtreeBuffer - number of results a subtree walked ahead of
+// its turn buffers before it waits for its parent to catch up.
+const treeWalkSubtreeBuffer = 1000
+
+// subtreeWalk - a subdirectory which, in a parallel walk, may be walked
+// ahead of its turn into a buffer. Whoever claims it first, the parent
+// walk reaching it or a worker picking it up, walks it.
+//
+// The keys of sibling subtrees form disjoint ranges which sort the same
+// way as their entries, "a1.txt" < "a1/..." < "a10", so merging the
+// sorted streams of the subtrees is forwarding them one after another.
+type subtreeWalk struct {
+	claimed   int32
+	prefixDir string
+	marker    string
+	isEnd     bool
+
+	// Set by the worker, valid once resultCh is closed.
+	resultCh chan TreeWalkResult
+	emptyDir bool
+	err      error
+}
+
+// claim - claims the subtree, returns false if it was claimed already.
+func (st *subtreeWalk) claim() bool {
+	return atomic.CompareAndSwapInt32(&st.claimed, 0, 1)
+}
+
+// forward - forwards the buffered results of a subtree walked ahead in
+// order and returns the outcome of its walk.
+func (st *subtreeWalk) forward(ctx context.Context, resultCh chan TreeWalkResult, endWalkCh <-chan struct{}) (emptyDir bool, treeErr error) {
+	for result := range st.resultCh {
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-endWalkCh:
+			return false, errWalkAbort
+		case resultCh <- result:
+		}
+	}
+	return st.emptyDir, st.err
+}
+
+// walkSubtreesAhead - walks the subdirectories among entries ahead of
+// their turn, in order and as workers become available. The returned
+// slice is indexed like entries, holding nil for entries which are not
+// walked into, or not known to be directories before the delayed isLeaf
+// check. Workers stop once ctx is canceled.
+func walkSubtreesAhead(ctx context.Context, bucket, prefixDir string, entries []*Entry, markerDir, markerBase string, listDir ListDirFunc, isLeaf IsLeafFunc, isLeafDir IsLeafDirFunc, opts *WalkOptions, endWalkCh <-chan struct{}, isEnd bool) []*subtreeWalk {
+	subtrees := make([]*subtreeWalk, len(entries))
+	var pending []*subtreeWalk
+	for i, entry := range entries {
+		if !HasSuffix(entry.Name, opts.separator()) || opts.isExcluded(opts.join(prefixDir, entry.Name)) {
+			continue
+		}
+		st := &subtreeWalk{
+			prefixDir: opts.join(prefixDir, entry.Name),
+			isEnd:     i == len(entries)-1 && isEnd,
+		}
+		if entry.Name == markerDir {
+			if opts.skipsMarkerDir(markerBase) {
+				continue
+			}
+			st.marker = markerBase
+		}
+		subtrees[i] = st
+		pending = append(pending, st)
+	}
+
+	go func() {
+		for _, st := range pending {
+			if atomic.LoadInt32(&st.claimed) != 0 {
+				// Already walked by the parent.
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case opts.workers <- struct{}{}:
+			}
+			st.resultCh = make(chan TreeWalkResult, treeWalkSubtreeBuffer)
+			if !st.claim() {
+				<-opts.workers
+				continue
+			}
+			go func(st *subtreeWalk) {
+				defer func() { <-opts.workers }()
+				st.emptyDir, st.err = doTreeWalk(ctx, bucket, st.prefixDir, "", st.marker, true,
+					listDir, isLeaf, isLeafDir, opts, st.resultCh, endWalkCh, st.isEnd, false)
+				close(st.resultCh)
+			}(st)
+		}
+	}()
+	return subtrees
+}
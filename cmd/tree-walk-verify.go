@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// VerifyBackend - walks the whole of bucket through listDir, checking
+// the invariants the tree walk relies on, and returns the violations
+// found, nil if none. It is a development tool for backend authors and
+// lists every directory more than once, not meant for production use.
+//
+// The invariants are:
+//  1. entries are sorted, without duplicates or nested names, only the
+//     directory itself, listed first, has no name,
+//  2. directories end with a slash, unless the isLeaf check is delayed,
+//  3. entries are filtered by the prefix they are listed with,
+//  4. emptyDir comes with no entries, and isLeafDir agrees with listDir
+//     on which directories are empty.
+func VerifyBackend(ctx context.Context, bucket string, listDir ListDirFunc, isLeaf IsLeafFunc, isLeafDir IsLeafDirFunc) []error {
+	var errs []error
+	violation := func(prefixDir, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%q: %s: %w", prefixDir, fmt.Sprintf(format, args...), ErrBackendInvariant))
+	}
+
+	dirs := []string{""}
+	for len(dirs) > 0 {
+		if err := ctx.Err(); err != nil {
+			return append(errs, err)
+		}
+		prefixDir := dirs[len(dirs)-1]
+		dirs = dirs[:len(dirs)-1]
+		if strings.Count(prefixDir, SlashSeparator) > maxRecursionDepth {
+			violation(prefixDir, "nested deeper than %d directories", maxRecursionDepth)
+			continue
+		}
+
+		emptyDir, entries, delayIsLeaf := listDir(bucket, prefixDir, "")
+		if emptyDir && len(entries) > 0 {
+			violation(prefixDir, "listed as empty with %d entries", len(entries))
+		}
+		var subdirs []string
+		for i, entry := range entries {
+			name := entry.Name
+			if i > 0 {
+				switch prev := entries[i-1].Name; {
+				case name == prev:
+					violation(prefixDir, "entry %q is listed twice", name)
+					continue
+				case name < prev:
+					violation(prefixDir, "entry %q is listed after %q", name, prev)
+				}
+			}
+			if name == "" && i == 0 {
+				// The directory itself.
+				continue
+			}
+			if name == "" || strings.Contains(strings.TrimSuffix(name, SlashSeparator), SlashSeparator) {
+				violation(prefixDir, "entry %q is not a name of the directory", name)
+				continue
+			}
+
+			isDir := HasSuffix(name, SlashSeparator)
+			if delayIsLeaf {
+				isDir = !isLeaf(bucket, pathJoin(prefixDir, name))
+			} else if leaf := isLeaf(bucket, pathJoin(prefixDir, name)); leaf == isDir {
+				if leaf {
+					violation(prefixDir, "entry %q ends with a slash but is a leaf", name)
+				} else {
+					violation(prefixDir, "directory %q does not end with a slash", name)
+				}
+			}
+			if !isDir {
+				continue
+			}
+			dir := pathJoin(prefixDir, strings.TrimSuffix(name, SlashSeparator)+SlashSeparator)
+			subEmpty, subEntries, _ := listDir(bucket, dir, "")
+			if empty := subEmpty || len(subEntries) == 0; isLeafDir(bucket, dir) != empty {
+				violation(prefixDir, "isLeafDir of %q is %v while it has %d entries", name, !empty, len(subEntries))
+			}
+			subdirs = append(subdirs, dir)
+		}
+
+		// The first letter of the last entry lists a subset of the entries.
+		if len(entries) > 0 && entries[len(entries)-1].Name != "" {
+			prefixEntry := entries[len(entries)-1].Name[:1]
+			_, matched, _ := listDir(bucket, prefixDir, prefixEntry)
+			for _, entry := range matched {
+				if !HasPrefix(entry.Name, prefixEntry) {
+					violation(prefixDir, "entry %q is listed for prefix %q", entry.Name, prefixEntry)
+				}
+			}
+			if len(matched) == 0 {
+				violation(prefixDir, "nothing is listed for prefix %q", prefixEntry)
+			}
+		}
+
+		// Walk the subdirectories in order.
+		for i := len(subdirs) - 1; i >= 0; i-- {
+			dirs = append(dirs, subdirs[i])
+		}
+	}
+	return errs
+}
@@ -2,9 +2,14 @@ package cmd
 
 import (
 	"context"
+	"fmt"
 	"runtime"
 	"sort"
 	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
 )
 
 type Entry struct {
@@ -17,10 +22,13 @@ type TreeWalkResult struct {
 	entry      *Entry
 	isEmptyDir bool
 	end        bool
+	err        error // Set on the last result of a walk which failed.
 }
 
 // Return entries that have prefix prefixEntry.
 // The supplied entries are modified and the returned string is a subslice of entries.
+// The matching entries are moved to the front of entries in their order,
+// callers must not use entries afterwards and keep the result instead.
 func filterMatchingPrefix(entries []*Entry, prefixEntry string) []*Entry {
 	if len(entries) == 0 || prefixEntry == "" {
 		return entries
@@ -36,6 +44,32 @@ func filterMatchingPrefix(entries []*Entry, prefixEntry string) []*Entry {
 	return dst
 }
 
+// trimLeadingSeparators - trims the separators some backends prefix the
+// entry names with, which would end up doubled in the keys. Entries left
+// without a name are dropped, the remaining ones sorted again.
+func trimLeadingSeparators(entries []*Entry, separator string) []*Entry {
+	var trimmed bool
+	dst := entries[:0]
+	for _, entry := range entries {
+		if HasPrefix(entry.Name, separator) {
+			trimmed = true
+			for HasPrefix(entry.Name, separator) {
+				entry.Name = entry.Name[len(separator):]
+			}
+			if entry.Name == "" {
+				continue
+			}
+		}
+		dst = append(dst, entry)
+	}
+	if trimmed {
+		sort.Slice(dst, func(i, j int) bool {
+			return dst[i].Name < dst[j].Name
+		})
+	}
+	return dst
+}
+
 // ListDirFunc - "listDir" function of type listDirFunc returned by listDirFactory() - explained below.
 type ListDirFunc func(bucket, prefixDir, prefixEntry string) (emptyDir bool, entries []*Entry, delayIsLeaf bool)
 
@@ -52,35 +86,549 @@ type IsLeafFunc func(string, string) bool
 // if an entry is empty directory.
 type IsLeafDirFunc func(string, string) bool
 
+// FilterOptions - optional behaviour of filterListEntriesWithOptions().
+type FilterOptions struct {
+	// IsTombstone reports the entries standing for deleted objects,
+	// which are left out of the listing unless ShowDeleted is set.
+	IsTombstone func(entry *Entry) bool
+	ShowDeleted bool
+
+	// IsDeleted reports the objects whose latest version is a delete
+	// marker, from the Info of their entries. Like tombstones they are
+	// left out of the plain listing of the current versions, and kept
+	// in the listing of all the versions with ShowDeleted.
+	IsDeleted func(info *ObjectInfo) bool
+
+	// MaxEntries, when set, gives up on a directory of more entries than
+	// this before sorting them, returning the first MaxEntries+1 of them
+	// unsorted. Set it to the WalkOptions.MaxEntriesPerDir of the walks
+	// listing with it, which fail on them with ErrDirTooLarge.
+	MaxEntries int
+}
+
+// isDeleted - returns true if the entry is left out of the listing.
+func (opts FilterOptions) isDeleted(entry *Entry) bool {
+	if opts.ShowDeleted {
+		return false
+	}
+	if opts.IsTombstone != nil && opts.IsTombstone(entry) {
+		return true
+	}
+	return opts.IsDeleted != nil && entry.Info != nil && opts.IsDeleted(entry.Info)
+}
+
 func filterListEntries(bucket, prefixDir string, entries []*Entry, prefixEntry string, isLeaf IsLeafFunc) ([]*Entry, bool) {
+	return filterListEntriesWithOptions(bucket, prefixDir, entries, prefixEntry, isLeaf, FilterOptions{})
+}
+
+// filterListEntriesWithOptions - like filterListEntries() tuned by opts.
+func filterListEntriesWithOptions(bucket, prefixDir string, entries []*Entry, prefixEntry string, isLeaf IsLeafFunc, opts FilterOptions) ([]*Entry, bool) {
 	// Filter entries that have the prefix prefixEntry.
 	entries = filterMatchingPrefix(entries, prefixEntry)
 
+	// Filter out the "." and ".." entries some backends list.
+	dst := entries[:0]
+	for _, entry := range entries {
+		switch entry.Name {
+		case ".", "..", "./", "../":
+			continue
+		}
+		dst = append(dst, entry)
+	}
+	entries = dst
+
+	// Filter out the deleted objects.
+	if (opts.IsTombstone != nil || opts.IsDeleted != nil) && !opts.ShowDeleted {
+		dst := entries[:0]
+		for _, entry := range entries {
+			if !opts.isDeleted(entry) {
+				dst = append(dst, entry)
+			}
+		}
+		entries = dst
+	}
+
+	// Pathological directories are not worth sorting.
+	if opts.MaxEntries > 0 && len(entries) > opts.MaxEntries {
+		return entries[:opts.MaxEntries+1], false
+	}
+
 	// Listing needs to be sorted.
 	sort.Slice(entries, func(i, j int) bool {
 		return entries[i].Name < entries[j].Name
 	})
+
+	// Can isLeaf() check be delayed till when it has to be sent down the
+	// TreeWalkResult channel?
+	if isLeaf == nil {
+		// Entries with a trailing "/" are directories.
+		return entries, false
+	}
+	if delayIsLeafCheck(entries) {
+		return entries, true
+	}
+
+	// isLeaf() check has to happen here so that trailing "/" for objects can be removed,
+	// and added for directories listed without it.
+	resolveLeaves(entries, SlashSeparator, func(name string) bool {
+		return isLeaf(bucket, pathJoin(prefixDir, name))
+	})
 	return entries, false
 }
 
+// resolveLeaves - trims the trailing separator of the leaves and appends
+// it to the directories listed without it, then sorts the entries again
+// as the previous sort does not hold good anymore.
+func resolveLeaves(entries []*Entry, separator string, isLeaf func(name string) bool) {
+	for _, entry := range entries {
+		if isLeaf(entry.Name) {
+			entry.Name = strings.TrimSuffix(entry.Name, separator)
+		} else if !HasSuffix(entry.Name, separator) {
+			entry.Name += separator
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+}
+
+// delayIsLeafCheck - Returns true if isLeaf check can be delayed.
+func delayIsLeafCheck(entries []*Entry) bool {
+	return canDelayIsLeaf(entries, SlashSeparator)
+}
+
+// canDelayIsLeaf - returns true if telling the leaves apart, trimming or
+// appending the separator, keeps the sorted entries in order.
+func canDelayIsLeaf(entries []*Entry, separator string) bool {
+	for i := 1; i < len(entries); i++ {
+		prev, entry := entries[i-1].Name, entries[i].Name
+		// if "prev" is a dir and "entry" has the prefix "prev" then isLeaf() check can't be delayed
+		if HasSuffix(prev, separator) && HasPrefix(entry, prev) {
+			return false
+		}
+		// "obj" as a directory sorts after "obj.txt" once named "obj/".
+		if name := strings.TrimSuffix(prev, separator); sortsBeforeDir(entry, name, separator) {
+			return false
+		}
+		// "obj/" as a leaf sorts before "obj.txt" once named "obj".
+		if name := strings.TrimSuffix(entry, separator); name != entry && sortsBeforeDir(prev, name, separator) {
+			return false
+		}
+	}
+	return true
+}
+
+// sortsBeforeDir - returns true if name sorts between dir and dir
+// followed by the separator.
+func sortsBeforeDir(name, dir, separator string) bool {
+	return len(name) > len(dir) && HasPrefix(name, dir) && name[len(dir):] < separator
+}
+
+// WalkOptions - optional behaviour of a tree walk. Walks parked in a
+// TreeWalkPool are only reused by listings with the same options, and
+// walks reporting to the caller are not pooled at all.
+type WalkOptions struct {
+	// ExcludePrefixes leaves out all the keys under any of these
+	// prefixes, the walk does not descend into excluded directories.
+	ExcludePrefixes []string
+
+	// ParallelSubtrees walks up to this many sibling subdirectories of
+	// a recursive walk concurrently, the results are still emitted in
+	// sorted order. Zero walks serially.
+	ParallelSubtrees int
+
+	// MaxEntriesPerDir fails the walk with ErrDirTooLarge on listing a
+	// directory of more entries than this, as a safety valve against
+	// pathological directories. Zero means no limit. Backends filtering
+	// their entries with FilterOptions.MaxEntries skip sorting them.
+	MaxEntriesPerDir int
+
+	// MaxKeyLength fails the walk with ErrKeyTooLong on coming across a
+	// key longer than this many bytes. Zero means the S3 limit of 1024.
+	MaxKeyLength int
+
+	// MaxRecursionDepth fails the walk with ErrWalkTooDeep on coming
+	// across a directory nested deeper than this below the directory the
+	// walk starts from, as a safety limit on the recursion of the walk.
+	// Zero means 1000, negative values mean no limit.
+	MaxRecursionDepth int
+
+	// RateLimit, when set, caps the rate of the listDir calls of the
+	// walk. It may be shared by several walks to cap them as a whole.
+	RateLimit *rate.Limiter
+
+	// Metrics, when set, receives the metrics of the listing.
+	Metrics MetricsSink
+
+	// CheckDirChanges lists a directory once more if it or one of its
+	// leaf directories was modified while listing it and telling its
+	// subdirectories from its leaf directories, as told by DirStamp of
+	// each directory, such as from its mtime and size.
+	CheckDirChanges bool
+	DirStamp        func(bucket, prefixDir string) string
+
+	// Progress, when set, counts the progress of the walk, for polling
+	// from other goroutines.
+	Progress *WalkProgress
+
+	// DirsFirst emits the directories of recursive walks ahead of their
+	// contents, in pre-order, rather than the empty directories only.
+	DirsFirst bool
+
+	// ExplicitDirObjects emits the placeholder objects of directories,
+	// zero-byte keys ending with the separator such as the folders some
+	// clients create, ahead of the contents of recursive walks. Backends
+	// list them as directories with the Info of a zero-byte object.
+	ExplicitDirObjects bool
+
+	// SkipMarkerSubtree resumes recursive walks after the whole directory
+	// the marker is in, rather than after the marker within it, for the
+	// clients jumping past a folder. Only the walk starting from the
+	// marker skips, the walks parked for the next pages are not told
+	// apart from the ones of other listings.
+	SkipMarkerSubtree bool
+
+	// NoSelfEntry tells the walk the backend never lists a directory
+	// itself, as an entry without a name ahead of the others, failing the
+	// walk with ErrBackendInvariant on coming across one. Entries without
+	// a name past the first one always fail the walk.
+	NoSelfEntry bool
+
+	// Tracer, when set, traces the decisions of the walk. It must be
+	// safe for concurrent use with ParallelSubtrees.
+	Tracer Tracer
+
+	// Separator is the path separator of the backend, SlashSeparator
+	// if empty. The backend sees prefixes and entries with Separator
+	// while the walk emits keys with SlashSeparator.
+	Separator string
+
+	// Rewrite, when set, renames the keys the walk emits, such as to
+	// strip an internal tenant prefix off them, and Unrewrite renames
+	// the prefixes and markers of the listing back. Rewrite must keep
+	// the keys in order. Resolvers are handed the rewritten keys.
+	Rewrite   func(name string) string
+	Unrewrite func(name string) string
+
+	// CollapseSlashes collapses the runs of slashes in the prefixes and
+	// the markers of the listings, and in the keys the walk emits, into
+	// single slashes, such as for the clients sending "a//b" for "a/b".
+	// The keys differing by their runs of slashes alone are then listed
+	// under the same name. Off, the keys are listed as they are.
+	CollapseSlashes bool
+
+	// SuffixFilter, when set, leaves out the leaves whose names do not
+	// end with it, such as ".jpg", before they are resolved, matching it
+	// regardless of case with ListOptions.CaseInsensitive. Directories
+	// are walked as usual.
+	SuffixFilter string
+
+	// FolderPlaceholderNames leaves out the leaves named any of these,
+	// such as ".keep", the placeholder objects some tools create for
+	// folders to exist. Their directories are still listed as prefixes,
+	// while recursive walks leave out the ones holding nothing else.
+	FolderPlaceholderNames []string
+
+	workers    chan struct{}  // Tokens bounding the parallel subtree walks.
+	rootDepth  int            // Depth of the directory the walk starts from.
+	prefetched *prefetchedDir // Listing of the first directory of the walk.
+	foldSuffix bool           // SuffixFilter is matched regardless of case.
+}
+
+// prefetchedDir - the listing of a directory, listed ahead of the walk.
+type prefetchedDir struct {
+	prefixDir        string
+	entryPrefixMatch string
+	emptyDir         bool
+	entries          []*Entry
+	delayIsLeaf      bool
+	taken            atomic.Bool
+}
+
+// take - returns the listing if it is the one of prefixDir, only once.
+func (p *prefetchedDir) take(prefixDir, entryPrefixMatch string) (bool, []*Entry, bool, bool) {
+	if p == nil || p.prefixDir != prefixDir || p.entryPrefixMatch != entryPrefixMatch || !p.taken.CompareAndSwap(false, true) {
+		return false, nil, false, false
+	}
+	return p.emptyDir, p.entries, p.delayIsLeaf, true
+}
+
+// WalkProgress - progress of a tree walk, updated as it goes.
+type WalkProgress struct {
+	DirsVisited    atomic.Int64 // Directories listed.
+	EntriesEmitted atomic.Int64 // Entries sent to the consumer.
+}
+
+// Tracer - receives debug traces of a tree walk.
+type Tracer interface {
+	Tracef(format string, args ...interface{})
+}
+
+// poolKey - returns the options shaping the walk as a key of the
+// TreeWalkPool, false when the walk must not be pooled since it
+// reports to the caller of the listing which started it.
+func (opts *WalkOptions) poolKey() (string, bool) {
+	if opts.Metrics != nil || opts.Progress != nil || opts.Tracer != nil || opts.DirStamp != nil ||
+		opts.Rewrite != nil || opts.Unrewrite != nil {
+		return "", false
+	}
+	return fmt.Sprintf("%q %d %d %d %d %t %t %t %t %t %q %q %t %q %p", opts.ExcludePrefixes, opts.ParallelSubtrees,
+		opts.MaxEntriesPerDir, opts.MaxKeyLength, opts.MaxRecursionDepth, opts.CheckDirChanges,
+		opts.DirsFirst, opts.ExplicitDirObjects, opts.NoSelfEntry, opts.CollapseSlashes, opts.Separator,
+		opts.SuffixFilter, opts.foldSuffix, opts.FolderPlaceholderNames, opts.RateLimit), true
+}
+
+// emitsAhead - returns true if the directory entry is emitted ahead of
+// its contents by recursive walks.
+func (opts *WalkOptions) emitsAhead(entry *Entry) bool {
+	return opts.DirsFirst || opts.ExplicitDirObjects && isDirObject(entry)
+}
+
+// isDirObject - returns true if the directory entry is the placeholder
+// object of the directory rather than a directory alone.
+func isDirObject(entry *Entry) bool {
+	return entry.Info != nil && !entry.Info.IsDir && entry.Info.Size == 0
+}
+
+// skipsMarkerDir - returns true if the directory of the marker, holding
+// markerBase, is skipped as a whole.
+func (opts *WalkOptions) skipsMarkerDir(markerBase string) bool {
+	return opts.SkipMarkerSubtree && !strings.Contains(markerBase, opts.separator())
+}
+
+// separator - returns the path separator of the backend.
+func (opts *WalkOptions) separator() string {
+	if opts.Separator == "" {
+		return SlashSeparator
+	}
+	return opts.Separator
+}
+
+// join - joins an entry name to the directory it was listed from.
+func (opts *WalkOptions) join(prefixDir, name string) string {
+	if opts.separator() == SlashSeparator {
+		return pathJoin(prefixDir, name)
+	}
+	return prefixDir + name
+}
+
+// toSlash - translates a backend path into a key.
+func (opts *WalkOptions) toSlash(name string) string {
+	if opts.separator() != SlashSeparator {
+		name = strings.ReplaceAll(name, opts.separator(), SlashSeparator)
+	}
+	if opts.CollapseSlashes {
+		name = collapseSlashes(name)
+	}
+	if opts.Rewrite != nil {
+		name = opts.Rewrite(name)
+	}
+	return name
+}
+
+// fromSlash - translates a key into a backend path.
+func (opts *WalkOptions) fromSlash(name string) string {
+	if opts.Unrewrite != nil {
+		name = opts.Unrewrite(name)
+	}
+	if opts.separator() == SlashSeparator {
+		return name
+	}
+	return strings.ReplaceAll(name, SlashSeparator, opts.separator())
+}
+
+// waitListDir - waits for the rate limit to allow the next listDir
+// call, unless the walk is canceled or ended in the meantime.
+func (opts *WalkOptions) waitListDir(ctx context.Context, endWalkCh <-chan struct{}) error {
+	if opts.RateLimit == nil {
+		return nil
+	}
+	r := opts.RateLimit.Reserve()
+	if !r.OK() {
+		return ErrRateLimitNoBurst
+	}
+	delay := r.Delay()
+	if delay == 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	case <-endWalkCh:
+		r.Cancel()
+		return errWalkAbort
+	}
+}
+
+// checkDepth - returns an error if the walk may not descend into prefixDir.
+func (opts *WalkOptions) checkDepth(prefixDir string) error {
+	maxDepth := opts.MaxRecursionDepth
+	if maxDepth < 0 {
+		return nil
+	}
+	if maxDepth == 0 {
+		maxDepth = maxRecursionDepth
+	}
+	if strings.Count(prefixDir, opts.separator())-opts.rootDepth > maxDepth {
+		return fmt.Errorf("%.64s...: %w", opts.toSlash(prefixDir), ErrWalkTooDeep)
+	}
+	return nil
+}
+
+// checkKey - returns an error if the key is too long to be emitted.
+func (opts *WalkOptions) checkKey(key string) error {
+	maxKeyLength := opts.MaxKeyLength
+	if maxKeyLength == 0 {
+		maxKeyLength = maxObjectKeyLength
+	}
+	if len(key) > maxKeyLength {
+		return fmt.Errorf("%.64s...: %w", key, ErrKeyTooLong)
+	}
+	return nil
+}
+
+// isExcluded - returns true if the backend path name is under any of
+// the excluded prefixes.
+func (opts *WalkOptions) isExcluded(name string) bool {
+	name = opts.toSlash(name)
+	for _, prefix := range opts.ExcludePrefixes {
+		if HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesSuffix - returns true if the leaf name passes SuffixFilter.
+func (opts *WalkOptions) matchesSuffix(name string) bool {
+	if opts.foldSuffix {
+		return HasSuffix(strings.ToLower(name), strings.ToLower(opts.SuffixFilter))
+	}
+	return HasSuffix(name, opts.SuffixFilter)
+}
+
+// isFolderPlaceholder - returns true if the base name of the leaf name
+// is one of FolderPlaceholderNames.
+func (opts *WalkOptions) isFolderPlaceholder(name string) bool {
+	base := name[strings.LastIndex(name, SlashSeparator)+1:]
+	for _, placeholder := range opts.FolderPlaceholderNames {
+		if base == placeholder {
+			return true
+		}
+	}
+	return false
+}
+
+// listDirChecked - lists prefixDir and tells its subdirectories from its
+// leaf directories right away, listing it once more if it was modified in
+// between, as told by its stamp and the stamps of its leaf directories.
+// Changes deeper in the subdirectories are seen as the walk descends.
+func listDirChecked(ctx context.Context, bucket, prefixDir, entryPrefixMatch string, listDir ListDirFunc, isLeafDir IsLeafDirFunc, opts *WalkOptions, endWalkCh <-chan struct{}) (emptyDir bool, entries []*Entry, delayIsLeaf bool, leafDirs map[*Entry]bool, err error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		if attempt > 0 {
+			if err = opts.waitListDir(ctx, endWalkCh); err != nil {
+				return false, nil, false, nil, err
+			}
+		}
+		stamp := opts.DirStamp(bucket, prefixDir)
+		emptyDir, entries, delayIsLeaf = listDir(bucket, prefixDir, entryPrefixMatch)
+		leafDirs = make(map[*Entry]bool)
+		// A leaf directory written to in the interim period is a
+		// subdirectory to walk into.
+		leafStamps := make(map[string]string)
+		for _, entry := range entries {
+			if HasSuffix(entry.Name, opts.separator()) {
+				dir := opts.join(prefixDir, entry.Name)
+				dirStamp := opts.DirStamp(bucket, dir)
+				if leafDirs[entry] = isLeafDir(bucket, dir); leafDirs[entry] {
+					leafStamps[dir] = dirStamp
+				}
+			}
+		}
+		changed := opts.DirStamp(bucket, prefixDir) != stamp
+		for dir, dirStamp := range leafStamps {
+			changed = changed || opts.DirStamp(bucket, dir) != dirStamp
+		}
+		if !changed {
+			break
+		}
+		if opts.Tracer != nil {
+			opts.Tracer.Tracef("treeWalk: changed %q", prefixDir)
+		}
+	}
+	return emptyDir, entries, delayIsLeaf, leafDirs, nil
+}
+
+// recoverBackendPanic - recovers a panic of the backend in a goroutine
+// of the listing into *err, for the listing to fail with it rather than
+// crash or leave its channels open.
+func recoverBackendPanic(err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("%v: %w", r, ErrBackendPanic)
+	}
+}
+
 // treeWalk walks directory tree recursively pushing TreeWalkResult into the channel as and when it encounters files.
-func doTreeWalk(ctx context.Context, bucket, prefixDir, entryPrefixMatch, marker string, recursive bool, listDir ListDirFunc, isLeaf IsLeafFunc, isLeafDir IsLeafDirFunc, resultCh chan TreeWalkResult, endWalkCh <-chan struct{}, isEnd bool) (emptyDir bool, treeErr error) {
+func doTreeWalk(ctx context.Context, bucket, prefixDir, entryPrefixMatch, marker string, recursive bool, listDir ListDirFunc, isLeaf IsLeafFunc, isLeafDir IsLeafDirFunc, opts *WalkOptions, resultCh chan TreeWalkResult, endWalkCh <-chan struct{}, isEnd, skipMarkerDir bool) (emptyDir bool, treeErr error) {
+	defer recoverBackendPanic(&treeErr)
+
 	// Example:
 	// if prefixDir="one/two/three/" and marker="four/five.txt" treeWalk is recursively
 	// called with prefixDir="one/two/three/four/" and marker="five.txt"
+	//
+	// skipMarkerDir leaves out the directory marker names altogether,
+	// when it was walked already.
+
+	// The walk is canceled, as opposed to aborted through endWalkCh.
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	if err := opts.checkDepth(prefixDir); err != nil {
+		return false, err
+	}
 
 	var markerBase, markerDir string
 	if marker != "" {
 		// Ex: if marker="four/five.txt", markerDir="four/" markerBase="five.txt"
-		markerSplit := strings.SplitN(marker, SlashSeparator, 2)
+		markerSplit := strings.SplitN(marker, opts.separator(), 2)
 		markerDir = markerSplit[0]
 		if len(markerSplit) == 2 {
-			markerDir += SlashSeparator
+			markerDir += opts.separator()
 			markerBase = markerSplit[1]
 		}
 	}
 
-	emptyDir, entries, delayIsLeaf := listDir(bucket, prefixDir, entryPrefixMatch)
+	if opts.Tracer != nil {
+		opts.Tracer.Tracef("treeWalk: enter %q marker %q", prefixDir, marker)
+	}
+	// The first directory of the walk might have been listed already.
+	emptyDir, entries, delayIsLeaf, prefetched := opts.prefetched.take(prefixDir, entryPrefixMatch)
+	var leafDirs map[*Entry]bool
+	if !prefetched {
+		if err := opts.waitListDir(ctx, endWalkCh); err != nil {
+			return false, err
+		}
+		if opts.CheckDirChanges && opts.DirStamp != nil && isLeafDir != nil {
+			var err error
+			emptyDir, entries, delayIsLeaf, leafDirs, err = listDirChecked(ctx, bucket, prefixDir, entryPrefixMatch, listDir, isLeafDir, opts, endWalkCh)
+			if err != nil {
+				return false, err
+			}
+		} else {
+			emptyDir, entries, delayIsLeaf = listDir(bucket, prefixDir, entryPrefixMatch)
+		}
+	}
+	if opts.Metrics != nil {
+		opts.Metrics.IncDirsWalked()
+	}
+	if opts.Progress != nil {
+		opts.Progress.DirsVisited.Add(1)
+	}
 	// When isleaf check is delayed, make sure that it is set correctly here.
 	if delayIsLeaf && isLeaf == nil || isLeafDir == nil {
 		return false, errInvalidArgument
@@ -91,40 +639,140 @@ func doTreeWalk(ctx context.Context, bucket, prefixDir, entryPrefixMatch, marker
 		return true, nil
 	}
 
+	entries = trimLeadingSeparators(entries, opts.separator())
+	if entryPrefixMatch != "" {
+		// A backend ignoring the prefix would list the keys around it.
+		for i, entry := range entries {
+			if !HasPrefix(entry.Name, entryPrefixMatch) && (i > 0 || entry.Name != "") {
+				return false, fmt.Errorf("%s: entry %q is listed for prefix %q: %w", opts.toSlash(prefixDir), entry.Name, entryPrefixMatch, ErrBackendInvariant)
+			}
+		}
+	}
+	if delayIsLeaf && !canDelayIsLeaf(entries, opts.separator()) {
+		// Telling the leaves apart later would break the order of the
+		// entries, do it right away.
+		resolveLeaves(entries, opts.separator(), func(name string) bool {
+			return isLeaf(bucket, opts.join(prefixDir, name))
+		})
+		delayIsLeaf = false
+	}
+
+	if opts.MaxEntriesPerDir > 0 && len(entries) > opts.MaxEntriesPerDir {
+		return false, fmt.Errorf("%s: %w", opts.toSlash(prefixDir), ErrDirTooLarge)
+	}
+
 	// example:
 	// If markerDir="four/" Search() returns the index of "four/" in the sorted
 	// entries list so we skip all the entries till "four/"
 	idx := sort.Search(len(entries), func(i int) bool {
 		return entries[i].Name >= markerDir
 	})
+	if delayIsLeaf && idx > 0 {
+		// A directory listed without its trailing separator sorts right
+		// before the marker, while its keys may sort after the marker or
+		// the marker be within it.
+		name := entries[idx-1].Name
+		if !HasSuffix(name, opts.separator()) && markerDir <= name+opts.separator() &&
+			!isLeaf(bucket, opts.join(prefixDir, name)) {
+			entries[idx-1].Name = name + opts.separator()
+			idx--
+		}
+	}
 	entries = entries[idx:]
+	if skipMarkerDir && len(entries) > 0 && entries[0].Name == marker {
+		entries = entries[1:]
+	}
 	// For an empty list after search through the entries, return right here.
 	if len(entries) == 0 {
 		return false, nil
 	}
 
+	// Walk the sibling subtrees ahead of their turn in parallel mode.
+	var subtrees []*subtreeWalk
+	if recursive && opts.workers != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		subtrees = walkSubtreesAhead(ctx, bucket, prefixDir, entries, markerDir, markerBase,
+			listDir, isLeaf, isLeafDir, opts, endWalkCh, isEnd)
+	}
+
 	for i, entry := range entries {
 		var leaf, leafDir bool
+		if entry.Name == "" && (i > 0 || opts.NoSelfEntry) {
+			// Only the directory itself, listed first, has no name.
+			return false, fmt.Errorf("%s: empty entry name at index %d: %w", opts.toSlash(prefixDir), i, ErrBackendInvariant)
+		}
 		if i == 0 && entry.Name == "" {
+			if err := opts.checkKey(opts.toSlash(prefixDir)); err != nil {
+				return false, err
+			}
 			select {
+			case <-ctx.Done():
+				return false, ctx.Err()
 			case <-endWalkCh:
 				return false, errWalkAbort
-			case resultCh <- TreeWalkResult{entry: &Entry{prefixDir, entry.Info}, isEmptyDir: leafDir, end: (i == len(entries)-1) && isEnd}:
+			case resultCh <- TreeWalkResult{entry: &Entry{opts.toSlash(prefixDir), entry.Info}, isEmptyDir: leafDir, end: (i == len(entries)-1) && isEnd}:
+				if opts.Progress != nil {
+					opts.Progress.EntriesEmitted.Add(1)
+				}
 			}
 			continue
 		}
 
-		leaf = !HasSuffix(entry.Name, slashSeparator)
+		// Prune excluded entries, skipping directories as a whole.
+		if opts.isExcluded(opts.join(prefixDir, entry.Name)) {
+			continue
+		}
+
+		// Decision to do isLeaf check was pushed from listDir() to here.
+		if delayIsLeaf {
+			leaf = isLeaf(bucket, opts.join(prefixDir, entry.Name))
+			if leaf {
+				entry.Name = strings.TrimSuffix(entry.Name, opts.separator())
+			} else if !HasSuffix(entry.Name, opts.separator()) {
+				// A directory listed without its trailing separator, such as
+				// an object directory of erasure backends.
+				entry.Name += opts.separator()
+			}
+		} else {
+			leaf = !HasSuffix(entry.Name, opts.separator())
+		}
+		if leaf && (!opts.matchesSuffix(entry.Name) || opts.isFolderPlaceholder(entry.Name)) {
+			continue
+		}
 
-		if HasSuffix(entry.Name, slashSeparator) {
-			leafDir = isLeafDir(bucket, pathJoin(prefixDir, entry.Name))
+		if HasSuffix(entry.Name, opts.separator()) {
+			var ok bool
+			if leafDir, ok = leafDirs[entry]; !ok {
+				leafDir = isLeafDir(bucket, opts.join(prefixDir, entry.Name))
+			}
 		}
 
 		isDir := !leafDir && !leaf
 
 		if i == 0 && markerDir == entry.Name {
-			if !recursive {
+			var follow bool
+			if !recursive && isDir && markerBase != "" {
+				// The marker is within the directory, such as the one of a
+				// recursive listing, list it for the keys after the marker.
+				var err error
+				if follow, err = keysFollow(ctx, bucket, opts.join(prefixDir, entry.Name), markerBase, listDir, isLeaf, isLeafDir, opts); err != nil {
+					return false, err
+				}
+			}
+			if !recursive && !follow {
 				// Skip as the marker would already be listed in the previous listing.
+				if opts.Tracer != nil {
+					opts.Tracer.Tracef("treeWalk: skip marker %q", entry.Name)
+				}
+				continue
+			}
+			if recursive && isDir && opts.skipsMarkerDir(markerBase) {
+				// Resume after the directory holding the marker.
+				if opts.Tracer != nil {
+					opts.Tracer.Tracef("treeWalk: skip marker subtree %q", entry.Name)
+				}
 				continue
 			}
 			if recursive && !isDir {
@@ -133,6 +781,9 @@ func doTreeWalk(ctx context.Context, bucket, prefixDir, entryPrefixMatch, marker
 				// should not be skipped, instead it will need to be treeWalk()'ed into.
 
 				// Skip if it is a file though as it would be listed in previous listing.
+				if opts.Tracer != nil {
+					opts.Tracer.Tracef("treeWalk: skip marker %q", entry.Name)
+				}
 				continue
 			}
 		}
@@ -148,8 +799,39 @@ func doTreeWalk(ctx context.Context, bucket, prefixDir, entryPrefixMatch, marker
 			// markIsEnd is passed to this entry's treeWalk() so that treeWalker.end can be marked
 			// true at the end of the treeWalk stream.
 			markIsEnd := i == len(entries)-1 && isEnd
-			emptyDir, err := doTreeWalk(ctx, bucket, pathJoin(prefixDir, entry.Name), prefixMatch, markerArg, recursive,
-				listDir, isLeaf, isLeafDir, resultCh, endWalkCh, markIsEnd)
+			emittedAhead := opts.emitsAhead(entry)
+			if emittedAhead && !(i == 0 && entry.Name == markerDir) {
+				// Emit the directory ahead of its contents, unless the
+				// marker is within it, when it was emitted already.
+				dirEntry := &Entry{opts.toSlash(opts.join(prefixDir, entry.Name)), entry.Info}
+				if opts.Tracer != nil {
+					opts.Tracer.Tracef("treeWalk: emit %q", dirEntry.Name)
+				}
+				select {
+				case <-ctx.Done():
+					return false, ctx.Err()
+				case <-endWalkCh:
+					return false, errWalkAbort
+				case resultCh <- TreeWalkResult{entry: dirEntry}:
+					if opts.Progress != nil {
+						opts.Progress.EntriesEmitted.Add(1)
+					}
+				}
+			}
+			if opts.Tracer != nil {
+				opts.Tracer.Tracef("treeWalk: recurse %q", opts.join(prefixDir, entry.Name))
+			}
+			var emptyDir bool
+			var err error
+			// Directories listed without their trailing separator are only
+			// known as such here, they are walked serially.
+			if subtrees != nil && subtrees[i] != nil && !subtrees[i].claim() {
+				// Walked ahead by a worker, catch up with it.
+				emptyDir, err = subtrees[i].forward(ctx, resultCh, endWalkCh)
+			} else {
+				emptyDir, err = doTreeWalk(ctx, bucket, opts.join(prefixDir, entry.Name), prefixMatch, markerArg, recursive,
+					listDir, isLeaf, isLeafDir, opts, resultCh, endWalkCh, markIsEnd, false)
+			}
 			if err != nil {
 				return false, err
 			}
@@ -160,15 +842,30 @@ func doTreeWalk(ctx context.Context, bucket, prefixDir, entryPrefixMatch, marker
 			if !emptyDir {
 				continue
 			}
+			if emittedAhead {
+				// Sent already, ahead of its contents.
+				continue
+			}
 		}
 
 		// EOF is set if we are at last entry and the caller indicated we at the end.
 		isEOF := (i == len(entries)-1) && isEnd
-		entry.Name = pathJoin(prefixDir, entry.Name)
+		entry.Name = opts.toSlash(opts.join(prefixDir, entry.Name))
+		if err := opts.checkKey(entry.Name); err != nil {
+			return false, err
+		}
+		if opts.Tracer != nil {
+			opts.Tracer.Tracef("treeWalk: emit %q", entry.Name)
+		}
 		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
 		case <-endWalkCh:
 			return false, errWalkAbort
 		case resultCh <- TreeWalkResult{entry: entry, isEmptyDir: leafDir, end: isEOF}:
+			if opts.Progress != nil {
+				opts.Progress.EntriesEmitted.Add(1)
+			}
 		}
 	}
 
@@ -177,7 +874,7 @@ func doTreeWalk(ctx context.Context, bucket, prefixDir, entryPrefixMatch, marker
 }
 
 // Initiate a new treeWalk in a goroutine.
-func startTreeWalk(ctx context.Context, bucket, prefix, marker string, recursive bool, listDir ListDirFunc, isLeaf IsLeafFunc, isLeafDir IsLeafDirFunc, endWalkCh <-chan struct{}) chan TreeWalkResult {
+func startTreeWalk(ctx context.Context, bucket, prefix, marker string, recursive bool, listDir ListDirFunc, isLeaf IsLeafFunc, isLeafDir IsLeafDirFunc, opts WalkOptions, endWalkCh <-chan struct{}) chan TreeWalkResult {
 	// Example 1
 	// If prefix is "one/two/three/" and marker is "one/two/three/four/five.txt"
 	// treeWalk is called with prefixDir="one/two/three/" and marker="four/five.txt"
@@ -188,23 +885,143 @@ func startTreeWalk(ctx context.Context, bucket, prefix, marker string, recursive
 	// treeWalk is called with prefixDir="one/two/" and marker="three/four/five.txt"
 	// and entryPrefixMatch="th"
 
-	resultCh := make(chan TreeWalkResult, maxObjectList)
+	resultCh := make(chan TreeWalkResult, DefaultMaxObjectList)
+	prefix = opts.fromSlash(prefix)
+	if marker != "" {
+		marker = opts.fromSlash(marker)
+	}
 	entryPrefixMatch := prefix
 	prefixDir := ""
-	lastIndex := strings.LastIndex(prefix, SlashSeparator)
+	lastIndex := strings.LastIndex(prefix, opts.separator())
 	if lastIndex != -1 {
-		entryPrefixMatch = prefix[lastIndex+1:]
-		prefixDir = prefix[:lastIndex+1]
+		entryPrefixMatch = prefix[lastIndex+len(opts.separator()):]
+		prefixDir = prefix[:lastIndex+len(opts.separator())]
 	}
 	marker = strings.TrimPrefix(marker, prefixDir)
+	opts.rootDepth = strings.Count(prefixDir, opts.separator())
+	if recursive && opts.ParallelSubtrees > 0 {
+		opts.workers = make(chan struct{}, opts.ParallelSubtrees)
+	}
 	go func() {
 		isEnd := true // Indication to start walking the tree with end as true.
-		doTreeWalk(ctx, bucket, prefixDir, entryPrefixMatch, marker, recursive, listDir, isLeaf, isLeafDir, resultCh, endWalkCh, isEnd)
+		_, err := doTreeWalk(ctx, bucket, prefixDir, entryPrefixMatch, marker, recursive, listDir, isLeaf, isLeafDir, &opts, resultCh, endWalkCh, isEnd, false)
+		if err != nil && err != errWalkAbort {
+			// Hand the failure over to the consumer, unless it went away.
+			select {
+			case <-endWalkCh:
+			case resultCh <- TreeWalkResult{err: err}:
+			}
+		}
 		close(resultCh)
 	}()
 	return resultCh
 }
 
+// keysFollow - returns true if any key of the directory dir follows
+// marker within it, walking dir recursively up to the first such key.
+func keysFollow(ctx context.Context, bucket, dir, marker string, listDir ListDirFunc, isLeaf IsLeafFunc, isLeafDir IsLeafDirFunc, opts *WalkOptions) (bool, error) {
+	subOpts := *opts
+	subOpts.prefetched, subOpts.workers, subOpts.ParallelSubtrees = nil, nil, 0
+	endWalkCh := make(chan struct{})
+	defer close(endWalkCh)
+	resultCh := make(chan TreeWalkResult)
+	go func() {
+		defer close(resultCh)
+		_, err := doTreeWalk(ctx, bucket, dir, "", marker, true, listDir, isLeaf, isLeafDir, &subOpts, resultCh, endWalkCh, false, false)
+		if err != nil && err != errWalkAbort {
+			select {
+			case <-endWalkCh:
+			case resultCh <- TreeWalkResult{err: err}:
+			}
+		}
+	}()
+	result, ok := <-resultCh
+	if !ok {
+		return false, nil
+	}
+	return result.err == nil, result.err
+}
+
+// resumeTreeWalk - like startTreeWalk() for recursive walks, resuming
+// from marker within dir, a directory below the one of prefix. Rather
+// than going down from the directory of prefix to the one of marker,
+// the walk starts right in dir and then walks the rest of each of its
+// parents on the way up.
+func resumeTreeWalk(ctx context.Context, bucket, prefix, dir, marker string, listDir ListDirFunc, isLeaf IsLeafFunc, isLeafDir IsLeafDirFunc, opts WalkOptions, endWalkCh <-chan struct{}) chan TreeWalkResult {
+	resultCh := make(chan TreeWalkResult, DefaultMaxObjectList)
+	prefix, dir, marker = opts.fromSlash(prefix), opts.fromSlash(dir), opts.fromSlash(dir+marker)
+	marker = strings.TrimPrefix(marker, dir)
+	entryPrefixMatch := prefix
+	prefixDir := ""
+	lastIndex := strings.LastIndex(prefix, opts.separator())
+	if lastIndex != -1 {
+		entryPrefixMatch = prefix[lastIndex+len(opts.separator()):]
+		prefixDir = prefix[:lastIndex+len(opts.separator())]
+	}
+	opts.rootDepth = strings.Count(prefixDir, opts.separator())
+	if opts.ParallelSubtrees > 0 {
+		opts.workers = make(chan struct{}, opts.ParallelSubtrees)
+	}
+
+	// The directories from the one of prefix down to dir.
+	dirs := []string{prefixDir}
+	for rest := strings.TrimPrefix(dir, prefixDir); rest != ""; {
+		i := strings.Index(rest, opts.separator()) + len(opts.separator())
+		dirs = append(dirs, dirs[len(dirs)-1]+rest[:i])
+		rest = rest[i:]
+	}
+
+	walkCh := make(chan TreeWalkResult)
+	go func() {
+		defer close(walkCh)
+		var err error
+		for i := len(dirs) - 1; i >= 0 && err == nil; i-- {
+			match, skipMarkerDir := "", i < len(dirs)-1
+			if i == 0 {
+				match = entryPrefixMatch
+			}
+			if skipMarkerDir {
+				// Walked already on the way up.
+				marker = strings.TrimPrefix(dirs[i+1], dirs[i])
+			}
+			_, err = doTreeWalk(ctx, bucket, dirs[i], match, marker, true, listDir, isLeaf, isLeafDir, &opts, walkCh, endWalkCh, false, skipMarkerDir)
+		}
+		if err != nil && err != errWalkAbort {
+			select {
+			case <-endWalkCh:
+			case walkCh <- TreeWalkResult{err: err}:
+			}
+		}
+	}()
+
+	// Whether the walk of a directory is at the end depends on its
+	// parents, walked later. Hold every result back until the next one,
+	// so that the last one is marked as such.
+	go func() {
+		defer close(resultCh)
+		var last TreeWalkResult
+		var held bool
+		for result := range walkCh {
+			if held {
+				select {
+				case <-endWalkCh:
+					return
+				case resultCh <- last:
+				}
+			}
+			last, held = result, true
+		}
+		if held {
+			last.end = last.err == nil
+			select {
+			case <-endWalkCh:
+			case resultCh <- last:
+			}
+		}
+	}()
+	return resultCh
+}
+
 var globalWindowsOSName = "windows"
 
 // HasPrefix - Prefix matcher string matches prefix in a platform specific way.
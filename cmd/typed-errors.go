@@ -4,3 +4,43 @@ import "errors"
 
 // errInvalidArgument means that input argument is invalid.
 var errInvalidArgument = errors.New("Invalid arguments specified")
+
+// ErrInvalidCursor means that a listing cursor is malformed or belongs
+// to a different listing.
+var ErrInvalidCursor = errors.New("Invalid listing cursor specified")
+
+// ErrDirTooLarge means that a directory holds more entries than the
+// walk is allowed to handle.
+var ErrDirTooLarge = errors.New("Directory has too many entries")
+
+// ErrKeyTooLong means that the walk came across a key longer than it
+// is allowed to emit.
+var ErrKeyTooLong = errors.New("Object key is too long")
+
+// ErrRateLimitNoBurst means that the rate limit of the walk can never
+// allow a listDir call, as its burst is zero.
+var ErrRateLimitNoBurst = errors.New("listDir rate limit has no burst")
+
+// ErrWalkTooDeep means that the walk came across directories nested
+// deeper than it is allowed to descend.
+var ErrWalkTooDeep = errors.New("Directories are nested too deep")
+
+// ErrInvalidEncodingType means that the requested encoding type of the
+// keys is not supported.
+var ErrInvalidEncodingType = errors.New("Invalid encoding type specified")
+
+// ErrInvalidDelimiter means that the delimiter is white space, or longer
+// than a character without ListOptions.MultiCharDelimiter.
+var ErrInvalidDelimiter = errors.New("Invalid delimiter specified")
+
+// ErrBackendInvariant means that the listDir function of a backend
+// breaks an invariant the tree walk relies on.
+var ErrBackendInvariant = errors.New("Backend breaks a listing invariant")
+
+// ErrStatTimeout means that resolving the ObjectInfo of an entry took
+// longer than the listing allows.
+var ErrStatTimeout = errors.New("Object stat timed out")
+
+// ErrBackendPanic means that a function of the backend, such as listDir
+// or getObjInfo, panicked while listing.
+var ErrBackendPanic = errors.New("Backend panicked while listing")
@@ -1,3 +1,5 @@
 module github.com/zhaohuxing/s3
 
 go 1.22.6
+
+require golang.org/x/time v0.9.0
@@ -0,0 +1,139 @@
+package tests
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	. "github.com/zhaohuxing/s3/cmd"
+)
+
+func TestMarshalS3XML(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 30, 45, 123456789, time.FixedZone("CEST", 2*60*60))
+	testCases := []struct {
+		loi      ListObjectsInfo
+		expected string
+	}{
+		{
+			loi: ListObjectsInfo{},
+			expected: `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+				`<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">` +
+				`<Name>bucket</Name><IsTruncated>false</IsTruncated>` +
+				`</ListBucketResult>`,
+		},
+		{
+			loi: ListObjectsInfo{
+				IsTruncated: true,
+				NextMarker:  "b/",
+				Objects: []ObjectInfo{
+					{Name: "a&b", ModTime: modTime, Size: 42, ETag: "d41d8cd98f00b204e9800998ecf8427e"},
+					{Name: "a1", ModTime: modTime, StorageClass: "GLACIER", Owner: "alice"},
+				},
+				Prefixes: []string{"b/"},
+			},
+			expected: `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+				`<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">` +
+				`<Name>bucket</Name><IsTruncated>true</IsTruncated><NextMarker>b/</NextMarker>` +
+				`<Contents><Key>a&amp;b</Key><LastModified>2024-05-01T10:30:45.123Z</LastModified>` +
+				`<ETag>&#34;d41d8cd98f00b204e9800998ecf8427e&#34;</ETag><Size>42</Size><StorageClass>STANDARD</StorageClass></Contents>` +
+				`<Contents><Key>a1</Key><LastModified>2024-05-01T10:30:45.123Z</LastModified>` +
+				`<ETag></ETag><Size>0</Size><Owner><ID>alice</ID><DisplayName>alice</DisplayName></Owner><StorageClass>GLACIER</StorageClass></Contents>` +
+				`<CommonPrefixes><Prefix>b/</Prefix></CommonPrefixes>` +
+				`</ListBucketResult>`,
+		},
+		{
+			loi: ListObjectsInfo{
+				Objects: []ObjectInfo{
+					{Name: "a", ModTime: modTime, StorageClass: "GLACIER", RestoreOngoing: true},
+					{Name: "b", ModTime: modTime, StorageClass: "GLACIER", RestoreExpires: modTime.Add(24 * time.Hour)},
+				},
+			},
+			expected: `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+				`<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">` +
+				`<Name>bucket</Name><IsTruncated>false</IsTruncated>` +
+				`<Contents><Key>a</Key><LastModified>2024-05-01T10:30:45.123Z</LastModified>` +
+				`<ETag></ETag><Size>0</Size><StorageClass>GLACIER</StorageClass>` +
+				`<RestoreStatus><IsRestoreInProgress>true</IsRestoreInProgress></RestoreStatus></Contents>` +
+				`<Contents><Key>b</Key><LastModified>2024-05-01T10:30:45.123Z</LastModified>` +
+				`<ETag></ETag><Size>0</Size><StorageClass>GLACIER</StorageClass>` +
+				`<RestoreStatus><IsRestoreInProgress>false</IsRestoreInProgress>` +
+				`<RestoreExpiryDate>2024-05-02T10:30:45.123Z</RestoreExpiryDate></RestoreStatus></Contents>` +
+				`</ListBucketResult>`,
+		},
+	}
+	for i, testCase := range testCases {
+		buf, err := testCase.loi.MarshalS3XML("bucket")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != testCase.expected {
+			t.Errorf("Test %d: expected\n%s\ngot\n%s", i+1, testCase.expected, buf)
+		}
+	}
+}
+
+// countingWriter - counts the writes made to it.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestWriteNDJSON(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 30, 45, 0, time.UTC)
+	loi := ListObjectsInfo{
+		Objects: []ObjectInfo{
+			{Bucket: "bucket", Name: "a", ModTime: modTime, Size: 1, ETag: "etag"},
+			{Bucket: "bucket", Name: "c", ModTime: modTime, UserDefined: map[string]string{"k": "v"}},
+		},
+		Prefixes: []string{"b/", "d/"},
+	}
+
+	var w countingWriter
+	if err := WriteNDJSON(&w, loi); err != nil {
+		t.Fatal(err)
+	}
+	// Written a line at a time.
+	if w.writes != 4 {
+		t.Fatalf("expected 4 writes, got %d", w.writes)
+	}
+
+	var decoded ListObjectsInfo
+	var order []string
+	scanner := bufio.NewScanner(&w)
+	for scanner.Scan() {
+		var line map[string]json.RawMessage
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		if prefix, ok := line["prefix"]; ok {
+			var name string
+			if err := json.Unmarshal(prefix, &name); err != nil {
+				t.Fatal(err)
+			}
+			decoded.Prefixes = append(decoded.Prefixes, name)
+			order = append(order, name)
+			continue
+		}
+		var objInfo ObjectInfo
+		if err := json.Unmarshal(scanner.Bytes(), &objInfo); err != nil {
+			t.Fatal(err)
+		}
+		decoded.Objects = append(decoded.Objects, objInfo)
+		order = append(order, objInfo.Name)
+	}
+	if !reflect.DeepEqual(decoded.Objects, loi.Objects) || !reflect.DeepEqual(decoded.Prefixes, loi.Prefixes) {
+		t.Fatalf("expected %+v, got %+v", loi, decoded)
+	}
+	if fmt.Sprint(order) != "[a b/ c d/]" {
+		t.Fatalf("expected the lines in name order, got %v", order)
+	}
+}
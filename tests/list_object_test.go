@@ -5,8 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sort"
 	"strings"
-	"syscall"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -24,38 +25,25 @@ func npath(bucket, prefixDir, name string) string {
 }
 
 func getObjectInfo(ctx context.Context, bucket, object string, info *ObjectInfo) (obj ObjectInfo, err error) {
-	//var eno syscall.Errno
 	if info == nil {
+		// Links to external file systems fail with ENOTSUP, which the
+		// listing replaces with empty objects when asked to.
 		fi, eno := os.Stat(cpath(bucket, object))
-		if eno == nil {
-			size := fi.Size()
-			if fi.IsDir() {
-				size = 0
-			}
-			info = &ObjectInfo{
-				Bucket:  bucket,
-				ModTime: fi.ModTime(),
-				Size:    size,
-				IsDir:   fi.IsDir(),
-			}
+		if eno != nil {
+			return obj, eno
 		}
-
-		// replace links to external file systems with empty files
-		if errors.Is(eno, syscall.ENOTSUP) {
-			now := time.Now()
-			info = &ObjectInfo{
-				Bucket:  bucket,
-				ModTime: now,
-				Size:    0,
-				IsDir:   false,
-			}
-			eno = nil
+		size := fi.Size()
+		if fi.IsDir() {
+			size = 0
+		}
+		info = &ObjectInfo{
+			Bucket:  bucket,
+			ModTime: fi.ModTime(),
+			Size:    size,
+			IsDir:   fi.IsDir(),
 		}
 	}
 
-	if info == nil {
-		return obj, errors.New("object is nil")
-	}
 	info.Name = object
 	return *info, nil
 }
@@ -232,3 +220,291 @@ func TestLsCase3(t *testing.T) {
 	delimiter, prefix, marker, maxKeys := "/", "a", "", 100
 	ListObjectFn(prefix, marker, delimiter, maxKeys)
 }
+
+// cancelingResolver - cancels the listing once a number of objects
+// has been resolved.
+type cancelingResolver struct {
+	cancel context.CancelFunc
+	after  int64
+	calls  int64
+}
+
+func (r *cancelingResolver) ResolveObject(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	if atomic.AddInt64(&r.calls, 1) == r.after {
+		r.cancel()
+	}
+	return getObjectInfo(ctx, bucket, name, info)
+}
+
+func (r *cancelingResolver) ResolveDir(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	return getObjectInfo(ctx, bucket, name, info)
+}
+
+func TestListObjectsCanceled(t *testing.T) {
+	for _, delimiter := range []string{"", "/", "-"} {
+		// Canceled upfront.
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := ListObjects(ctx, "", "a1/", "", delimiter, 100,
+			NewTreeWalkPool(time.Minute), listDirFactory(), isLeaf, isLeafDir, getObjectInfo, getObjectInfo)
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("delimiter %q: expected context.Canceled, got %v", delimiter, err)
+		}
+
+		// Canceled halfway through the page.
+		ctx, cancel = context.WithCancel(context.Background())
+		resolver := &cancelingResolver{cancel: cancel, after: 5}
+		_, err = ListObjectsWithResolver(ctx, "", "a1/", "", delimiter, 100,
+			NewTreeWalkPool(time.Minute), listDirFactory(), isLeaf, isLeafDir, resolver, ListOptions{})
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("delimiter %q: expected context.Canceled, got %v", delimiter, err)
+		}
+	}
+}
+
+func TestTreeWalkCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := NextPrefix(ctx, "", "", "", listDirFactory(), isLeafDir)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestListObjectsExactKey(t *testing.T) {
+	var listed int64
+	listDir := func(bucket, prefixDir, prefixEntry string) (bool, []*Entry, bool) {
+		atomic.AddInt64(&listed, 1)
+		return listDirFactory()(bucket, prefixDir, prefixEntry)
+	}
+	listObjects := func(prefix, marker string) ListObjectsInfo {
+		result, err := ListObjects(context.Background(), "", prefix, marker, "", 1,
+			NewTreeWalkPool(time.Minute), listDir, isLeaf, isLeafDir, getObjectInfo, getObjectInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	// Only the parent directory is listed, nothing else shares the prefix.
+	result := listObjects("a1/b2/c11.txt", "")
+	if len(result.Objects) != 1 || result.Objects[0].Name != "a1/b2/c11.txt" || result.IsTruncated {
+		t.Fatalf("expected a1/b2/c11.txt alone, got %+v", result)
+	}
+	if listed != 1 {
+		t.Fatalf("expected a single listDir call, got %d", listed)
+	}
+
+	// Keys which do not exist fall back to the walk.
+	listed = 0
+	result = listObjects("a1/b2/c1", "")
+	if len(result.Objects) != 1 || result.Objects[0].Name != "a1/b2/c1/1.txt" {
+		t.Fatalf("expected a1/b2/c1/1.txt, got %+v", result.Objects)
+	}
+	if listed == 0 {
+		t.Fatal("expected the listing to walk")
+	}
+
+	// Like the walk, leaves out the keys filtered by the backend.
+	tree := newMemBackend("a/1~deleted", "a/3", "obj", "obj.txt")
+	tree.Put(ObjectInfo{Name: "a/2", DeleteMarker: true})
+	filtered := filteredListDir(tree, FilterOptions{
+		IsTombstone: func(entry *Entry) bool {
+			return strings.HasSuffix(entry.Name, "~deleted")
+		},
+		IsDeleted: func(info *ObjectInfo) bool {
+			return info.DeleteMarker
+		},
+	})
+	list := func(prefix, marker string, opts ListOptions) (ListObjectsInfo, error) {
+		return ListObjectsWithResolver(context.Background(), "", prefix, marker, "", 1,
+			NewTreeWalkPool(time.Minute), filtered, tree.IsLeaf, tree.IsLeafDir, memResolver{tree}, opts)
+	}
+	for _, prefix := range []string{"a/1~deleted", "a/2"} {
+		result, err := list(prefix, "", ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Objects) != 0 || result.IsTruncated {
+			t.Fatalf("%s: expected nothing, got %+v", prefix, result)
+		}
+	}
+	opts := ListOptions{WalkOptions: WalkOptions{MaxKeyLength: 2}}
+	if _, err := list("a/3", "", opts); !errors.Is(err, ErrKeyTooLong) {
+		t.Fatalf("expected ErrKeyTooLong, got %v", err)
+	}
+
+	// The other keys sharing the prefix follow on the next pages.
+	names := listNames(t, func(marker string) (ListObjectsInfo, error) {
+		return list("obj", marker, ListOptions{})
+	})
+	if strings.Join(names, ",") != "obj,obj.txt" {
+		t.Fatalf("expected obj,obj.txt, got %v", names)
+	}
+}
+
+func TestListObjectsEmptyBucket(t *testing.T) {
+	tree := newMemBackend()
+	for _, prefix := range []string{"", "a/", "a/b"} {
+		for _, delimiter := range []string{"", "/"} {
+			tracer := &captureTracer{}
+			opts := ListOptions{WalkOptions: WalkOptions{Tracer: tracer}}
+			result, err := listMem(tree, prefix, "", delimiter, 100, nil, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Objects) != 0 || len(result.Prefixes) != 0 || result.IsTruncated {
+				t.Fatalf("expected an empty listing, got %+v", result)
+			}
+			// No walk was started.
+			if len(tracer.traces) != 0 {
+				t.Fatalf("prefix %q delimiter %q: expected no walk, got %v", prefix, delimiter, tracer.traces)
+			}
+		}
+	}
+}
+
+func BenchmarkListObjectsEmptyBucket(b *testing.B) {
+	tree := newMemBackend()
+	pool := NewTreeWalkPool(time.Minute)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := listMem(tree, "", "", "/", 1000, pool, ListOptions{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestListObjectsMarkerWithinPrefix(t *testing.T) {
+	listObjects := func(prefix, marker, delimiter string) []string {
+		var names []string
+		for {
+			result, err := ListObjects(context.Background(), "", prefix, marker, delimiter, 7,
+				NewTreeWalkPool(time.Minute), listDirFactory(), isLeaf, isLeafDir, getObjectInfo, getObjectInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, obj := range result.Objects {
+				names = append(names, obj.Name)
+			}
+			names = append(names, result.Prefixes...)
+			if !result.IsTruncated {
+				return names
+			}
+			marker = result.NextMarker
+		}
+	}
+
+	// The prefix does not end with a slash while the marker is within a
+	// directory it matches.
+	for _, tc := range []struct{ prefix, marker, delimiter string }{
+		{"a1", "a1/b1/1.txt", ""},
+		{"a1", "a1/b1/c1/1.txt", ""},
+		{"a1", "a1/", "/"},
+		{"a1/b", "a1/b1/1.txt", ""},
+		{"a1/b", "a1/b1/", "/"},
+	} {
+		var expected []string
+		for _, name := range listObjects(tc.prefix, "", tc.delimiter) {
+			if name > tc.marker {
+				expected = append(expected, name)
+			}
+		}
+		if len(expected) == 0 {
+			t.Fatalf("%+v: expected keys past the marker", tc)
+		}
+		// Pages list their objects ahead of their prefixes.
+		names := listObjects(tc.prefix, tc.marker, tc.delimiter)
+		sort.Strings(expected)
+		sort.Strings(names)
+		if strings.Join(names, ",") != strings.Join(expected, ",") {
+			t.Fatalf("%+v: expected %v, got %v", tc, expected, names)
+		}
+	}
+}
+
+func TestListObjectsPrefixIsObject(t *testing.T) {
+	for _, prefix := range []string{"a1.txt", "a1/b2/c11.txt", "z2.txt"} {
+		for _, delimiter := range []string{"", "/"} {
+			for _, maxKeys := range []int{1, 2, 1000} {
+				result, err := ListObjects(context.Background(), "", prefix, "", delimiter, maxKeys,
+					NewTreeWalkPool(time.Minute), listDirFactory(), isLeaf, isLeafDir, getObjectInfo, getObjectInfo)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(result.Objects) != 1 || result.Objects[0].Name != prefix || len(result.Prefixes) != 0 || result.IsTruncated {
+					t.Fatalf("%s %q %d: expected the object alone, got %+v", prefix, delimiter, maxKeys, result)
+				}
+			}
+		}
+	}
+}
+
+// delimitedAfter - the keys and common prefixes listed after marker, by
+// the S3 semantics the listings follow across delimiter changes.
+func delimitedAfter(keys []string, prefix, marker, delimiter string) []string {
+	var names []string
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) || key <= marker {
+			continue
+		}
+		name := key
+		if i := strings.Index(key[len(prefix):], delimiter); i != -1 {
+			name = key[:len(prefix)+i+len(delimiter)]
+			if name == marker {
+				// Listed on the previous page.
+				continue
+			}
+		}
+		if len(names) == 0 || names[len(names)-1] != name {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestListObjectsDelimiterToggle(t *testing.T) {
+	tree := newMemBackend("a/1", "a/2", "a/b/1", "a/b/2", "a-1", "a-2", "a-3/x", "b", "c/1", "c/d/e/1", "c/d/e/2", "c/f")
+	for _, prefix := range []string{"", "a/", "c/"} {
+		// Every page of a flat listing, toggled to the delimiters.
+		var marker string
+		for {
+			flat, err := listMem(tree, prefix, marker, "", 1, nil, ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !flat.IsTruncated {
+				break
+			}
+			marker = flat.NextMarker
+			for _, delimiter := range []string{"/", "-"} {
+				for _, maxKeys := range []int{1, 100} {
+					names := listNames(t, func(next string) (ListObjectsInfo, error) {
+						if next == "" {
+							next = marker
+						}
+						return listMem(tree, prefix, next, delimiter, maxKeys, NewTreeWalkPool(time.Minute), ListOptions{})
+					})
+					sort.Strings(names)
+					expected := delimitedAfter(tree.Keys(), prefix, marker, delimiter)
+					if fmt.Sprint(names) != fmt.Sprint(expected) {
+						t.Fatalf("%q after %q by %q, %d keys: expected %v, got %v", prefix, marker, delimiter, maxKeys, expected, names)
+					}
+					// The range scans of a sorted source agree with the walk.
+					source := &sortedKeys{keys: tree.Keys()}
+					scanned := listNames(t, func(next string) (ListObjectsInfo, error) {
+						if next == "" {
+							next = marker
+						}
+						return ListFromSortedSource(context.Background(), "", prefix, next, delimiter, maxKeys, source, tree.GetObjectInfo)
+					})
+					sort.Strings(scanned)
+					if fmt.Sprint(scanned) != fmt.Sprint(expected) {
+						t.Fatalf("%q after %q by %q, %d keys from a sorted source: expected %v, got %v", prefix, marker, delimiter, maxKeys, expected, scanned)
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,985 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/zhaohuxing/s3/cmd"
+)
+
+func fsBackend() ListBackend {
+	return ListBackend{
+		Pool:      NewTreeWalkPool(time.Minute),
+		ListDir:   listDirFactory(),
+		IsLeaf:    isLeaf,
+		IsLeafDir: isLeafDir,
+		Resolver:  funcResolver(getObjectInfo),
+	}
+}
+
+// funcResolver - resolves objects and directories alike through fn.
+type funcResolver func(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error)
+
+func (fn funcResolver) ResolveObject(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	return fn(ctx, bucket, name, info)
+}
+
+func (fn funcResolver) ResolveDir(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	return fn(ctx, bucket, name, info)
+}
+
+func TestListObjectsWithOptions(t *testing.T) {
+	// The cases of TestLsCase1 to TestLsCase3 and a few more.
+	testCases := []struct {
+		prefix    string
+		delimiter string
+		maxKeys   int
+	}{
+		{"", "", 100},
+		{"a", "", 100},
+		{"a1/", "", 100},
+		{"a1/c", "", 100},
+		{"a", "/", 100},
+		{"b2/", "/", 7},
+		{"c3/a", "-", 5},
+	}
+	for _, testCase := range testCases {
+		pool := NewTreeWalkPool(time.Minute)
+		expected := listNames(t, func(marker string) (ListObjectsInfo, error) {
+			return ListObjects(context.Background(), "", testCase.prefix, marker, testCase.delimiter, testCase.maxKeys,
+				pool, listDirFactory(), isLeaf, isLeafDir, getObjectInfo, getObjectInfo)
+		})
+		backend := fsBackend()
+		got := listNames(t, func(marker string) (ListObjectsInfo, error) {
+			opts := ListOptions{Delimiter: testCase.delimiter, Marker: marker, MaxKeys: testCase.maxKeys}
+			return ListObjectsWithOptions(context.Background(), "", testCase.prefix, opts, backend)
+		})
+		if fmt.Sprint(expected) != fmt.Sprint(got) {
+			t.Fatalf("%+v: expected\n%v\ngot\n%v", testCase, expected, got)
+		}
+	}
+}
+
+func TestListOptionsDefaults(t *testing.T) {
+	// Zero MaxKeys lists everything.
+	result, err := ListObjectsWithOptions(context.Background(), "", "a1/", ListOptions{}, fsBackend())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Objects) != 382 || result.IsTruncated {
+		t.Fatalf("expected all 382 objects, got %d", len(result.Objects))
+	}
+
+	// StartAfter applies without a marker only.
+	opts := ListOptions{StartAfter: "a1/z1.txt"}
+	if result, err = ListObjectsWithOptions(context.Background(), "", "a1/", opts, fsBackend()); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Objects) != 1 || result.Objects[0].Name != "a1/z2.txt" {
+		t.Fatalf("expected a1/z2.txt, got %+v", result.Objects)
+	}
+	opts.Marker = "a1/c32.txt"
+	if result, err = ListObjectsWithOptions(context.Background(), "", "a1/", opts, fsBackend()); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Objects) != 2 || result.Objects[0].Name != "a1/z1.txt" {
+		t.Fatalf("expected a1/z1.txt and a1/z2.txt, got %d objects", len(result.Objects))
+	}
+}
+
+func TestListOptionsEncodingType(t *testing.T) {
+	tree := newMemBackend("a b/c+d", "a b/é")
+	backend := ListBackend{
+		Pool:      NewTreeWalkPool(time.Minute),
+		ListDir:   tree.ListDir,
+		IsLeaf:    isLeaf,
+		IsLeafDir: tree.IsLeafDir,
+		Resolver:  memResolver{tree},
+	}
+	result, err := ListObjectsWithOptions(context.Background(), "", "", ListOptions{Delimiter: "/", EncodingType: "url"}, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Prefixes) != 1 || result.Prefixes[0] != "a%20b/" {
+		t.Fatalf("expected prefix a%%20b/, got %v", result.Prefixes)
+	}
+	result, err = ListObjectsWithOptions(context.Background(), "", "a b/", ListOptions{EncodingType: "url"}, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Objects) != 2 || result.Objects[0].Name != "a%20b/c%2Bd" || result.Objects[1].Name != "a%20b/%C3%A9" {
+		t.Fatalf("unexpected objects %+v", result.Objects)
+	}
+
+	if _, err = ListObjectsWithOptions(context.Background(), "", "", ListOptions{EncodingType: "base64"}, backend); err != ErrInvalidEncodingType {
+		t.Fatalf("expected ErrInvalidEncodingType, got %v", err)
+	}
+}
+
+func TestListOptionsDelimiter(t *testing.T) {
+	tree := newMemBackend("a-b/1", "a/b", "a\u00e9b", "ab/c", "c")
+	backend := ListBackend{ListDir: tree.ListDir, IsLeaf: isLeaf, IsLeafDir: tree.IsLeafDir, Resolver: memResolver{tree}}
+	testCases := []struct {
+		opts     ListOptions
+		expected string
+		err      error
+	}{
+		{ListOptions{Delimiter: "/"}, "[a-b/ a/ ab/]", nil},
+		{ListOptions{Delimiter: "-"}, "[a-]", nil},
+		{ListOptions{Delimiter: "\u00e9"}, "[a\u00e9]", nil},
+		{ListOptions{Delimiter: " "}, "", ErrInvalidDelimiter},
+		{ListOptions{Delimiter: " \t"}, "", ErrInvalidDelimiter},
+		{ListOptions{Delimiter: "b/"}, "", ErrInvalidDelimiter},
+		{ListOptions{Delimiter: "b/", MultiCharDelimiter: true}, "[a-b/ ab/]", nil},
+		{ListOptions{Delimiter: " ", MultiCharDelimiter: true}, "", ErrInvalidDelimiter},
+	}
+	for _, testCase := range testCases {
+		result, err := ListObjectsWithOptions(context.Background(), "", "", testCase.opts, backend)
+		if err != testCase.err {
+			t.Fatalf("%q: expected %v, got %v", testCase.opts.Delimiter, testCase.err, err)
+		}
+		if err == nil && fmt.Sprint(result.Prefixes) != testCase.expected {
+			t.Fatalf("%q: expected prefixes %s, got %v", testCase.opts.Delimiter, testCase.expected, result.Prefixes)
+		}
+	}
+}
+
+func TestListOptionsSuffixFilter(t *testing.T) {
+	// The .txt files of testdata, filtered as listed.
+	var expected []string
+	for _, name := range listAllPages(t, nil, "", "", 1000, func() {}) {
+		if strings.HasSuffix(name, "1.txt") {
+			expected = append(expected, name)
+		}
+	}
+	var stats atomic.Int64
+	resolver := funcResolver(func(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+		if !strings.HasSuffix(name, "1.txt") {
+			t.Errorf("%s: unexpected stat", name)
+		}
+		stats.Add(1)
+		return getObjectInfo(ctx, bucket, name, info)
+	})
+	opts := ListOptions{WalkOptions: WalkOptions{SuffixFilter: "1.txt"}}
+	pool := NewTreeWalkPool(time.Minute)
+	names := listNames(t, func(marker string) (ListObjectsInfo, error) {
+		result, err := ListObjectsWithResolver(context.Background(), "", "", marker, "", 100,
+			pool, listDirFactory(), isLeaf, isLeafDir, resolver, opts)
+		if err == nil && result.IsTruncated && len(result.Objects) != 100 {
+			t.Fatalf("%s: expected a full page, got %d objects", marker, len(result.Objects))
+		}
+		return result, err
+	})
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected %d objects, got %d", len(expected), len(names))
+	}
+	if int(stats.Load()) != len(expected) {
+		t.Fatalf("expected %d stats, got %d", len(expected), stats.Load())
+	}
+
+	// Matched regardless of case with CaseInsensitive, the directories
+	// are listed as usual.
+	tree := newMemBackend("a.jpg", "a.txt", "b/c.TXT", "b/d.png", "e.txt")
+	for _, caseInsensitive := range []bool{false, true} {
+		opts := ListOptions{WalkOptions: WalkOptions{SuffixFilter: ".txt"}, CaseInsensitive: caseInsensitive}
+		names := listNames(t, func(marker string) (ListObjectsInfo, error) {
+			return listMem(tree, "", marker, "", 1, nil, opts)
+		})
+		expected := map[bool]string{false: "[a.txt e.txt]", true: "[a.txt b/c.TXT e.txt]"}[caseInsensitive]
+		if fmt.Sprint(names) != expected {
+			t.Fatalf("case insensitive %v: expected %s, got %v", caseInsensitive, expected, names)
+		}
+		result, err := listMem(tree, "", "", "/", 10, nil, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(result.Prefixes) != "[b/]" {
+			t.Fatalf("expected prefix b/, got %v", result.Prefixes)
+		}
+	}
+}
+
+func TestListOptionsFolderPlaceholderNames(t *testing.T) {
+	tree := newMemBackend(".keep", "a", "d/.keep", "e/.keep", "e/f", "g/_$folder$", "g/h/.keep")
+	opts := ListOptions{WalkOptions: WalkOptions{FolderPlaceholderNames: []string{".keep", "_$folder$"}}}
+	testCases := []struct {
+		prefix, delimiter string
+		maxKeys           int
+		expected          string
+	}{
+		// The directories of placeholders alone are still prefixes.
+		{"", "/", 10, "[a] [d/ e/ g/]"},
+		{"d/", "/", 10, "[] []"},
+		{"g/", "/", 10, "[] [g/h/]"},
+		{"", "", 10, "[a e/f] []"},
+		{"", "", 1, "[a] []"},
+		// Not even listed as the exact key.
+		{"d/.keep", "", 1, "[] []"},
+	}
+	for _, testCase := range testCases {
+		result, err := listMem(tree, testCase.prefix, "", testCase.delimiter, testCase.maxKeys, nil, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, obj := range result.Objects {
+			names = append(names, obj.Name)
+		}
+		if s := fmt.Sprint(names, result.Prefixes); s != testCase.expected {
+			t.Errorf("prefix %q delimiter %q: expected %s, got %s", testCase.prefix, testCase.delimiter, testCase.expected, s)
+		}
+	}
+}
+
+func TestListOptionsCaseInsensitive(t *testing.T) {
+	tree := newMemBackend("Photos/a.jpg", "Zebra/z.jpg", "photos/b.jpg", "x.jpg")
+	list := func(delimiter string, maxKeys int, caseInsensitive bool) string {
+		pool := NewTreeWalkPool(time.Minute)
+		names := listNames(t, func(marker string) (ListObjectsInfo, error) {
+			return listMem(tree, "", marker, delimiter, maxKeys, pool, ListOptions{CaseInsensitive: caseInsensitive})
+		})
+		return fmt.Sprint(names)
+	}
+
+	if names := list("/", 100, false); names != "[x.jpg Photos/ Zebra/ photos/]" {
+		t.Fatalf("expected distinct prefixes, got %s", names)
+	}
+	if names := list("/", 100, true); names != "[x.jpg Photos/ Zebra/]" {
+		t.Fatalf("expected folded prefixes, got %s", names)
+	}
+	if names := list("o", 100, true); names != "[Zebra/z.jpg x.jpg Pho]" {
+		t.Fatalf("expected folded prefixes, got %s", names)
+	}
+
+	// Case variants are folded across pages as well.
+	sorted := func(delimiter string, maxKeys int) string {
+		names := strings.Fields(strings.Trim(list(delimiter, maxKeys, true), "[]"))
+		sort.Strings(names)
+		return fmt.Sprint(names)
+	}
+	for _, delimiter := range []string{"/", "o"} {
+		expected := sorted(delimiter, 100)
+		for _, maxKeys := range []int{1, 2} {
+			if names := sorted(delimiter, maxKeys); names != expected {
+				t.Fatalf("delimiter %q maxKeys %d: expected %s, got %s", delimiter, maxKeys, expected, names)
+			}
+		}
+	}
+	tree = newMemBackend("Photos/a.jpg", "photos/b.jpg")
+	if names := list("/", 1, true); names != "[Photos/]" {
+		t.Fatalf("expected folded prefixes, got %s", names)
+	}
+	// Mixed case sibling directories with a delimiter other than "/"
+	// keep the casing listed first.
+	tree = newMemBackend("A1/x", "a1/y", "b")
+	if names := list("1", 100, true); names != "[b A1]" {
+		t.Fatalf("expected a single prefix, got %s", names)
+	}
+	if names := list("1", 1, true); names != "[A1 b]" {
+		t.Fatalf("expected a single prefix, got %s", names)
+	}
+	// Prefixes which sort apart are distinct.
+	tree = newMemBackend("B/1", "a/1", "b/1")
+	if names := list("/", 1, true); names != "[B/ a/]" {
+		t.Fatalf("expected distinct prefixes, got %s", names)
+	}
+}
+
+func TestListObjectsKeyCount(t *testing.T) {
+	testCases := []struct {
+		delimiter string
+		maxKeys   int
+	}{
+		{"/", 10},
+		{"/", 31},
+		{"/", 100},
+		{"", 10},
+		{"1", 5},
+	}
+	for _, testCase := range testCases {
+		opts := ListOptions{Delimiter: testCase.delimiter, MaxKeys: testCase.maxKeys}
+		result, err := ListObjectsWithOptions(context.Background(), "", "a1/", opts, fsBackend())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.KeyCount == 0 || result.KeyCount != len(result.Objects)+len(result.Prefixes) {
+			t.Fatalf("%+v: expected KeyCount %d, got %d", testCase, len(result.Objects)+len(result.Prefixes), result.KeyCount)
+		}
+		if result.IsTruncated && result.KeyCount != testCase.maxKeys {
+			t.Fatalf("%+v: expected KeyCount %d on a truncated page, got %d", testCase, testCase.maxKeys, result.KeyCount)
+		}
+	}
+}
+
+func TestListOptionsMerged(t *testing.T) {
+	backend := fsBackend()
+	var entries []string
+	var marker string
+	for {
+		opts := ListOptions{Delimiter: "/", Marker: marker, MaxKeys: 7, Merged: true}
+		result, err := ListObjectsWithOptions(context.Background(), "", "a1/", opts, backend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Entries) != result.KeyCount {
+			t.Fatalf("expected %d entries, got %d", result.KeyCount, len(result.Entries))
+		}
+		for _, entry := range result.Entries {
+			if entry.IsPrefix != (entry.Info == nil) || entry.Info != nil && entry.Info.Name != entry.Name {
+				t.Fatalf("%s: inconsistent entry %+v", entry.Name, entry)
+			}
+			entries = append(entries, entry.Name)
+		}
+		if !result.IsTruncated {
+			break
+		}
+		if result.NextMarker != entries[len(entries)-1] {
+			t.Fatalf("expected NextMarker %s, got %s", entries[len(entries)-1], result.NextMarker)
+		}
+		marker = result.NextMarker
+	}
+
+	// S3 lists the objects and the prefixes in the order of their names.
+	expected, err := ListObjectsWithOptions(context.Background(), "", "a1/", ListOptions{Delimiter: "/"}, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := append([]string(nil), expected.Prefixes...)
+	for _, obj := range expected.Objects {
+		names = append(names, obj.Name)
+	}
+	sort.Strings(names)
+	if fmt.Sprint(entries) != fmt.Sprint(names) {
+		t.Fatalf("expected\n%v\ngot\n%v", names, entries)
+	}
+	if len(entries) != 31 || entries[0] != "a1/a1.txt" || entries[1] != "a1/a1/" {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+}
+
+func TestListOptionsAccept(t *testing.T) {
+	tree := newMemBackend("a", "bbbbbbbbbb", "c", "dddddddddd", "eeeeeeeeee", "f", "g")
+	for _, delimiter := range []string{"", "/", "-"} {
+		opts := ListOptions{Accept: func(info *ObjectInfo) bool {
+			return info.Size <= 3
+		}}
+		pool := NewTreeWalkPool(time.Minute)
+		var pages []string
+		var marker string
+		for {
+			result, err := listMem(tree, "", marker, delimiter, 2, pool, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, obj := range result.Objects {
+				names = append(names, obj.Name)
+			}
+			pages = append(pages, strings.Join(names, ","))
+			if !result.IsTruncated {
+				break
+			}
+			marker = result.NextMarker
+		}
+		// Pages fill with the accepted objects.
+		if strings.Join(pages, " ") != "a,c f,g" {
+			t.Fatalf("%q: unexpected pages %q", delimiter, pages)
+		}
+	}
+}
+
+// taggingResolver - resolves the objects of a MemBackend with their tags.
+type taggingResolver struct {
+	memResolver
+	tags map[string]map[string]string
+}
+
+func (r taggingResolver) ResolveObject(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	objInfo, err := r.memResolver.ResolveObject(ctx, bucket, name, info)
+	objInfo.UserDefined = r.tags[name]
+	return objInfo, err
+}
+
+func TestListOptionsTagMatch(t *testing.T) {
+	tree := newMemBackend("a", "b", "c", "d/1", "d/2", "e", "f")
+	resolver := taggingResolver{memResolver: memResolver{tree}, tags: map[string]map[string]string{
+		"a":   {"team": "x", "env": "prod"},
+		"b":   {"team": "y", "env": "prod"},
+		"c":   {"team": "x"},
+		"d/2": {"team": "x", "env": "prod", "tier": "1"},
+		"f":   {"env": "prod", "team": "x"},
+	}}
+	opts := ListOptions{TagMatch: map[string]string{"team": "x", "env": "prod"}}
+	for _, maxKeys := range []int{1, 2, 100} {
+		pool := NewTreeWalkPool(time.Minute)
+		names := listNames(t, func(marker string) (ListObjectsInfo, error) {
+			result, err := ListObjectsWithResolver(context.Background(), "", "", marker, "", maxKeys,
+				pool, tree.ListDir, isLeaf, tree.IsLeafDir, resolver, opts)
+			// Pages fill with the matching objects.
+			if err == nil && result.IsTruncated && len(result.Objects) != maxKeys {
+				t.Fatalf("maxKeys %d: expected a full page, got %+v", maxKeys, result.Objects)
+			}
+			return result, err
+		})
+		if strings.Join(names, ",") != "a,d/2,f" {
+			t.Fatalf("maxKeys %d: expected the matching objects, got %v", maxKeys, names)
+		}
+	}
+}
+
+// countingResolver - resolves the objects of a MemBackend, recording them.
+type countingResolver struct {
+	memResolver
+	mu       sync.Mutex
+	resolved map[string]bool
+}
+
+func (r *countingResolver) ResolveObject(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	r.mu.Lock()
+	r.resolved[name] = true
+	r.mu.Unlock()
+	return r.memResolver.ResolveObject(ctx, bucket, name, info)
+}
+
+func TestListOptionsExistsHint(t *testing.T) {
+	tree := wideMemBackend(4, 10)
+	exists := func(name string) bool {
+		// Half of the files, f000, f002...
+		return (name[len(name)-1]-'0')%2 == 0
+	}
+	resolver := &countingResolver{memResolver: memResolver{tree}, resolved: make(map[string]bool)}
+	backend := ListBackend{
+		Pool:      NewTreeWalkPool(time.Minute),
+		ListDir:   tree.ListDir,
+		IsLeaf:    isLeaf,
+		IsLeafDir: tree.IsLeafDir,
+		Resolver:  resolver,
+	}
+	names := listNames(t, func(marker string) (ListObjectsInfo, error) {
+		result, err := ListObjectsWithOptions(context.Background(), "", "", ListOptions{Marker: marker, MaxKeys: 7, ExistsHint: exists}, backend)
+		if err == nil && result.IsTruncated && len(result.Objects) != 7 {
+			t.Fatalf("%s: expected a full page, got %d objects", marker, len(result.Objects))
+		}
+		return result, err
+	})
+	if len(names) != 20 {
+		t.Fatalf("expected 20 objects, got %d", len(names))
+	}
+	for _, name := range names {
+		if !exists(name) {
+			t.Fatalf("%s: unexpected object", name)
+		}
+	}
+	for name := range resolver.resolved {
+		if !exists(name) {
+			t.Fatalf("%s: resolved despite the hint", name)
+		}
+	}
+}
+
+func TestListOptionsFirstByteDeadline(t *testing.T) {
+	tree := wideMemBackend(20, 5)
+	slow := slowListDir(tree, 20*time.Millisecond)
+	var listings atomic.Int64
+	listDir := func(bucket, prefixDir, prefixEntry string) (bool, []*Entry, bool) {
+		listings.Add(1)
+		return slow(bucket, prefixDir, prefixEntry)
+	}
+	backend := ListBackend{
+		Pool:      NewTreeWalkPool(time.Minute),
+		ListDir:   listDir,
+		IsLeaf:    tree.IsLeaf,
+		IsLeafDir: tree.IsLeafDir,
+		Resolver:  memResolver{tree},
+	}
+
+	opts := ListOptions{MaxKeys: 100, FirstByteDeadline: 50 * time.Millisecond}
+	start := time.Now()
+	result, err := ListObjectsWithOptions(context.Background(), "", "", opts, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The whole page takes 21 listings of 20ms.
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Fatalf("expected an early page, took %v", elapsed)
+	}
+	if len(result.Objects) == 0 || len(result.Objects) >= 100 || !result.IsTruncated {
+		t.Fatalf("expected a partial page, got %d objects, truncated %v", len(result.Objects), result.IsTruncated)
+	}
+	if result.NextMarker != result.Objects[len(result.Objects)-1].Name {
+		t.Fatalf("unexpected next marker %s", result.NextMarker)
+	}
+	names := make([]string, 0, 100)
+	for _, obj := range result.Objects {
+		names = append(names, obj.Name)
+	}
+
+	// The next pages resume the walk saved in the pool.
+	listed := len(names)
+	names = append(names, listNames(t, func(marker string) (ListObjectsInfo, error) {
+		if marker == "" {
+			marker = result.NextMarker
+		}
+		return ListObjectsWithOptions(context.Background(), "", "", ListOptions{Marker: marker, MaxKeys: 100}, backend)
+	})...)
+	if len(names) != 100 {
+		t.Fatalf("expected 100 objects, got %d after %d", len(names), listed)
+	}
+	for i, name := range names {
+		if expected := fmt.Sprintf("d%03d/f%03d", i/5, i%5); name != expected {
+			t.Fatalf("%d: expected %s, got %s", i, expected, name)
+		}
+	}
+	// The root and the 20 directories are listed once.
+	if n := listings.Load(); n != 21 {
+		t.Fatalf("expected 21 listings, got %d", n)
+	}
+}
+
+// peakResolver - resolves the objects of a MemBackend, recording the peak
+// number of concurrent resolutions.
+type peakResolver struct {
+	memResolver
+	mu            sync.Mutex
+	running, peak int
+}
+
+func (r *peakResolver) ResolveObject(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	r.mu.Lock()
+	r.running++
+	r.peak = max(r.peak, r.running)
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.running--
+		r.mu.Unlock()
+	}()
+	time.Sleep(time.Millisecond)
+	return r.memResolver.ResolveObject(ctx, bucket, name, info)
+}
+
+func TestListDefaults(t *testing.T) {
+	tree := wideMemBackend(100, DefaultMaxObjectList/100+1)
+	var listings atomic.Int64
+	listDir := func(bucket, prefixDir, prefixEntry string) (bool, []*Entry, bool) {
+		listings.Add(1)
+		return tree.ListDir(bucket, prefixDir, prefixEntry)
+	}
+	backend := ListBackend{
+		Pool:      NewTreeWalkPool(0),
+		ListDir:   listDir,
+		IsLeaf:    tree.IsLeaf,
+		IsLeafDir: tree.IsLeafDir,
+		Resolver:  memResolver{tree},
+	}
+	result, err := ListObjectsWithOptions(context.Background(), "", "", ListOptions{}, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Objects) != DefaultMaxObjectList || !result.IsTruncated {
+		t.Fatalf("expected %d objects, got %d", DefaultMaxObjectList, len(result.Objects))
+	}
+	// The walk is kept in the pool for DefaultTreeWalkTimeout.
+	result, err = ListObjectsWithOptions(context.Background(), "", "", ListOptions{Marker: result.NextMarker}, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Objects) != len(tree.Keys())-DefaultMaxObjectList || result.IsTruncated {
+		t.Fatalf("expected the remaining objects, got %d", len(result.Objects))
+	}
+	if n := listings.Load(); n != 101 {
+		t.Fatalf("expected 101 listings, got %d", n)
+	}
+
+	// Objects are resolved DefaultListConcurrency at a time.
+	for _, concurrency := range []int{0, 3} {
+		resolver := &peakResolver{memResolver: memResolver{tree}}
+		backend.Resolver = resolver
+		_, err = ListObjectsWithOptions(context.Background(), "", "", ListOptions{MaxKeys: 100, Concurrency: concurrency}, backend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := concurrency
+		if concurrency == 0 {
+			expected = DefaultListConcurrency
+		}
+		if resolver.peak != expected {
+			t.Fatalf("concurrency %d: expected %d concurrent resolutions, got %d", concurrency, expected, resolver.peak)
+		}
+	}
+}
+
+func TestListOptionsAlias(t *testing.T) {
+	tree := newMemBackend("a1/x", "a1/y/z", "alias/w", "b/1")
+	opts := ListOptions{Alias: PrefixAlias{External: "alias/", Internal: "a1/"}}
+	list := func(prefix, delimiter string, maxKeys int) string {
+		pool := NewTreeWalkPool(time.Minute)
+		names := listNames(t, func(marker string) (ListObjectsInfo, error) {
+			return listMem(tree, prefix, marker, delimiter, maxKeys, pool, opts)
+		})
+		return fmt.Sprint(names)
+	}
+
+	for _, maxKeys := range []int{1, 100} {
+		if names := list("alias/", "/", maxKeys); names != "[alias/x alias/y/]" {
+			t.Fatalf("maxKeys %d: expected the keys of a1/ under alias/, got %s", maxKeys, names)
+		}
+		if names := list("alias/", "", maxKeys); names != "[alias/x alias/y/z]" {
+			t.Fatalf("maxKeys %d: expected the keys of a1/ under alias/, got %s", maxKeys, names)
+		}
+	}
+	if names := list("alias/y", "", 100); names != "[alias/y/z]" {
+		t.Fatalf("expected the keys of a1/y under alias/y, got %s", names)
+	}
+
+	// Markers are named under the alias too.
+	result, err := listMem(tree, "alias/", "alias/x", "", 100, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Objects) != 1 || result.Objects[0].Name != "alias/y/z" {
+		t.Fatalf("expected alias/y/z, got %+v", result.Objects)
+	}
+	result, err = listMem(tree, "alias/", "b", "", 100, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Objects) != 0 || result.IsTruncated {
+		t.Fatalf("expected nothing past the alias, got %+v", result)
+	}
+
+	// Other prefixes are listed as they are.
+	if names := list("b/", "", 100); names != "[b/1]" {
+		t.Fatalf("expected b/1, got %s", names)
+	}
+}
+
+func TestListObjectsTruncatedKinds(t *testing.T) {
+	testCases := []struct {
+		keys      []string
+		delimiter string
+		marker    string
+		maxKeys   int
+		objects   bool
+		prefixes  bool
+	}{
+		{[]string{"a", "b/1", "c/1", "d", "e/1"}, "/", "", 1, true, true},
+		{[]string{"a", "b/1", "c/1", "d", "e/1"}, "/", "", 3, true, true},
+		// Only prefixes follow.
+		{[]string{"a", "b/1", "c/1", "d", "e/1"}, "/", "c/", 1, false, true},
+		{[]string{"a", "b/1", "c/1", "d", "e/1"}, "/", "b/", 2, false, true},
+		{[]string{"a", "b/1", "c/1"}, "/", "", 2, false, true},
+		// Only objects follow.
+		{[]string{"a/1", "b", "c"}, "/", "", 1, true, false},
+		{[]string{"a/1", "b", "c"}, "", "", 1, true, false},
+		{[]string{"a", "b/1", "c/1", "d", "e/1"}, "/", "", 100, false, false},
+	}
+	for _, testCase := range testCases {
+		result, err := listMem(newMemBackend(testCase.keys...), "", testCase.marker, testCase.delimiter, testCase.maxKeys, nil, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.ObjectsTruncated != testCase.objects || result.PrefixesTruncated != testCase.prefixes {
+			t.Fatalf("%+v: got objects %v prefixes %v", testCase, result.ObjectsTruncated, result.PrefixesTruncated)
+		}
+	}
+}
+
+// latencyResolver - a peakResolver of a variable latency.
+type latencyResolver struct {
+	peakResolver
+	latency atomic.Int64
+}
+
+func (r *latencyResolver) ResolveObject(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	time.Sleep(time.Duration(r.latency.Load()))
+	return r.peakResolver.ResolveObject(ctx, bucket, name, info)
+}
+
+func TestListOptionsAdaptiveConcurrency(t *testing.T) {
+	tree := wideMemBackend(10, 100)
+	resolver := &latencyResolver{peakResolver: peakResolver{memResolver: memResolver{tree}}}
+	adaptive := &AdaptiveConcurrency{Min: 2, Max: 8, Target: 20 * time.Millisecond}
+	opts := ListOptions{AdaptiveConcurrency: adaptive}
+	pool := NewTreeWalkPool(time.Minute)
+	var marker string
+	page := func() int {
+		t.Helper()
+		resolver.mu.Lock()
+		resolver.peak = 0
+		resolver.mu.Unlock()
+		result, err := ListObjectsWithResolver(context.Background(), "", "", marker, "", 16,
+			pool, tree.ListDir, isLeaf, tree.IsLeafDir, resolver, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		marker = result.NextMarker
+		return resolver.peak
+	}
+
+	// Starts from Min.
+	if peak := page(); peak != 2 {
+		t.Fatalf("expected 2 concurrent resolutions, got %d", peak)
+	}
+	// Goes up to Max while the latency is low.
+	for i := 0; i < 10; i++ {
+		page()
+	}
+	if peak := page(); peak != 8 || adaptive.Concurrency() != 8 {
+		t.Fatalf("expected 8 concurrent resolutions, got %d", peak)
+	}
+	// Backs off to Min once it is high.
+	resolver.latency.Store(int64(30 * time.Millisecond))
+	page()
+	if concurrency := adaptive.Concurrency(); concurrency != 4 {
+		t.Fatalf("expected the concurrency to halve, got %d", concurrency)
+	}
+	page()
+	if peak := page(); peak != 2 {
+		t.Fatalf("expected 2 concurrent resolutions, got %d", peak)
+	}
+}
+
+func TestSetGlobalStatConcurrency(t *testing.T) {
+	SetGlobalStatConcurrency(5)
+	defer SetGlobalStatConcurrency(0)
+
+	// Concurrent listings resolving 10 objects at a time each share the
+	// resolutions between them.
+	tree := wideMemBackend(10, 20)
+	resolver := &peakResolver{memResolver: memResolver{tree}}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := ListObjectsWithResolver(context.Background(), "", "", "", "", 50,
+				nil, tree.ListDir, isLeaf, tree.IsLeafDir, resolver, ListOptions{})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if resolver.peak > 5 {
+		t.Fatalf("expected at most 5 concurrent resolutions, got %d", resolver.peak)
+	}
+	if resolver.peak < 2 {
+		t.Fatalf("expected concurrent resolutions, got %d", resolver.peak)
+	}
+}
+
+// dirlessResolver - resolves the objects of a MemBackend like a backend
+// without directory objects.
+type dirlessResolver struct {
+	memResolver
+}
+
+func (r dirlessResolver) ResolveDir(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	return ObjectInfo{}, os.ErrNotExist
+}
+
+func TestListOptionsSynthesizeDirStat(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tree := newMemBackend("a/1", "a/2", "b/c/3", "d", "x1y", "x1z")
+	listDir := func(bucket, prefixDir, prefixEntry string) (bool, []*Entry, bool) {
+		emptyDir, entries, delayIsLeaf := tree.ListDir(bucket, prefixDir, prefixEntry)
+		for _, entry := range entries {
+			entry.Info.ModTime = modTime
+		}
+		return emptyDir, entries, delayIsLeaf
+	}
+	backend := ListBackend{
+		Pool:      NewTreeWalkPool(time.Minute),
+		ListDir:   listDir,
+		IsLeaf:    isLeaf,
+		IsLeafDir: tree.IsLeafDir,
+		Resolver:  dirlessResolver{memResolver{tree}},
+	}
+
+	result, err := ListObjectsWithOptions(context.Background(), "", "", ListOptions{Delimiter: "/"}, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(result.Prefixes, ",") != "a/,b/" || result.PrefixInfos != nil {
+		t.Fatalf("expected the prefixes alone, got %+v", result)
+	}
+
+	for _, delimiter := range []string{"/", "1"} {
+		for _, maxKeys := range []int{1, 100} {
+			var marker string
+			var prefixes []string
+			for {
+				opts := ListOptions{Delimiter: delimiter, Marker: marker, MaxKeys: maxKeys, SynthesizeDirStat: true, Merged: true}
+				result, err := ListObjectsWithOptions(context.Background(), "", "", opts, backend)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(result.PrefixInfos) != len(result.Prefixes) {
+					t.Fatalf("expected the stats of %v, got %+v", result.Prefixes, result.PrefixInfos)
+				}
+				for i, info := range result.PrefixInfos {
+					if info.Name != result.Prefixes[i] || !info.IsDir || !info.ModTime.Equal(modTime) {
+						t.Fatalf("%s: expected a synthesized stat, got %+v", result.Prefixes[i], info)
+					}
+				}
+				for _, entry := range result.Entries {
+					if entry.IsPrefix && (entry.Info == nil || entry.Info.Name != entry.Name) {
+						t.Fatalf("%s: expected the stat of the prefix, got %+v", entry.Name, entry)
+					}
+				}
+				prefixes = append(prefixes, result.Prefixes...)
+				if !result.IsTruncated {
+					break
+				}
+				marker = result.NextMarker
+			}
+			if len(prefixes) == 0 {
+				t.Fatalf("delimiter %q: expected prefixes", delimiter)
+			}
+		}
+	}
+}
+
+func TestListOptionsStream(t *testing.T) {
+	// 60000 objects and 200 prefixes, more than a page holds.
+	var keys []string
+	for i := 0; i < 60000; i++ {
+		keys = append(keys, fmt.Sprintf("k%05d", i))
+	}
+	for i := 0; i < 200; i++ {
+		keys = append(keys, fmt.Sprintf("p%03d-x", i), fmt.Sprintf("p%03d-y", i))
+	}
+	tree := newMemBackend(keys...)
+	backend := ListBackend{
+		ListDir:   tree.ListDir,
+		IsLeaf:    isLeaf,
+		IsLeafDir: tree.IsLeafDir,
+		Resolver:  memResolver{tree},
+	}
+
+	for _, testCase := range []struct {
+		delimiter string
+		last      int // Keys of the last page.
+	}{
+		{"-", 60000 - 101 - DefaultMaxObjectList + 200},
+		{"/", 60000 - 101 - DefaultMaxObjectList + 400},
+	} {
+		delimiter := testCase.delimiter
+		var streamed []string
+		opts := ListOptions{Delimiter: delimiter, Marker: "k00100", MaxKeys: 1 << 30, EncodingType: "url",
+			Stream: func(entry ListEntry) error {
+				if entry.IsPrefix != (entry.Info == nil) || entry.Info != nil && entry.Info.Name != entry.Name {
+					return fmt.Errorf("%s: inconsistent entry %+v", entry.Name, entry)
+				}
+				streamed = append(streamed, entry.Name)
+				return nil
+			}}
+		result, err := ListObjectsWithOptions(context.Background(), "", "", opts, backend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The page is clamped to DefaultMaxObjectList keys, none held.
+		if len(streamed) != DefaultMaxObjectList || result.KeyCount != len(streamed) {
+			t.Fatalf("%q: expected %d keys, got %d, KeyCount %d", delimiter, DefaultMaxObjectList, len(streamed), result.KeyCount)
+		}
+		if result.Objects != nil || result.Prefixes != nil || result.Entries != nil {
+			t.Fatalf("%q: expected the keys to be streamed alone", delimiter)
+		}
+		if !sort.StringsAreSorted(streamed) || streamed[0] != "k00101" {
+			t.Fatalf("%q: expected the keys in order after the marker, got %v...", delimiter, streamed[:3])
+		}
+		if !result.IsTruncated || result.NextMarker != streamed[len(streamed)-1] {
+			t.Fatalf("%q: expected a truncated page resuming after %s, got %+v", delimiter, streamed[len(streamed)-1], result)
+		}
+
+		// The next page streams the rest, the prefixes as well.
+		streamed = nil
+		opts.Marker = result.NextMarker
+		if result, err = ListObjectsWithOptions(context.Background(), "", "", opts, backend); err != nil {
+			t.Fatal(err)
+		}
+		if result.IsTruncated || len(streamed) != testCase.last {
+			t.Fatalf("%q: expected a last page of %d keys, got %d", delimiter, testCase.last, len(streamed))
+		}
+	}
+
+	// Errors end the listing.
+	errStream := errors.New("stream")
+	opts := ListOptions{Delimiter: "-", Stream: func(entry ListEntry) error { return errStream }}
+	if _, err := ListObjectsWithOptions(context.Background(), "", "", opts, backend); !errors.Is(err, errStream) {
+		t.Fatalf("expected errStream, got %v", err)
+	}
+}
+
+func TestListOptionsStripDelimiterFromPrefixes(t *testing.T) {
+	tree := newMemBackend("a-b", "a/1", "b", "c/d", "c/e")
+	backend := ListBackend{
+		ListDir:   tree.ListDir,
+		IsLeaf:    isLeaf,
+		IsLeafDir: tree.IsLeafDir,
+		Resolver:  memResolver{tree},
+	}
+
+	for _, testCase := range []struct {
+		delimiter string
+		strip     bool
+		prefixes  string
+		entries   string
+	}{
+		// S3 keeps the delimiter by default.
+		{"/", false, "[a/ c/]", "[a-b a/ b c/]"},
+		{"/", true, "[a c]", "[a-b a b c]"},
+		{"-", false, "[a-]", "[a- a/1 b c/d c/e]"},
+		{"-", true, "[a]", "[a a/1 b c/d c/e]"},
+	} {
+		opts := ListOptions{Delimiter: testCase.delimiter, Merged: true, StripDelimiterFromPrefixes: testCase.strip}
+		result, err := ListObjectsWithOptions(context.Background(), "", "", opts, backend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(result.Prefixes) != testCase.prefixes {
+			t.Fatalf("%q, strip %v: expected prefixes %s, got %v", testCase.delimiter, testCase.strip, testCase.prefixes, result.Prefixes)
+		}
+		var entries []string
+		for _, entry := range result.Entries {
+			entries = append(entries, entry.Name)
+		}
+		// The prefixes keep their order with the delimiter.
+		if fmt.Sprint(entries) != testCase.entries {
+			t.Fatalf("%q, strip %v: expected entries %s, got %v", testCase.delimiter, testCase.strip, testCase.entries, entries)
+		}
+
+		var streamed []string
+		opts = ListOptions{Delimiter: testCase.delimiter, StripDelimiterFromPrefixes: testCase.strip,
+			Stream: func(entry ListEntry) error {
+				streamed = append(streamed, entry.Name)
+				return nil
+			}}
+		if _, err = ListObjectsWithOptions(context.Background(), "", "", opts, backend); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(streamed) != testCase.entries {
+			t.Fatalf("%q, strip %v: expected streamed %s, got %v", testCase.delimiter, testCase.strip, testCase.entries, streamed)
+		}
+	}
+
+	// The NextMarker keeps the delimiter to resume the listing with.
+	opts := ListOptions{Delimiter: "/", MaxKeys: 2, StripDelimiterFromPrefixes: true}
+	result, err := ListObjectsWithOptions(context.Background(), "", "", opts, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(result.Prefixes) != "[a]" || result.NextMarker != "a/" {
+		t.Fatalf("expected prefixes [a] and NextMarker a/, got %v and %s", result.Prefixes, result.NextMarker)
+	}
+}
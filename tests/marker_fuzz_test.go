@@ -0,0 +1,201 @@
+package tests
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/zhaohuxing/s3/cmd"
+)
+
+// fuzzKeys - keys of the in-memory backend listed by FuzzMarkerSplit, with
+// files and directories sharing names and an empty directory.
+var fuzzKeys = []string{
+	"a", "a.b", "a/b", "a/b/c", "a/bc", "a/c/", "ab/c", "b/", "b0", "c/d/e/f", "c/d/g", "c/d.e",
+}
+
+// fuzzPath - maps arbitrary fuzz input onto the alphabet of fuzzKeys,
+// so most of the inputs land on the interesting boundaries.
+func fuzzPath(s string) string {
+	const alphabet = "abcdefg/."
+	var sb strings.Builder
+	for i := 0; i < len(s) && i < 12; i++ {
+		if strings.IndexByte(alphabet, s[i]) >= 0 {
+			sb.WriteByte(s[i])
+			continue
+		}
+		sb.WriteByte(alphabet[int(s[i])%len(alphabet)])
+	}
+	return sb.String()
+}
+
+// expectedListing - lists fuzzKeys the way S3 does, names after marker
+// under prefix, grouped into common prefixes by delimiter.
+func expectedListing(prefix, marker, delimiter string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	if marker != "" && !strings.HasPrefix(marker, prefix) {
+		// Marker not common with prefix is not implemented.
+		return nil
+	}
+	for _, key := range fuzzKeys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if key == prefix && strings.HasSuffix(key, "/") {
+			// The walk lists the entries of the directory named by the
+			// prefix, not the directory itself.
+			continue
+		}
+		name := key
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				name = key[:len(prefix)+i+len(delimiter)]
+				if name == prefix {
+					continue
+				}
+			}
+		}
+		if name <= marker || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// delayedLeafListDir - lists the directories of tree without their
+// trailing slash, unless a file has the same name, leaving telling them
+// apart to the walk.
+func delayedLeafListDir(tree *MemBackend) ListDirFunc {
+	return func(bucket, prefixDir, prefixEntry string) (bool, []*Entry, bool) {
+		emptyDir, entries, _ := tree.ListDir(bucket, prefixDir, prefixEntry)
+		listed := make(map[string]bool)
+		for _, entry := range entries {
+			listed[entry.Name] = true
+		}
+		for _, entry := range entries {
+			if name := strings.TrimSuffix(entry.Name, "/"); !listed[name] {
+				entry.Name = name
+			}
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Name < entries[j].Name
+		})
+		return emptyDir, entries, true
+	}
+}
+
+// FuzzMarkerSplit - lists the in-memory backend from random prefixes and
+// markers, asserting that the pages are sorted, that no key is listed
+// twice or skipped. The delayed inputs list the directories without
+// their trailing slash. Failing inputs are written to testdata/fuzz, move
+// them to the seeds below since testdata is the tree of the FS tests.
+func FuzzMarkerSplit(f *testing.F) {
+	// Seed corpus from the prefixes and markers of the listing tests,
+	// already in the alphabet of fuzzPath.
+	seeds := []struct {
+		prefix, marker string
+		delimited      bool
+		maxKeys        uint8
+	}{
+		{"", "", false, 100},
+		{"a", "", false, 1},
+		{"a/", "", true, 2},
+		{"a/", "a/b", false, 1},
+		{"a/", "a/b/", true, 3},
+		{"a/b", "a/b", false, 2},
+		{"c/d/", "c/d/e/f", false, 1},
+		{"c/", "c/d.e", true, 1},
+		{"/", "", true, 5},
+		{"b", "a", false, 2},
+		{"a//", "", false, 3},
+		{"b/", "", false, 1},
+	}
+	for _, seed := range seeds {
+		for _, delayed := range []bool{false, true} {
+			f.Add(seed.prefix, seed.marker, seed.delimited, seed.maxKeys, delayed)
+		}
+	}
+
+	tree := newMemBackend(fuzzKeys...)
+	delayedListDir := delayedLeafListDir(tree)
+	// The trimmed directories are no keys.
+	delayedIsLeaf := func(bucket, name string) bool {
+		i := sort.SearchStrings(tree.Keys(), name)
+		return !strings.HasSuffix(name, "/") && i < len(tree.Keys()) && tree.Keys()[i] == name
+	}
+	f.Fuzz(func(t *testing.T, prefix, marker string, delimited bool, maxKeys uint8, delayed bool) {
+		prefix, marker = fuzzPath(prefix), fuzzPath(marker)
+		delimiter := ""
+		if delimited {
+			delimiter = "/"
+		}
+		if maxKeys == 0 {
+			maxKeys = 1
+		}
+		if delimiter == "/" && prefix == "/" {
+			// Nothing is listed at all on a flat namespace.
+			return
+		}
+
+		expected := expectedListing(prefix, marker, delimiter)
+		pool := NewTreeWalkPool(time.Minute)
+		var names []string
+		seen := make(map[string]bool)
+		nextMarker := marker
+		for pages := 0; ; pages++ {
+			if pages > len(fuzzKeys) {
+				t.Fatalf("prefix %q marker %q: listing does not end, got %v", prefix, marker, names)
+			}
+			var result ListObjectsInfo
+			var err error
+			opts := ListOptions{Merged: true}
+			if delayed {
+				result, err = ListObjectsWithResolver(context.Background(), "", prefix, nextMarker, delimiter, int(maxKeys),
+					pool, delayedListDir, delayedIsLeaf, tree.IsLeafDir, memResolver{tree}, opts)
+			} else {
+				result, err = listMem(tree, prefix, nextMarker, delimiter, int(maxKeys), pool, opts)
+			}
+			if err != nil {
+				t.Fatalf("prefix %q marker %q: %v", prefix, marker, err)
+			}
+			// The objects and the prefixes are merged as returned, the
+			// entries are out of order unless both of them are sorted.
+			var page []string
+			for _, entry := range result.Entries {
+				page = append(page, entry.Name)
+			}
+			if !sort.StringsAreSorted(page) {
+				t.Fatalf("prefix %q marker %q: page not sorted %v", prefix, marker, page)
+			}
+			for _, name := range page {
+				if seen[name] {
+					t.Fatalf("prefix %q marker %q: %s listed twice", prefix, marker, name)
+				}
+				seen[name] = true
+			}
+			names = append(names, page...)
+			if !result.IsTruncated {
+				break
+			}
+			if result.NextMarker <= nextMarker {
+				t.Fatalf("prefix %q marker %q: NextMarker %q does not advance past %q", prefix, marker, result.NextMarker, nextMarker)
+			}
+			checkNextMarker(t, expected, nextMarker, page, result.NextMarker)
+			nextMarker = result.NextMarker
+		}
+
+		if !sort.StringsAreSorted(names) {
+			t.Fatalf("prefix %q marker %q: not sorted %v", prefix, marker, names)
+		}
+		if strings.Join(names, ",") != strings.Join(expected, ",") {
+			t.Fatalf("prefix %q marker %q delimiter %q maxKeys %d delayed %v: expected\n%v\ngot\n%v",
+				prefix, marker, delimiter, maxKeys, delayed, expected, names)
+		}
+	})
+}
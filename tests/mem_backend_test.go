@@ -0,0 +1,166 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	. "github.com/zhaohuxing/s3/cmd"
+)
+
+// newMemBackend - MemBackend of the keys, sized by the length of their
+// names. Keys ending with a slash are empty directories.
+func newMemBackend(keys ...string) *MemBackend {
+	objects := make([]ObjectInfo, 0, len(keys))
+	for _, key := range keys {
+		objects = append(objects, ObjectInfo{Name: key, Size: int64(len(key))})
+	}
+	return NewMemBackend(objects...)
+}
+
+// wideMemBackend - dirs directories of files objects each.
+func wideMemBackend(dirs, files int) *MemBackend {
+	var keys []string
+	for i := 0; i < dirs; i++ {
+		for j := 0; j < files; j++ {
+			keys = append(keys, fmt.Sprintf("d%03d/f%03d", i, j))
+		}
+	}
+	return newMemBackend(keys...)
+}
+
+// listMem - lists the objects of b like ListObjectsWithResolver.
+func listMem(b *MemBackend, prefix, marker, delimiter string, maxKeys int, tpool *TreeWalkPool, opts ListOptions) (ListObjectsInfo, error) {
+	return ListObjectsWithResolver(context.Background(), "", prefix, marker, delimiter, maxKeys,
+		tpool, b.ListDir, b.IsLeaf, b.IsLeafDir, memResolver{b}, opts)
+}
+
+// slowListDir - ListDirFunc of b spending delay in every call, to
+// simulate a remote backend.
+func slowListDir(b *MemBackend, delay time.Duration) ListDirFunc {
+	return func(bucket, prefixDir, prefixEntry string) (bool, []*Entry, bool) {
+		time.Sleep(delay)
+		return b.ListDir(bucket, prefixDir, prefixEntry)
+	}
+}
+
+// filteredListDir - ListDirFunc of b filtering the entries it lists
+// with filter, like the backends of versioned buckets.
+func filteredListDir(b *MemBackend, filter FilterOptions) ListDirFunc {
+	return func(bucket, prefixDir, prefixEntry string) (bool, []*Entry, bool) {
+		emptyDir, entries, _ := b.ListDir(bucket, prefixDir, "")
+		if emptyDir {
+			return true, nil, false
+		}
+		entries, delayIsLeaf := FilterListEntriesWithOptions(bucket, prefixDir, entries, prefixEntry, b.IsLeaf, filter)
+		return false, entries, delayIsLeaf
+	}
+}
+
+// memResolver - InfoResolver of a MemBackend.
+type memResolver struct {
+	b *MemBackend
+}
+
+func (r memResolver) ResolveObject(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	return r.b.GetObjectInfo(ctx, bucket, name, info)
+}
+
+func (r memResolver) ResolveDir(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	return r.b.GetObjectInfo(ctx, bucket, name, info)
+}
+
+// testdataMemBackend - MemBackend holding the files of testdata.
+func testdataMemBackend(t *testing.T) *MemBackend {
+	t.Helper()
+	var objects []ObjectInfo
+	err := filepath.WalkDir(testdir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(testdir, path)
+		objects = append(objects, ObjectInfo{Name: filepath.ToSlash(name), Size: 1})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewMemBackend(objects...)
+}
+
+func TestMemBackend(t *testing.T) {
+	backend := testdataMemBackend(t)
+	if errs := VerifyBackend(context.Background(), "", backend.ListDir, backend.IsLeaf, backend.IsLeafDir); len(errs) != 0 {
+		t.Fatalf("expected a conforming backend, got %v", errs)
+	}
+
+	// The cases of TestLsCase1 to TestLsCase3, against the testdata.
+	testCases := []struct {
+		prefix, delimiter string
+	}{
+		{"", ""},
+		{"a", ""},
+		{"a1/", ""},
+		{"a1/c", ""},
+		{"a", "/"},
+	}
+	for _, testCase := range testCases {
+		for _, maxKeys := range []int{7, 100} {
+			expected := listAllPages(t, NewTreeWalkPool(time.Minute), testCase.prefix, testCase.delimiter, maxKeys, func() {})
+			mem := backend.ListBackend(NewTreeWalkPool(time.Minute))
+			got := listNames(t, func(marker string) (ListObjectsInfo, error) {
+				return ListObjectsWithOptions(context.Background(), "bucket", testCase.prefix,
+					ListOptions{Marker: marker, Delimiter: testCase.delimiter, MaxKeys: maxKeys}, mem)
+			})
+			if !reflect.DeepEqual(got, expected) {
+				t.Fatalf("%q %q %d: expected %d names, got %d", testCase.prefix, testCase.delimiter, maxKeys, len(expected), len(got))
+			}
+		}
+	}
+}
+
+func TestMemBackendPutDelete(t *testing.T) {
+	backend := NewMemBackend(ObjectInfo{Name: "b/1"}, ObjectInfo{Name: "a"})
+	backend.Put(ObjectInfo{Name: "b/", ContentType: "application/x-directory"})
+	backend.Put(ObjectInfo{Name: "c/", ContentType: "application/x-directory"})
+	backend.Put(ObjectInfo{Name: "a", Size: 42})
+	list := func(delimiter string) string {
+		result, err := ListObjectsWithOptions(context.Background(), "bucket", "",
+			ListOptions{Delimiter: delimiter}, backend.ListBackend(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, obj := range result.Objects {
+			if obj.Bucket != "bucket" {
+				t.Fatalf("%s: expected bucket, got %q", obj.Name, obj.Bucket)
+			}
+			names = append(names, obj.Name)
+		}
+		return fmt.Sprint(names, result.Prefixes)
+	}
+	if s := list(""); s != "[a b/1 c/] []" {
+		t.Fatalf("expected [a b/1 c/] [], got %s", s)
+	}
+	if s := list("/"); s != "[a] [b/ c/]" {
+		t.Fatalf("expected [a] [b/ c/], got %s", s)
+	}
+	objInfo, err := backend.GetObjectInfo(context.Background(), "bucket", "a", nil)
+	if err != nil || objInfo.Size != 42 {
+		t.Fatalf("expected the replaced object, got %+v, %v", objInfo, err)
+	}
+
+	backend.Delete("b/1")
+	backend.Delete("b/1")
+	if s := list(""); s != "[a b/ c/] []" {
+		t.Fatalf("expected [a b/ c/] [], got %s", s)
+	}
+	if _, err = backend.GetObjectInfo(context.Background(), "bucket", "b/1", nil); !os.IsNotExist(err) {
+		t.Fatalf("expected a deleted object, got %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package tests
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/zhaohuxing/s3/cmd"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	cursor := ListCursor{PrefixDir: "a1/", Dir: "b2/c3/", Marker: "1.txt", Recursive: true}
+	decoded, err := DecodeCursor(EncodeCursor(cursor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != cursor {
+		t.Fatalf("expected %+v, got %+v", cursor, decoded)
+	}
+	if _, err = DecodeCursor("not a cursor"); err != ErrInvalidCursor {
+		t.Fatalf("expected ErrInvalidCursor, got %v", err)
+	}
+}
+
+func TestListObjectsWithCursor(t *testing.T) {
+	for _, delimiter := range []string{"", "/"} {
+		tpool := NewTreeWalkPool(time.Minute)
+		expected := listNames(t, func(marker string) (ListObjectsInfo, error) {
+			return ListObjectsWithResolver(context.Background(), "", "a1/b", marker, delimiter, 4,
+				tpool, listDirFactory(), isLeaf, isLeafDir, &splitResolver{}, ListOptions{})
+		})
+
+		var got []string
+		var cursor string
+		for {
+			// A new pool for every page, as if the process restarted.
+			result, nextCursor, err := ListObjectsWithCursor(context.Background(), "", "a1/b", cursor, delimiter, 4,
+				NewTreeWalkPool(time.Minute), listDirFactory(), isLeaf, isLeafDir, &splitResolver{}, ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, obj := range result.Objects {
+				got = append(got, obj.Name)
+			}
+			got = append(got, result.Prefixes...)
+			if nextCursor == "" {
+				break
+			}
+			cursor = nextCursor
+		}
+		if strings.Join(expected, ",") != strings.Join(got, ",") {
+			t.Fatalf("delimiter %q: resuming from cursors differs\n%v\n%v", delimiter, expected, got)
+		}
+
+		// A cursor of a different listing is refused.
+		if cursor == "" {
+			t.Fatalf("delimiter %q: expected more than one page", delimiter)
+		}
+		_, _, err := ListObjectsWithCursor(context.Background(), "", "c1/", cursor, delimiter, 4,
+			NewTreeWalkPool(time.Minute), listDirFactory(), isLeaf, isLeafDir, &splitResolver{}, ListOptions{})
+		if err != ErrInvalidCursor {
+			t.Fatalf("expected ErrInvalidCursor, got %v", err)
+		}
+	}
+}
+
+func TestListObjectsWithCursorResume(t *testing.T) {
+	tree := newMemBackend("a/1", "a/b/c/1", "a/b/c/2", "a/b/c/d/", "a/b/e", "a/f", "g/1", "h")
+	list := func(prefix, cursor string, maxKeys int, opts ListOptions) (ListObjectsInfo, string) {
+		t.Helper()
+		result, nextCursor, err := ListObjectsWithCursor(context.Background(), "", prefix, cursor, "", maxKeys,
+			NewTreeWalkPool(time.Minute), tree.ListDir, isLeaf, tree.IsLeafDir, memResolver{tree}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result, nextCursor
+	}
+
+	// The cursor holds the directory the walk was in.
+	_, cursor := list("", "", 2, ListOptions{})
+	c, err := DecodeCursor(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Dir != "a/b/c/" || c.Marker != "1" {
+		t.Fatalf("expected the walk in a/b/c/ at 1, got %+v", c)
+	}
+
+	// The resumed walk starts right in it.
+	tracer := &captureTracer{}
+	result, _ := list("", cursor, 1, ListOptions{WalkOptions: WalkOptions{Tracer: tracer}})
+	if len(result.Objects) != 1 || result.Objects[0].Name != "a/b/c/2" {
+		t.Fatalf("expected a/b/c/2, got %+v", result.Objects)
+	}
+	tracer.mu.Lock()
+	first := tracer.traces[0]
+	tracer.mu.Unlock()
+	if first != `treeWalk: enter "a/b/c/" marker "1"` {
+		t.Fatalf("expected the walk to enter a/b/c/ first, got %s", first)
+	}
+
+	// Resuming on every page lists the same as a single page.
+	for _, prefix := range []string{"", "a/", "a/b"} {
+		for _, opts := range []ListOptions{{}, {WalkOptions: WalkOptions{ParallelSubtrees: 2}}, {WalkOptions: WalkOptions{DirsFirst: true}}} {
+			expected, _ := list(prefix, "", 100, opts)
+			var got []string
+			var cursor string
+			for {
+				var result ListObjectsInfo
+				result, cursor = list(prefix, cursor, 1, opts)
+				for _, obj := range result.Objects {
+					got = append(got, obj.Name)
+				}
+				if cursor == "" {
+					break
+				}
+			}
+			var names []string
+			for _, obj := range expected.Objects {
+				names = append(names, obj.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(got, ",") {
+				t.Fatalf("prefix %q %+v: resuming from cursors differs\n%v\n%v", prefix, opts, names, got)
+			}
+		}
+	}
+}
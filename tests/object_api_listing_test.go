@@ -0,0 +1,786 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/zhaohuxing/s3/cmd"
+)
+
+func TestNextPrefix(t *testing.T) {
+	expected := []string{"a1/", "a2/", "a3/", "b1/", "b2/", "b3/", "c1/", "c2/", "c3/"}
+
+	var marker string
+	for i, want := range expected {
+		prefix, more, err := NextPrefix(context.Background(), "", "", marker, listDirFactory(), isLeafDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prefix != want {
+			t.Fatalf("expected %s, got %s", want, prefix)
+		}
+		if more != (i < len(expected)-1) {
+			t.Fatalf("%s: unexpected more %v", prefix, more)
+		}
+		marker = prefix
+	}
+
+	// Walking into a folder.
+	prefix, more, err := NextPrefix(context.Background(), "", "b2/", "b2/a3/", listDirFactory(), isLeafDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prefix != "b2/b1/" || !more {
+		t.Fatalf("expected b2/b1/ with more, got %s %v", prefix, more)
+	}
+}
+
+func TestPrefixHasObjects(t *testing.T) {
+	for prefix, expected := range map[string]bool{"a1/": true, "a1/b2/c1": true, "a1/nonexistent": false, "nonexistent/": false} {
+		found, err := PrefixHasObjects(context.Background(), "", prefix, listDirFactory(), isLeaf, isLeafDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != expected {
+			t.Fatalf("%s: expected %v, got %v", prefix, expected, found)
+		}
+	}
+
+	// Empty directories are not objects.
+	tree := newMemBackend("a/", "b/c/", "b/d/", "e/f")
+	for prefix, expected := range map[string]bool{"": true, "a/": false, "b/": false, "e/": true} {
+		found, err := PrefixHasObjects(context.Background(), "", prefix, tree.ListDir, tree.IsLeaf, tree.IsLeafDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != expected {
+			t.Fatalf("%s: expected %v, got %v", prefix, expected, found)
+		}
+	}
+}
+
+// identityResolver - resolves the identities of the objects from a map.
+type identityResolver struct {
+	memResolver
+	identities map[string]string
+}
+
+func (r identityResolver) ResolveObject(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	objInfo, err := r.memResolver.ResolveObject(ctx, bucket, name, info)
+	objInfo.Identity = r.identities[name]
+	return objInfo, err
+}
+
+func TestListUniqueByIdentity(t *testing.T) {
+	tree := newMemBackend("a/1", "a/2", "b/1", "c")
+	resolver := identityResolver{
+		memResolver: memResolver{tree},
+		identities:  map[string]string{"a/2": "dev1:42", "b/1": "dev1:42", "c": "dev1:43"},
+	}
+	objInfos, err := ListUniqueByIdentity(context.Background(), "", "", NewTreeWalkPool(time.Minute),
+		tree.ListDir, isLeaf, tree.IsLeafDir, resolver, ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, objInfo := range objInfos {
+		names = append(names, objInfo.Name)
+	}
+	if strings.Join(names, ",") != "a/1,a/2,c" {
+		t.Fatalf("expected a/1,a/2,c, got %v", names)
+	}
+}
+
+func TestListKeys(t *testing.T) {
+	testCases := []struct {
+		prefix    string
+		delimiter string
+		maxKeys   int
+	}{
+		{"", "", 1000},
+		{"a1/", "", 7},
+		{"", "/", 100},
+		{"b2/", "/", 3},
+	}
+	for _, testCase := range testCases {
+		pool := NewTreeWalkPool(time.Minute)
+		expected := listNames(t, func(marker string) (ListObjectsInfo, error) {
+			return ListObjects(context.Background(), "", testCase.prefix, marker, testCase.delimiter, testCase.maxKeys,
+				pool, listDirFactory(), isLeaf, isLeafDir, getObjectInfo, getObjectInfo)
+		})
+		got := listNames(t, func(marker string) (ListObjectsInfo, error) {
+			keys, prefixes, nextMarker, truncated, err := ListKeys(context.Background(), "", testCase.prefix, marker,
+				testCase.delimiter, testCase.maxKeys, listDirFactory(), isLeaf, isLeafDir)
+			loi := ListObjectsInfo{IsTruncated: truncated, NextMarker: nextMarker, Prefixes: prefixes}
+			for _, key := range keys {
+				loi.Objects = append(loi.Objects, ObjectInfo{Name: key})
+			}
+			return loi, err
+		})
+		if strings.Join(expected, ",") != strings.Join(got, ",") {
+			t.Fatalf("%+v: expected\n%v\ngot\n%v", testCase, expected, got)
+		}
+	}
+}
+
+func TestAutocomplete(t *testing.T) {
+	testCases := []struct {
+		partial  string
+		limit    int
+		expected string
+	}{
+		// a1.txt sorts ahead of the folder a1/.
+		{"a", 5, "[a1.txt a1/ a11.txt a12.txt a2.txt]"},
+		{"a", 100, "[a1.txt a1/ a11.txt a12.txt a2.txt a2/ a21.txt a22.txt a3/ a31.txt a32.txt]"},
+		{"a3", 100, "[a3/ a31.txt a32.txt]"},
+		{"a1/b", 2, "[a1/b1/ a1/b11.txt]"},
+		{"x", 5, "[]"},
+		{"a", 0, "[]"},
+	}
+	for _, testCase := range testCases {
+		names, err := Autocomplete(context.Background(), "", testCase.partial, testCase.limit, listDirFactory(), isLeaf, isLeafDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(names) != testCase.expected {
+			t.Errorf("%q limit %d: expected %s, got %v", testCase.partial, testCase.limit, testCase.expected, names)
+		}
+	}
+}
+
+func TestListObjectsMultiPrefix(t *testing.T) {
+	prefixes := []string{"a1/", "b2/", "c3/"}
+	results, err := ListObjectsMultiPrefix(context.Background(), "", prefixes, "/", 5,
+		NewTreeWalkPool(time.Minute), listDirFactory(), isLeaf, isLeafDir, &splitResolver{}, ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(prefixes) {
+		t.Fatalf("expected %d results, got %d", len(prefixes), len(results))
+	}
+	for _, prefix := range prefixes {
+		expected, err := ListObjectsWithResolver(context.Background(), "", prefix, "", "/", 5,
+			NewTreeWalkPool(time.Minute), listDirFactory(), isLeaf, isLeafDir, &splitResolver{}, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := results[prefix]
+		if !reflect.DeepEqual(result, expected) {
+			t.Fatalf("%s: expected\n%+v\ngot\n%+v", prefix, expected, result)
+		}
+		for _, obj := range result.Objects {
+			if !strings.HasPrefix(obj.Name, prefix) {
+				t.Fatalf("%s: unexpected object %s", prefix, obj.Name)
+			}
+		}
+		for _, p := range result.Prefixes {
+			if !strings.HasPrefix(p, prefix) {
+				t.Fatalf("%s: unexpected prefix %s", prefix, p)
+			}
+		}
+	}
+}
+
+func TestListFolder(t *testing.T) {
+	for _, folder := range []string{"a1", "a1/"} {
+		files, subdirs, _, truncated, err := ListFolder(context.Background(), "", folder, "", 100,
+			listDirFactory(), isLeaf, isLeafDir, getObjectInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a1/ holds 22 files and 9 directories.
+		if len(files) != 22 || len(subdirs) != 9 || truncated {
+			t.Fatalf("%s: expected 22 files and 9 subdirs, got %d and %d", folder, len(files), len(subdirs))
+		}
+		for _, file := range files {
+			if file.IsDir || strings.Contains(strings.TrimPrefix(file.Name, "a1/"), "/") {
+				t.Fatalf("%s: unexpected file %s", folder, file.Name)
+			}
+		}
+		if subdirs[0] != "a1/a1/" || subdirs[8] != "a1/c3/" {
+			t.Fatalf("%s: unexpected subdirs %v", folder, subdirs)
+		}
+	}
+
+	// Paging through the folder.
+	var names []string
+	var marker string
+	for {
+		files, subdirs, nextMarker, truncated, err := ListFolder(context.Background(), "", "a1", marker, 4,
+			listDirFactory(), isLeaf, isLeafDir, getObjectInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range files {
+			names = append(names, file.Name)
+		}
+		names = append(names, subdirs...)
+		if !truncated {
+			break
+		}
+		marker = nextMarker
+	}
+	if len(names) != 31 {
+		t.Fatalf("expected 31 names, got %d", len(names))
+	}
+}
+
+func TestListUpTo(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	pool := NewTreeWalkPool(time.Minute)
+	all, err := ListUpTo(context.Background(), 1000, 100, "", "a1/", pool,
+		listDirFactory(), isLeaf, isLeafDir, &splitResolver{}, ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stops at the end of the listing.
+	if len(all) != 382 {
+		t.Fatalf("expected 382 objects, got %d", len(all))
+	}
+
+	for _, total := range []int{1, 7, 100, 250} {
+		calls := &splitResolver{}
+		objInfos, err := ListUpTo(context.Background(), total, 30, "", "a1/", pool,
+			listDirFactory(), isLeaf, isLeafDir, calls, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(objInfos) != total {
+			t.Fatalf("expected %d objects, got %d", total, len(objInfos))
+		}
+		for i := range objInfos {
+			if objInfos[i].Name != all[i].Name {
+				t.Fatalf("%d: expected %s, got %s", i, all[i].Name, objInfos[i].Name)
+			}
+		}
+		// Nothing is resolved past the total.
+		if calls.objCalls != int64(total) {
+			t.Fatalf("expected %d resolutions, got %d", total, calls.objCalls)
+		}
+	}
+	// The walks stopped at the total are not left in the pool.
+	waitGoroutines(t, baseline)
+}
+
+func TestListObjectsBatched(t *testing.T) {
+	full := listAllPages(t, nil, "", "", 1000, func() {})
+	for _, batchSize := range []int{10, 7} {
+		var names []string
+		var sizes []int
+		err := ListObjectsBatched(context.Background(), "", "", batchSize, listDirFactory(), isLeaf, isLeafDir,
+			funcResolver(getObjectInfo), ListOptions{}, func(batch []ObjectInfo) error {
+				sizes = append(sizes, len(batch))
+				for _, objInfo := range batch {
+					names = append(names, objInfo.Name)
+				}
+				return nil
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(names, full) {
+			t.Fatalf("%d: expected the %d objects, got %d", batchSize, len(full), len(names))
+		}
+		// Full batches, but for the last one with the rest.
+		for i, size := range sizes {
+			if i < len(sizes)-1 && size != batchSize || size == 0 || size > batchSize {
+				t.Fatalf("%d: unexpected size %d of batch %d of %d", batchSize, size, i+1, len(sizes))
+			}
+		}
+		if expected := (len(full) + batchSize - 1) / batchSize; len(sizes) != expected {
+			t.Fatalf("%d: expected %d batches, got %d", batchSize, expected, len(sizes))
+		}
+	}
+
+	// An error of onBatch ends the listing with it.
+	baseline := runtime.NumGoroutine()
+	errBatch := errors.New("batch failed")
+	var batches int
+	err := ListObjectsBatched(context.Background(), "", "", 10, listDirFactory(), isLeaf, isLeafDir,
+		funcResolver(getObjectInfo), ListOptions{}, func(batch []ObjectInfo) error {
+			if batches++; batches == 3 {
+				return errBatch
+			}
+			return nil
+		})
+	if !errors.Is(err, errBatch) || batches != 3 {
+		t.Fatalf("expected errBatch after 3 batches, got %v after %d", err, batches)
+	}
+	waitGoroutines(t, baseline)
+}
+
+func TestListChangedSince(t *testing.T) {
+	synced := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	modTimes := map[string]time.Time{
+		"a/1":   synced.Add(-time.Hour),
+		"a/2":   synced.Add(time.Minute),
+		"a/b/3": synced.Add(-time.Minute),
+		"a/b/4": synced,
+		"c":     synced.Add(-24 * time.Hour),
+		"d/5":   synced.Add(time.Hour),
+		"e":     synced.Add(-time.Second),
+	}
+	var keys []string
+	for key := range modTimes {
+		keys = append(keys, key)
+	}
+	tree := newMemBackend(keys...)
+	getObjInfo := func(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+		objInfo, err := tree.GetObjectInfo(ctx, bucket, name, info)
+		objInfo.ModTime = modTimes[name]
+		return objInfo, err
+	}
+
+	for _, maxKeys := range []int{100, 1} {
+		var names []string
+		var marker string
+		latest := synced
+		for {
+			objInfos, nextMarker, truncated, nextSince, err := ListChangedSince(context.Background(), "", "", synced,
+				marker, maxKeys, tree.ListDir, tree.IsLeaf, tree.IsLeafDir, getObjInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, objInfo := range objInfos {
+				names = append(names, objInfo.Name)
+			}
+			if nextSince.After(latest) {
+				latest = nextSince
+			}
+			if !truncated {
+				break
+			}
+			marker = nextMarker
+		}
+		if strings.Join(names, ",") != "a/2,a/b/4,d/5" {
+			t.Fatalf("maxKeys %d: unexpected objects %v", maxKeys, names)
+		}
+		if !latest.Equal(synced.Add(time.Hour)) {
+			t.Fatalf("maxKeys %d: unexpected next since %v", maxKeys, latest)
+		}
+	}
+
+	// Nothing changed since the latest modification.
+	objInfos, _, _, nextSince, err := ListChangedSince(context.Background(), "", "", synced.Add(2*time.Hour),
+		"", 100, tree.ListDir, tree.IsLeaf, tree.IsLeafDir, getObjInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objInfos) != 0 || !nextSince.Equal(synced.Add(2*time.Hour)) {
+		t.Fatalf("unexpected objects %v, next since %v", objInfos, nextSince)
+	}
+}
+
+func TestDedupListing(t *testing.T) {
+	tree := newMemBackend("a/1", "a/b/2", "c", "d/3", "e")
+	list := func(delimiter string, maxKeys int) ListObjectsInfo {
+		loi, err := listMem(tree, "", "", delimiter, maxKeys, nil, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return loi
+	}
+	names := func(loi ListObjectsInfo) string {
+		var names []string
+		for _, obj := range loi.Objects {
+			names = append(names, obj.Name)
+		}
+		return strings.Join(append(names, loi.Prefixes...), ",")
+	}
+
+	// Prefixes of the non-recursive listing with the recursive one.
+	merged := DedupListing(list("/", 100), list("", 100))
+	if names(merged) != "a/1,a/b/2,c,d/3,e,a/,d/" || merged.IsTruncated || merged.KeyCount != 7 {
+		t.Fatalf("unexpected merged listing %s %+v", names(merged), merged)
+	}
+
+	// Overlapping listings, the first one wins.
+	a, b := list("", 100), list("", 3)
+	b.Objects[0].ContentType = "stale"
+	merged = DedupListing(a, b)
+	if names(merged) != "a/1,a/b/2,c,d/3,e" || merged.Objects[0].ContentType == "stale" {
+		t.Fatalf("unexpected merged listing %s", names(merged))
+	}
+	// Truncated if either one is, resuming from the earliest marker.
+	if !merged.IsTruncated || merged.NextMarker != "c" {
+		t.Fatalf("expected to be truncated at c, got %v %q", merged.IsTruncated, merged.NextMarker)
+	}
+	merged = DedupListing(list("", 2), list("/", 1))
+	if !merged.IsTruncated || merged.NextMarker != "a/" {
+		t.Fatalf("expected to be truncated at a/, got %v %q", merged.IsTruncated, merged.NextMarker)
+	}
+}
+
+// drainWalkFull - collects the files and directories walked by WalkFull.
+func drainWalkFull(t *testing.T, files <-chan ObjectInfo, dirs <-chan string, errs <-chan error) (fileNames, dirNames []string) {
+	t.Helper()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for dir := range dirs {
+			dirNames = append(dirNames, dir)
+		}
+	}()
+	for file := range files {
+		fileNames = append(fileNames, file.Name)
+	}
+	wg.Wait()
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return fileNames, dirNames
+}
+
+func TestWalkFull(t *testing.T) {
+	tree := newMemBackend("a/1", "a/b/2", "a/c/", "d", "e/f/3")
+	fileCh, dirCh, errCh := WalkFull(context.Background(), "", "", tree.ListDir, tree.IsLeaf, tree.IsLeafDir)
+	files, dirs := drainWalkFull(t, fileCh, dirCh, errCh)
+	if strings.Join(files, ",") != "a/1,a/b/2,d,e/f/3" {
+		t.Fatalf("unexpected files %v", files)
+	}
+	if strings.Join(dirs, ",") != "a/,a/b/,a/c/,e/,e/f/" {
+		t.Fatalf("unexpected directories %v", dirs)
+	}
+
+	// Everything under testdata.
+	var fileCount, dirCount int
+	err := filepath.WalkDir(testdir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == testdir {
+			return err
+		}
+		if d.IsDir() {
+			dirCount++
+		} else {
+			fileCount++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileCh, dirCh, errCh = WalkFull(context.Background(), "", "", listDirFactory(), isLeaf, isLeafDir)
+	files, dirs = drainWalkFull(t, fileCh, dirCh, errCh)
+	if len(files) != fileCount || len(dirs) != dirCount {
+		t.Fatalf("expected %d files and %d directories, got %d and %d", fileCount, dirCount, len(files), len(dirs))
+	}
+}
+
+func TestDiffListings(t *testing.T) {
+	// walkFiles - walks the files of tree, leaving the directories out.
+	walkFiles := func(listDir ListDirFunc, tree *MemBackend) (<-chan ObjectInfo, <-chan error) {
+		files, dirs, errs := WalkFull(context.Background(), "", "", listDir, tree.IsLeaf, tree.IsLeafDir)
+		go func() {
+			for range dirs {
+			}
+		}()
+		return files, errs
+	}
+	source := newMemBackend("a/1", "a/2", "b", "c/d", "e")
+	destination := newMemBackend("a/1", "a/2", "b", "c/x", "f")
+	// "a/2" was rewritten in the destination.
+	listDir := func(bucket, prefixDir, prefixEntry string) (bool, []*Entry, bool) {
+		emptyDir, entries, delayIsLeaf := destination.ListDir(bucket, prefixDir, prefixEntry)
+		for _, entry := range entries {
+			if prefixDir+entry.Name == "a/2" {
+				entry.Info.ETag = "rewritten"
+			}
+		}
+		return emptyDir, entries, delayIsLeaf
+	}
+
+	a, errsA := walkFiles(source.ListDir, source)
+	b, errsB := walkFiles(listDir, destination)
+	var diffs []string
+	for diff := range DiffListings(a, b) {
+		if (diff.A == nil) != (diff.Kind == DiffAdded) || (diff.B == nil) != (diff.Kind == DiffRemoved) {
+			t.Fatalf("%s: inconsistent diff %+v", diff.Name, diff)
+		}
+		diffs = append(diffs, fmt.Sprintf("%d:%s", diff.Kind, diff.Name))
+	}
+	for _, errs := range []<-chan error{errsA, errsB} {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []string{
+		fmt.Sprintf("%d:a/2", DiffChanged),
+		fmt.Sprintf("%d:c/d", DiffRemoved),
+		fmt.Sprintf("%d:c/x", DiffAdded),
+		fmt.Sprintf("%d:e", DiffRemoved),
+		fmt.Sprintf("%d:f", DiffAdded),
+	}
+	if strings.Join(diffs, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected %v, got %v", expected, diffs)
+	}
+}
+
+func TestListGroupedByTopPrefix(t *testing.T) {
+	groups, err := ListGroupedByTopPrefix(context.Background(), "", "", 0, listDirFactory(), isLeaf, isLeafDir, getObjectInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, group := range []string{"a1", "b1", "c1"} {
+		var files []string
+		err := filepath.WalkDir(filepath.Join(testdir, group), func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				files = append(files, filepath.ToSlash(strings.TrimPrefix(path, filepath.Clean(testdir)+"/")))
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, objInfo := range groups[group] {
+			names = append(names, objInfo.Name)
+		}
+		// Listed in the order of the keys.
+		sort.Strings(files)
+		if len(files) == 0 || strings.Join(names, ",") != strings.Join(files, ",") {
+			t.Fatalf("%s: expected %v, got %v", group, files, names)
+		}
+	}
+	if len(groups["z1.txt"]) != 1 {
+		t.Fatalf("expected z1.txt as a group of its own, got %v", groups["z1.txt"])
+	}
+
+	// The walk stops ahead of the third group.
+	groups, err = ListGroupedByTopPrefix(context.Background(), "", "b1/", 2, listDirFactory(), isLeaf, isLeafDir, getObjectInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 || len(groups["a1"]) == 0 || len(groups["a1.txt"]) != 1 {
+		t.Fatalf("expected the groups a1 and a1.txt, got %v", groups)
+	}
+}
+
+// sortedKeys - KeyRangeScanner of a sorted slice of keys, counting the
+// keys it reads.
+type sortedKeys struct {
+	keys []string
+	read int
+}
+
+func (s *sortedKeys) Scan(ctx context.Context, bucket, start string, fn func(key string) bool) error {
+	for _, key := range s.keys[sort.SearchStrings(s.keys, start):] {
+		s.read++
+		if !fn(key) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestListFromSortedSource(t *testing.T) {
+	tree := newMemBackend(
+		"a", "a/1", "a/b/1", "a/b/c/1", "a/b/c/2", "a/e/1", "a-b",
+		"c", "d/1", "d/2/3/4/5", "d/2/3/6", "e/f/g", "z",
+	)
+	tree = newMemBackend(append(tree.Keys(), wideMemBackend(5, 10).Keys()...)...)
+	testCases := []struct {
+		prefix    string
+		delimiter string
+	}{
+		{"", ""},
+		{"", "/"},
+		{"a", "/"},
+		{"a/", "/"},
+		{"a/b/", ""},
+		{"d/", "/"},
+		{"", "-"},
+		{"", "b/"},
+		{"none/", "/"},
+	}
+	for _, testCase := range testCases {
+		for _, maxKeys := range []int{1, 2, 3, 1000} {
+			expected := listNames(t, func(marker string) (ListObjectsInfo, error) {
+				return listMem(tree, testCase.prefix, marker, testCase.delimiter, maxKeys, nil, ListOptions{MultiCharDelimiter: true})
+			})
+			source := &sortedKeys{keys: tree.Keys()}
+			got := listNames(t, func(marker string) (ListObjectsInfo, error) {
+				return ListFromSortedSource(context.Background(), "", testCase.prefix, marker, testCase.delimiter, maxKeys, source, tree.GetObjectInfo)
+			})
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("%q %q %d: expected %v, got %v", testCase.prefix, testCase.delimiter, maxKeys, expected, got)
+			}
+		}
+	}
+
+	// The keys under the common prefixes are skipped rather than read.
+	source := &sortedKeys{keys: tree.Keys()}
+	result, err := ListFromSortedSource(context.Background(), "", "", "", "/", 1000, source, tree.GetObjectInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(result.Objects) + len(result.Prefixes); source.read > 2*n {
+		t.Fatalf("expected at most %d keys read for %d listed, read %d", 2*n, n, source.read)
+	}
+}
+
+func TestNextPrefixMarker(t *testing.T) {
+	testCases := []struct {
+		prefix   string
+		expected string
+	}{
+		{"a1/", "a10"},
+		{"a", "b"},
+		{"a\xff", "b"},
+		{"a\xff\xff", "b"},
+		{"\xff", ""},
+		{"", ""},
+	}
+	for _, testCase := range testCases {
+		if marker := NextPrefixMarker(testCase.prefix); marker != testCase.expected {
+			t.Errorf("%q: expected %q, got %q", testCase.prefix, testCase.expected, marker)
+		}
+	}
+
+	// Listing past a1/ skips all of it.
+	result, err := ListObjects(context.Background(), "", "", NextPrefixMarker("a1/"), "", 1000,
+		nil, listDirFactory(), isLeaf, isLeafDir, getObjectInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Objects) == 0 || result.Objects[0].Name != "a11.txt" {
+		t.Fatalf("expected the listing to start with a11.txt, got %+v", result.Objects)
+	}
+	for _, obj := range result.Objects {
+		if strings.HasPrefix(obj.Name, "a1/") {
+			t.Fatalf("%s: expected to be skipped", obj.Name)
+		}
+	}
+}
+
+func TestListRange(t *testing.T) {
+	full := listAllPages(t, nil, "", "", 1000, func() {})
+	baseline := runtime.NumGoroutine()
+	pool := NewTreeWalkPool(time.Minute)
+	var union []string
+	for _, bounds := range [][2]string{{"", "b"}, {"b", "c"}, {"c", ""}} {
+		start, end := bounds[0], bounds[1]
+		names := listNames(t, func(marker string) (ListObjectsInfo, error) {
+			if marker == "" {
+				marker = start
+			}
+			return ListRange(context.Background(), "", "", marker, end, 100,
+				pool, listDirFactory(), isLeaf, isLeafDir, funcResolver(getObjectInfo), ListOptions{})
+		})
+		for _, name := range names {
+			if name <= start || end != "" && name >= end {
+				t.Fatalf("(%q, %q): %s is out of range", start, end, name)
+			}
+		}
+		union = append(union, names...)
+	}
+	if !reflect.DeepEqual(union, full) {
+		t.Fatalf("expected the ranges to list the %d keys once, got %d", len(full), len(union))
+	}
+	// The walks ended at the end of their ranges.
+	if params := pool.ActiveParams(); len(params) != 0 {
+		t.Fatalf("expected no walks parked, got %v", params)
+	}
+	waitGoroutines(t, baseline)
+
+	// More keys past the range than the walk buffers, the walk blocks
+	// unless ended.
+	tree := wideMemBackend(200, 500)
+	result, err := ListRange(context.Background(), "", "", "", "d001/", 1000,
+		pool, tree.ListDir, isLeaf, tree.IsLeafDir, memResolver{tree}, ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Objects) != 500 || result.IsTruncated {
+		t.Fatalf("expected the 500 keys of d000/, got %d", len(result.Objects))
+	}
+	waitGoroutines(t, baseline)
+
+	// Bounds outside of the prefix.
+	testCases := []struct {
+		start, end string
+		listed     bool
+	}{
+		{"a", "", true},
+		{"b", "", false},
+		{"", "a1/", false},
+		{"a1/a2/", "a1/a3/", true},
+	}
+	for _, testCase := range testCases {
+		result, err := ListRange(context.Background(), "", "a1/", testCase.start, testCase.end, 1000,
+			nil, listDirFactory(), isLeaf, isLeafDir, funcResolver(getObjectInfo), ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if listed := len(result.Objects) > 0; listed != testCase.listed {
+			t.Fatalf("(%q, %q): expected listed %v, got %d objects", testCase.start, testCase.end, testCase.listed, len(result.Objects))
+		}
+	}
+}
+
+func TestClaimRange(t *testing.T) {
+	full := listAllPages(t, nil, "", "", 1000, func() {})
+	small := newMemBackend("a", "b/1")
+	empty := newMemBackend()
+	testCases := []struct {
+		prefix    string
+		sample    int
+		listDir   ListDirFunc
+		isLeafDir IsLeafDirFunc
+		resolver  InfoResolver
+		expected  []string
+	}{
+		{"", 5000, listDirFactory(), isLeafDir, funcResolver(getObjectInfo), full},
+		// The keys past the sample are owned by the last worker.
+		{"", 10, listDirFactory(), isLeafDir, funcResolver(getObjectInfo), full},
+		{"b", 0, listDirFactory(), isLeafDir, funcResolver(getObjectInfo), nil},
+		// Fewer keys than workers.
+		{"", 0, small.ListDir, small.IsLeafDir, memResolver{small}, []string{"a", "b/1"}},
+		{"b/", 0, small.ListDir, small.IsLeafDir, memResolver{small}, []string{"b/1"}},
+		{"", 0, empty.ListDir, empty.IsLeafDir, memResolver{empty}, nil},
+	}
+	for i, testCase := range testCases {
+		if testCase.prefix == "b" {
+			// The keys of testdata under b.
+			for _, name := range full {
+				if strings.HasPrefix(name, "b") {
+					testCase.expected = append(testCase.expected, name)
+				}
+			}
+		}
+		var union []string
+		for workerN := 0; workerN < 3; workerN++ {
+			start, end, err := ClaimRange(context.Background(), "", testCase.prefix, workerN, 3, testCase.sample,
+				testCase.listDir, isLeaf, testCase.isLeafDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := listNames(t, func(marker string) (ListObjectsInfo, error) {
+				if marker == "" {
+					marker = start
+				}
+				return ListRange(context.Background(), "", testCase.prefix, marker, end, 1000,
+					nil, testCase.listDir, isLeaf, testCase.isLeafDir, testCase.resolver, ListOptions{})
+			})
+			union = append(union, names...)
+		}
+		if strings.Join(union, ",") != strings.Join(testCase.expected, ",") {
+			t.Fatalf("Test %d: expected the ranges to list the %d keys once, got %d: %v", i+1, len(testCase.expected), len(union), union)
+		}
+	}
+
+	for _, workerN := range []int{-1, 3} {
+		if _, _, err := ClaimRange(context.Background(), "", "", workerN, 3, 0, listDirFactory(), isLeaf, isLeafDir); err == nil {
+			t.Fatalf("worker %d: expected an error", workerN)
+		}
+	}
+}
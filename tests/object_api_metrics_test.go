@@ -0,0 +1,105 @@
+package tests
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/zhaohuxing/s3/cmd"
+)
+
+// fakeCounter - counts the calls of Inc() and Observe().
+type fakeCounter struct {
+	n int64
+}
+
+func (c *fakeCounter) Inc() {
+	atomic.AddInt64(&c.n, 1)
+}
+
+func (c *fakeCounter) Observe(float64) {
+	atomic.AddInt64(&c.n, 1)
+}
+
+func TestListMetrics(t *testing.T) {
+	tree := newMemBackend("a/1", "a/2", "b/c/1", "d")
+	var dirsWalked, objInfoCalls, listLatency fakeCounter
+	opts := ListOptions{WalkOptions: WalkOptions{Metrics: CounterSink{
+		DirsWalked:   &dirsWalked,
+		ObjInfoCalls: &objInfoCalls,
+		ListLatency:  &listLatency,
+	}}}
+
+	result, err := listMem(tree, "", "", "", 100, NewTreeWalkPool(time.Minute), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Objects) != 4 {
+		t.Fatalf("expected 4 objects, got %d", len(result.Objects))
+	}
+	// The root, a/, b/ and b/c/.
+	if dirsWalked.n != 4 {
+		t.Fatalf("expected 4 directories walked, got %d", dirsWalked.n)
+	}
+	if objInfoCalls.n != 4 {
+		t.Fatalf("expected 4 ObjectInfo calls, got %d", objInfoCalls.n)
+	}
+	if listLatency.n != 1 {
+		t.Fatalf("expected 1 latency observation, got %d", listLatency.n)
+	}
+
+	// With a delimiter the directories are resolved as well.
+	if _, err = listMem(tree, "", "", "/", 100, NewTreeWalkPool(time.Minute), opts); err != nil {
+		t.Fatal(err)
+	}
+	if dirsWalked.n != 5 || objInfoCalls.n != 7 || listLatency.n != 2 {
+		t.Fatalf("expected 5, 7 and 2 calls, got %d, %d and %d", dirsWalked.n, objInfoCalls.n, listLatency.n)
+	}
+
+	// Nil counters are not fed.
+	opts.Metrics = CounterSink{ObjInfoCalls: &objInfoCalls}
+	if _, err = listMem(tree, "", "", "", 100, NewTreeWalkPool(time.Minute), opts); err != nil {
+		t.Fatal(err)
+	}
+	if objInfoCalls.n != 11 {
+		t.Fatalf("expected 11 ObjectInfo calls, got %d", objInfoCalls.n)
+	}
+}
+
+func TestListTiming(t *testing.T) {
+	tree := newMemBackend("a/1", "a/2", "b/c/1", "d")
+	delays := make(map[string]time.Duration)
+	for _, name := range []string{"a/", "b/", "a/1", "a/2", "b/c/1", "d"} {
+		delays[name] = 10 * time.Millisecond
+	}
+	resolver := delayingResolver{memResolver: memResolver{tree}, delays: delays}
+
+	testCases := []struct {
+		delimiter string
+		stats     int
+	}{
+		{"", 4},
+		// Objects and directories alike.
+		{"/", 3},
+		// The keys under the prefix b/c are not resolved.
+		{"c", 3},
+	}
+	for _, testCase := range testCases {
+		var timing ListTiming
+		_, err := ListObjectsWithResolver(context.Background(), "", "", "", testCase.delimiter, 100,
+			nil, slowListDir(tree, 5*time.Millisecond), isLeaf, tree.IsLeafDir, resolver, ListOptions{Timing: &timing})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if timing.StatCount != testCase.stats {
+			t.Fatalf("%q: expected %d stats, got %d", testCase.delimiter, testCase.stats, timing.StatCount)
+		}
+		if timing.StatDuration < 10*time.Millisecond {
+			t.Fatalf("%q: expected the stats to take 10ms at least, got %v", testCase.delimiter, timing.StatDuration)
+		}
+		if timing.WalkDuration <= 0 {
+			t.Fatalf("%q: expected the walk to take time, got %v", testCase.delimiter, timing.WalkDuration)
+		}
+	}
+}
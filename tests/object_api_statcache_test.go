@@ -0,0 +1,52 @@
+package tests
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/zhaohuxing/s3/cmd"
+)
+
+func TestStatCache(t *testing.T) {
+	tree := wideMemBackend(5, 10)
+	var calls atomic.Int64
+	resolver := funcResolver(func(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+		calls.Add(1)
+		return tree.GetObjectInfo(ctx, bucket, name, info)
+	})
+	list := func(cache *StatCache) int64 {
+		t.Helper()
+		calls.Store(0)
+		result, err := ListObjectsWithResolver(context.Background(), "", "", "", "", 1000,
+			nil, tree.ListDir, isLeaf, tree.IsLeafDir, resolver, ListOptions{StatCache: cache})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Objects) != 50 {
+			t.Fatalf("expected 50 objects, got %d", len(result.Objects))
+		}
+		return calls.Load()
+	}
+
+	// Resolved once within the TTL.
+	cache := NewStatCache(100*time.Millisecond, 1000)
+	if n := list(cache); n != 50 {
+		t.Fatalf("expected 50 stats, got %d", n)
+	}
+	if n := list(cache); n != 0 {
+		t.Fatalf("expected no stats within the TTL, got %d", n)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if n := list(cache); n != 50 {
+		t.Fatalf("expected 50 stats past the TTL, got %d", n)
+	}
+
+	// Bounded in size.
+	cache = NewStatCache(time.Minute, 10)
+	list(cache)
+	if n := cache.Len(); n != 10 {
+		t.Fatalf("expected 10 cached objects, got %d", n)
+	}
+}
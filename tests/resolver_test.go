@@ -0,0 +1,679 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/zhaohuxing/s3/cmd"
+)
+
+// splitResolver - resolves objects and directories through distinct
+// code paths, tagging the results so the test can tell them apart.
+type splitResolver struct {
+	objCalls int64
+	dirCalls int64
+}
+
+func (r *splitResolver) ResolveObject(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	atomic.AddInt64(&r.objCalls, 1)
+	objInfo, err := getObjectInfo(ctx, bucket, name, info)
+	objInfo.ContentType = "object"
+	return objInfo, err
+}
+
+func (r *splitResolver) ResolveDir(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	atomic.AddInt64(&r.dirCalls, 1)
+	objInfo, err := getObjectInfo(ctx, bucket, name, info)
+	objInfo.ContentType = "dir"
+	return objInfo, err
+}
+
+func TestListObjectsWithResolver(t *testing.T) {
+	resolver := &splitResolver{}
+	result, err := ListObjectsWithResolver(context.Background(), "", "a1/", "", "/", 100,
+		NewTreeWalkPool(time.Minute), listDirFactory(), isLeaf, isLeafDir, resolver, ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a1/ holds 22 files and 9 directories.
+	if len(result.Objects) != 22 {
+		t.Fatalf("expected 22 objects, got %d", len(result.Objects))
+	}
+	if len(result.Prefixes) != 9 {
+		t.Fatalf("expected 9 prefixes, got %d", len(result.Prefixes))
+	}
+	for _, obj := range result.Objects {
+		if obj.ContentType != "object" {
+			t.Errorf("%s: expected to be resolved as an object", obj.Name)
+		}
+	}
+	if resolver.objCalls != 22 || resolver.dirCalls != 9 {
+		t.Fatalf("expected 22 object and 9 dir resolutions, got %d and %d", resolver.objCalls, resolver.dirCalls)
+	}
+}
+
+func TestListObjectsSkipDirStat(t *testing.T) {
+	for _, synthesize := range []bool{false, true} {
+		resolver := &splitResolver{}
+		result, err := ListObjectsWithResolver(context.Background(), "", "a1/", "", "/", 100,
+			nil, listDirFactory(), isLeaf, isLeafDir, resolver, ListOptions{SkipDirStat: true, SynthesizeDirStat: synthesize})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Objects) != 22 || len(result.Prefixes) != 9 {
+			t.Fatalf("expected 22 objects and 9 prefixes, got %d and %d", len(result.Objects), len(result.Prefixes))
+		}
+		// The stat of the prefixes is resolved only when it is listed.
+		if expected := map[bool]int64{false: 0, true: 9}[synthesize]; resolver.dirCalls != expected {
+			t.Fatalf("synthesize %v: expected %d dir resolutions, got %d", synthesize, expected, resolver.dirCalls)
+		}
+	}
+}
+
+func TestListObjectsFuncAdapter(t *testing.T) {
+	// Without any directory resolvers directories are left out.
+	result, err := ListObjects(context.Background(), "", "a1/", "", "/", 100,
+		NewTreeWalkPool(time.Minute), listDirFactory(), isLeaf, isLeafDir, getObjectInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Objects) != 22 || len(result.Prefixes) != 0 {
+		t.Fatalf("expected 22 objects and no prefixes, got %d and %d", len(result.Objects), len(result.Prefixes))
+	}
+}
+
+// unsupportedResolver - fails the stat of the named objects with ENOTSUP,
+// the same way links to external file systems do.
+type unsupportedResolver struct {
+	names map[string]bool
+}
+
+func (r unsupportedResolver) ResolveObject(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	if r.names[name] {
+		return ObjectInfo{}, syscall.ENOTSUP
+	}
+	return getObjectInfo(ctx, bucket, name, info)
+}
+
+func (r unsupportedResolver) ResolveDir(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	return getObjectInfo(ctx, bucket, name, info)
+}
+
+func TestListObjectsPlaceholderOnENOTSUP(t *testing.T) {
+	resolver := unsupportedResolver{names: map[string]bool{"a1/a2.txt": true}}
+	listObjects := func(opts ListOptions) (ListObjectsInfo, error) {
+		return ListObjectsWithResolver(context.Background(), "", "a1/a", "", "/", 100,
+			NewTreeWalkPool(time.Minute), listDirFactory(), isLeaf, isLeafDir, resolver, opts)
+	}
+
+	if _, err := listObjects(ListOptions{}); !errors.Is(err, syscall.ENOTSUP) {
+		t.Fatalf("expected ENOTSUP, got %v", err)
+	}
+
+	result, err := listObjects(ListOptions{PlaceholderOnENOTSUP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, obj := range result.Objects {
+		if obj.Name != "a1/a2.txt" {
+			continue
+		}
+		found = true
+		if obj.Size != 0 || obj.IsDir || obj.ModTime.IsZero() {
+			t.Fatalf("unexpected placeholder %+v", obj)
+		}
+	}
+	if !found {
+		t.Fatal("expected a placeholder for a1/a2.txt")
+	}
+}
+
+// vanishingResolver - resolves the objects of a MemBackend, except the ones
+// deleted in between listing and resolving them.
+type vanishingResolver struct {
+	memResolver
+	deleted map[string]bool
+}
+
+func (r vanishingResolver) ResolveObject(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	if r.deleted[name] {
+		return ObjectInfo{}, syscall.ENOENT
+	}
+	return r.memResolver.ResolveObject(ctx, bucket, name, info)
+}
+
+func (r vanishingResolver) ResolveDir(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	if r.deleted[name] {
+		return ObjectInfo{}, syscall.ENOENT
+	}
+	return r.memResolver.ResolveDir(ctx, bucket, name, info)
+}
+
+func TestListObjectsVanishedEntries(t *testing.T) {
+	// The whole of d/ vanishes between listDir and stat.
+	tree := newMemBackend("a", "d/1", "d/2", "d/3", "d/4", "e", "f")
+	resolver := vanishingResolver{
+		memResolver: memResolver{tree},
+		deleted:     map[string]bool{"d/1": true, "d/2": true, "d/3": true, "d/4": true},
+	}
+	pool := NewTreeWalkPool(time.Minute)
+	var pages [][]string
+	var marker string
+	for {
+		result, err := ListObjectsWithResolver(context.Background(), "", "", marker, "", 2,
+			pool, tree.ListDir, isLeaf, tree.IsLeafDir, resolver, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, obj := range result.Objects {
+			names = append(names, obj.Name)
+		}
+		pages = append(pages, names)
+		if !result.IsTruncated {
+			break
+		}
+		if len(pages) > 3 {
+			t.Fatalf("listing does not make progress: %v", pages)
+		}
+		marker = result.NextMarker
+	}
+	if fmt.Sprint(pages) != "[[a e] [f]]" {
+		t.Fatalf("expected pages [[a e] [f]], got %v", pages)
+	}
+
+	// Without directory resolvers all the directories are left out, a
+	// page of them must not stall the listing either.
+	pool = NewTreeWalkPool(time.Minute)
+	names := listNames(t, func(marker string) (ListObjectsInfo, error) {
+		result, err := ListObjects(context.Background(), "", "", marker, "/", 2,
+			pool, listDirFactory(), isLeaf, isLeafDir, getObjectInfo)
+		if err == nil && result.IsTruncated && len(result.Objects) != 2 {
+			t.Fatalf("%s: expected a full page, got %+v", marker, result)
+		}
+		return result, err
+	})
+	for _, name := range names {
+		if strings.HasSuffix(name, "/") {
+			t.Fatalf("%s: unexpected directory", name)
+		}
+	}
+}
+
+func TestListObjectsVanishedDirectories(t *testing.T) {
+	// b/, c/ and d/ vanish between listDir and stat.
+	tree := newMemBackend("a", "b/1", "c/1", "d/1", "e", "f/1", "g")
+	resolver := vanishingResolver{
+		memResolver: memResolver{tree},
+		deleted:     map[string]bool{"b/": true, "c/": true, "d/": true},
+	}
+	pool := NewTreeWalkPool(time.Minute)
+	var pages []string
+	var marker string
+	for {
+		result, err := ListObjectsWithResolver(context.Background(), "", "", marker, "/", 2,
+			pool, tree.ListDir, isLeaf, tree.IsLeafDir, resolver, ListOptions{Merged: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, entry := range result.Entries {
+			names = append(names, entry.Name)
+		}
+		pages = append(pages, strings.Join(names, ","))
+		if !result.IsTruncated {
+			break
+		}
+		if len(pages) > 3 {
+			t.Fatalf("listing does not make progress: %v", pages)
+		}
+		marker = result.NextMarker
+	}
+	// Still listed as plain directories, but the pages are full without them.
+	if fmt.Sprint(pages) != "[a,b/,c/,d/,e f/,g]" {
+		t.Fatalf("expected pages [a,b/,c/,d/,e f/,g], got %v", pages)
+	}
+}
+
+func TestListObjectsVanishedTrailingDirectories(t *testing.T) {
+	// b/, c/ and e/ vanish between listDir and stat, e/ being the last
+	// entry of the listing and any of them the last of a page.
+	keys := []string{"a", "b/1", "c/1", "d", "e/1"}
+	vanished := map[string]bool{"b/": true, "c/": true, "e/": true, "b/1": true, "c/1": true, "e/1": true}
+	for _, delimiter := range []string{"", "/"} {
+		for _, removed := range []bool{false, true} {
+			current := keys
+			list := func(marker string, maxKeys int) (ListObjectsInfo, []string) {
+				// A fresh tree per page, the walk of the page before may
+				// still be reading its own.
+				tree := newMemBackend(current...)
+				resolver := vanishingResolver{memResolver: memResolver{tree}, deleted: vanished}
+				result, err := ListObjectsWithResolver(context.Background(), "", "", marker, delimiter, maxKeys,
+					nil, tree.ListDir, isLeaf, tree.IsLeafDir, resolver, ListOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				var names []string
+				for _, obj := range result.Objects {
+					names = append(names, obj.Name)
+				}
+				names = append(names, result.Prefixes...)
+				sort.Strings(names)
+				return result, names
+			}
+			_, all := list("", 1000)
+			for maxKeys := 1; maxKeys <= len(keys); maxKeys++ {
+				current = keys
+				var names, firstPage []string
+				var marker string
+				for pages := 0; ; pages++ {
+					if pages > len(keys) {
+						t.Fatalf("%q maxKeys %d: listing does not end, got %v", delimiter, maxKeys, names)
+					}
+					result, page := list(marker, maxKeys)
+					names = append(names, page...)
+					if pages == 0 {
+						firstPage = page
+					}
+					if removed {
+						// Gone from the backend altogether once listed,
+						// the page resumes from a name no longer there.
+						current = []string{"a", "d"}
+					}
+					if !result.IsTruncated {
+						break
+					}
+					checkNextMarker(t, all, marker, page, result.NextMarker)
+					marker = result.NextMarker
+				}
+				expected := all
+				if removed {
+					// The directories past the first page are left out.
+					expected = firstPage
+					for _, name := range all {
+						if name > firstPage[len(firstPage)-1] && !strings.HasSuffix(name, "/") {
+							expected = append(expected, name)
+						}
+					}
+				}
+				if strings.Join(names, ",") != strings.Join(expected, ",") {
+					t.Fatalf("%q removed %v maxKeys %d: expected %v, got %v", delimiter, removed, maxKeys, expected, names)
+				}
+			}
+		}
+	}
+}
+
+// retentionResolver - resolves the objects of a MemBackend under a
+// compliance retention, when requested.
+type retentionResolver struct {
+	memResolver
+	requests int64
+}
+
+var retainUntil = time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func (r *retentionResolver) ResolveObject(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	objInfo, err := r.memResolver.ResolveObject(ctx, bucket, name, info)
+	if RetentionRequested(ctx) {
+		atomic.AddInt64(&r.requests, 1)
+	}
+	objInfo.RetentionMode, objInfo.RetainUntil = "COMPLIANCE", retainUntil
+	return objInfo, err
+}
+
+func TestListObjectsFetchRetention(t *testing.T) {
+	tree := newMemBackend("a/1", "a/2", "b")
+	for _, fetchRetention := range []bool{false, true} {
+		resolver := &retentionResolver{memResolver: memResolver{tree}}
+		for _, delimiter := range []string{"", "/"} {
+			result, err := ListObjectsWithResolver(context.Background(), "", "", "", delimiter, 100,
+				NewTreeWalkPool(time.Minute), tree.ListDir, isLeaf, tree.IsLeafDir, resolver,
+				ListOptions{FetchRetention: fetchRetention})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Objects) == 0 {
+				t.Fatalf("%q: expected objects", delimiter)
+			}
+			for _, obj := range result.Objects {
+				if fetchRetention != (obj.RetentionMode == "COMPLIANCE" && obj.RetainUntil.Equal(retainUntil)) {
+					t.Fatalf("%s: unexpected retention %q %v", obj.Name, obj.RetentionMode, obj.RetainUntil)
+				}
+			}
+		}
+		if fetchRetention != (resolver.requests > 0) {
+			t.Fatalf("expected retention requested %v, got %d requests", fetchRetention, resolver.requests)
+		}
+	}
+}
+
+func TestListObjectsFetchOwner(t *testing.T) {
+	tree := newMemBackend("a/1", "a/2", "b")
+	for _, fetchOwner := range []bool{false, true} {
+		var requests int64
+		// The owner is filled regardless, counting the requests for it.
+		getObjInfo := func(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+			objInfo, err := tree.GetObjectInfo(ctx, bucket, name, info)
+			if OwnerRequested(ctx) {
+				atomic.AddInt64(&requests, 1)
+			}
+			objInfo.Owner = "owner"
+			return objInfo, err
+		}
+		for _, delimiter := range []string{"", "/", "a"} {
+			result, err := ListObjectsWithResolver(context.Background(), "", "", "", delimiter, 100,
+				NewTreeWalkPool(time.Minute), tree.ListDir, isLeaf, tree.IsLeafDir, funcResolver(getObjInfo),
+				ListOptions{FetchOwner: fetchOwner})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Objects) == 0 {
+				t.Fatalf("%q: expected objects", delimiter)
+			}
+			for _, obj := range result.Objects {
+				if fetchOwner != (obj.Owner == "owner") {
+					t.Fatalf("%s: unexpected owner %q", obj.Name, obj.Owner)
+				}
+			}
+		}
+		if fetchOwner != (requests > 0) {
+			t.Fatalf("expected owner requested %v, got %d requests", fetchOwner, requests)
+		}
+	}
+}
+
+func TestListObjectsProjection(t *testing.T) {
+	tree := newMemBackend("a/1", "a/2", "b", "c/")
+	modTime := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	var stats atomic.Int64
+	var requested atomic.Value
+	getObjInfo := func(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+		stats.Add(1)
+		requested.Store(ProjectionRequested(ctx))
+		objInfo, err := tree.GetObjectInfo(ctx, bucket, name, info)
+		objInfo.ModTime, objInfo.ETag = modTime, "etag"
+		objInfo.UserDefined = map[string]string{"k": "v"}
+		return objInfo, err
+	}
+	list := func(projection Projection) ListObjectsInfo {
+		stats.Store(0)
+		result, err := ListObjectsWithResolver(context.Background(), "", "", "", "", 100,
+			nil, tree.ListDir, isLeaf, tree.IsLeafDir, funcResolver(getObjInfo), ListOptions{Projection: projection})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Objects) != 4 {
+			t.Fatalf("%b: expected 4 objects, got %d", projection, len(result.Objects))
+		}
+		return result
+	}
+
+	// The names alone, without a stat of the objects. The empty
+	// directory c/ is resolved as usual.
+	for _, obj := range list(ProjectName).Objects {
+		if !obj.ModTime.IsZero() || obj.Size != 0 || obj.ETag != "" || obj.UserDefined != nil {
+			t.Fatalf("%s: expected the name alone, got %+v", obj.Name, obj)
+		}
+	}
+	if stats.Load() != 1 {
+		t.Fatalf("expected c/ resolved alone, got %d stats", stats.Load())
+	}
+
+	// The fields requested are listed, the resolver is told which.
+	for _, obj := range list(ProjectName | ProjectSize | ProjectETag).Objects {
+		if !obj.ModTime.IsZero() || obj.Size == 0 || obj.ETag != "etag" || obj.UserDefined != nil {
+			t.Fatalf("%s: expected the size and the ETag alone, got %+v", obj.Name, obj)
+		}
+	}
+	if p := requested.Load().(Projection); p.Has(ProjectModTime) || !p.Has(ProjectETag) {
+		t.Fatalf("unexpected projection requested %b", p)
+	}
+
+	// All of them by default.
+	for _, obj := range list(0).Objects {
+		if obj.ModTime != modTime || obj.ETag != "etag" || obj.UserDefined == nil {
+			t.Fatalf("%s: expected all the fields, got %+v", obj.Name, obj)
+		}
+	}
+	if p := requested.Load().(Projection); p != 0 || !p.Has(ProjectMetadata) {
+		t.Fatalf("unexpected projection requested %b", p)
+	}
+}
+
+// delayingResolver - resolves the objects of a MemBackend, each one after
+// its own delay.
+type delayingResolver struct {
+	memResolver
+	delays map[string]time.Duration
+}
+
+func (r delayingResolver) ResolveObject(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	time.Sleep(r.delays[name])
+	return r.memResolver.ResolveObject(ctx, bucket, name, info)
+}
+
+func (r delayingResolver) ResolveDir(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	time.Sleep(r.delays[name])
+	return r.memResolver.ResolveDir(ctx, bucket, name, info)
+}
+
+func TestListObjectsResolvedOutOfOrder(t *testing.T) {
+	// Directories and objects interleaved, the later the name the faster
+	// it resolves.
+	var keys, names []string
+	for i := 0; i < 20; i++ {
+		keys = append(keys, fmt.Sprintf("d%02d/1", i), fmt.Sprintf("k%02d", i))
+		names = append(names, fmt.Sprintf("d%02d/", i), fmt.Sprintf("k%02d", i))
+	}
+	tree := newMemBackend(keys...)
+	resolver := delayingResolver{memResolver: memResolver{tree}, delays: make(map[string]time.Duration)}
+	for i, name := range names {
+		resolver.delays[name] = time.Duration(len(names)-i) * 100 * time.Microsecond
+	}
+
+	for _, delimiter := range []string{"/", ""} {
+		var marker string
+		for {
+			result, err := ListObjectsWithResolver(context.Background(), "", "", marker, delimiter, 15,
+				nil, tree.ListDir, isLeaf, tree.IsLeafDir, resolver, ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			last := marker
+			for _, obj := range result.Objects {
+				if obj.Name <= last {
+					t.Fatalf("delimiter %q: %s listed after %s", delimiter, obj.Name, last)
+				}
+				last = obj.Name
+			}
+			greatest := last
+			last = marker
+			for _, prefix := range result.Prefixes {
+				if prefix <= last {
+					t.Fatalf("delimiter %q: %s listed after %s", delimiter, prefix, last)
+				}
+				last = prefix
+			}
+			if last > greatest {
+				greatest = last
+			}
+			if !result.IsTruncated {
+				break
+			}
+			if result.NextMarker != greatest {
+				t.Fatalf("delimiter %q: expected NextMarker %s, got %s", delimiter, greatest, result.NextMarker)
+			}
+			marker = result.NextMarker
+		}
+	}
+}
+
+func TestListObjectsStorageClass(t *testing.T) {
+	tree := newMemBackend("a", "b", "c/1", "d/", "e")
+	getObjInfo := func(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+		if name == "d/" {
+			// Vanished, listed as a plain directory.
+			return ObjectInfo{StorageClass: "GLACIER"}, syscall.ENOENT
+		}
+		objInfo, err := tree.GetObjectInfo(ctx, bucket, name, info)
+		if name == "b" || name == "c/1" {
+			objInfo.StorageClass = "GLACIER"
+		}
+		return objInfo, err
+	}
+
+	result, err := ListObjects(context.Background(), "", "", "", "", 100,
+		nil, tree.ListDir, isLeaf, tree.IsLeafDir, getObjInfo, getObjInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var classes []string
+	for _, obj := range result.Objects {
+		classes = append(classes, obj.Name+":"+obj.StorageClass)
+	}
+	if fmt.Sprint(classes) != "[a: b:GLACIER c/1:GLACIER d/: e:]" {
+		t.Fatalf("unexpected storage classes %v", classes)
+	}
+}
+
+func TestListObjectsRestoreStatus(t *testing.T) {
+	tree := newMemBackend("a", "b", "c/1", "d")
+	restoreExpires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	// a is being restored, c/1 restored until restoreExpires.
+	getObjInfo := func(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+		objInfo, err := tree.GetObjectInfo(ctx, bucket, name, info)
+		switch name {
+		case "a":
+			objInfo.StorageClass, objInfo.RestoreOngoing = "GLACIER", true
+		case "c/1":
+			objInfo.StorageClass, objInfo.RestoreExpires = "DEEP_ARCHIVE", restoreExpires
+		}
+		return objInfo, err
+	}
+
+	for _, testCase := range []struct{ prefix, delimiter string }{{"", ""}, {"", "/"}, {"c/", "/"}} {
+		delimiter := testCase.delimiter
+		result, err := ListObjects(context.Background(), "", testCase.prefix, "", delimiter, 100,
+			nil, tree.ListDir, isLeaf, tree.IsLeafDir, getObjInfo, getObjInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Objects) == 0 {
+			t.Fatalf("%q: expected objects under %q", delimiter, testCase.prefix)
+		}
+		for _, obj := range result.Objects {
+			var expected ObjectInfo
+			switch obj.Name {
+			case "a":
+				expected.StorageClass, expected.RestoreOngoing = "GLACIER", true
+			case "c/1":
+				expected.StorageClass, expected.RestoreExpires = "DEEP_ARCHIVE", restoreExpires
+			}
+			if obj.StorageClass != expected.StorageClass || obj.RestoreOngoing != expected.RestoreOngoing ||
+				!obj.RestoreExpires.Equal(expected.RestoreExpires) {
+				t.Fatalf("%q: %s: unexpected status %q %v %v", delimiter, obj.Name, obj.StorageClass, obj.RestoreOngoing, obj.RestoreExpires)
+			}
+		}
+	}
+}
+
+func TestListObjectsStatTimeout(t *testing.T) {
+	// The stat of b hangs until the test ends, ignoring its context.
+	tree := newMemBackend("a", "b", "c")
+	hang := make(chan struct{})
+	defer close(hang)
+	resolver := funcResolver(func(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+		if name == "b" {
+			<-hang
+		}
+		return tree.GetObjectInfo(ctx, bucket, name, info)
+	})
+	list := func(opts ListOptions) (ListObjectsInfo, error) {
+		opts.StatTimeout = 50 * time.Millisecond
+		done := make(chan struct{})
+		var result ListObjectsInfo
+		var err error
+		go func() {
+			defer close(done)
+			result, err = ListObjectsWithResolver(context.Background(), "", "", "", "", 10,
+				nil, tree.ListDir, isLeaf, tree.IsLeafDir, resolver, opts)
+		}()
+		select {
+		case <-done:
+			return result, err
+		case <-time.After(5 * time.Second):
+			t.Fatal("listing hangs on the stat")
+		}
+		return result, err
+	}
+
+	result, err := list(ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, obj := range result.Objects {
+		names = append(names, obj.Name)
+	}
+	if fmt.Sprint(names) != "[a c]" {
+		t.Fatalf("expected [a c], got %v", names)
+	}
+
+	if _, err = list(ListOptions{StatTimeoutFatal: true}); !errors.Is(err, ErrStatTimeout) {
+		t.Fatalf("expected ErrStatTimeout, got %v", err)
+	}
+}
+
+// fileSys - backend specific details of a listed file.
+type fileSys struct {
+	nlink, inode uint64
+}
+
+func TestListObjectsSysPassthrough(t *testing.T) {
+	backend := NewMemBackend(ObjectInfo{Name: "a"}, ObjectInfo{Name: "b", Sys: "resolved"},
+		ObjectInfo{Name: "d/1"}, ObjectInfo{Name: "e/"})
+	listBackend := backend.ListBackend(nil)
+	// The details are listed with the entries and dropped by the resolver.
+	listBackend.ListDir = func(bucket, prefixDir, prefixEntry string) (bool, []*Entry, bool) {
+		emptyDir, entries, delayIsLeaf := backend.ListDir(bucket, prefixDir, prefixEntry)
+		for _, entry := range entries {
+			entry.Info.Sys = &fileSys{nlink: 1, inode: uint64(len(prefixDir + entry.Name))}
+		}
+		return emptyDir, entries, delayIsLeaf
+	}
+	for _, delimiter := range []string{"", "/"} {
+		result, err := ListObjectsWithOptions(context.Background(), "bucket", "",
+			ListOptions{Delimiter: delimiter}, listBackend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Objects) == 0 {
+			t.Fatalf("%q: expected objects", delimiter)
+		}
+		for _, obj := range result.Objects {
+			switch sys := obj.Sys.(type) {
+			case *fileSys:
+				if sys.nlink != 1 || sys.inode != uint64(len(obj.Name)) {
+					t.Fatalf("%q: %s: unexpected details %+v", delimiter, obj.Name, sys)
+				}
+			case string:
+				// Set by the resolver, which takes precedence.
+				if obj.Name != "b" || sys != "resolved" {
+					t.Fatalf("%q: %s: unexpected details %q", delimiter, obj.Name, sys)
+				}
+			default:
+				t.Fatalf("%q: %s: expected the listed details, got %v", delimiter, obj.Name, obj.Sys)
+			}
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/zhaohuxing/s3/cmd"
+)
+
+// listAllPages - lists every page under prefix calling between() after
+// each truncated page, returns the names of all objects and prefixes.
+func listAllPages(t *testing.T, tpool *TreeWalkPool, prefix, delimiter string, maxKeys int, between func()) []string {
+	t.Helper()
+	var names []string
+	var marker string
+	for {
+		result, err := ListObjects(context.Background(), "", prefix, marker, delimiter, maxKeys,
+			tpool, listDirFactory(), isLeaf, isLeafDir, getObjectInfo, getObjectInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, obj := range result.Objects {
+			names = append(names, obj.Name)
+		}
+		names = append(names, result.Prefixes...)
+		if !result.IsTruncated {
+			return names
+		}
+		marker = result.NextMarker
+		between()
+	}
+}
+
+func TestTreeWalkPoolExpiryResume(t *testing.T) {
+	testCases := []struct {
+		prefix    string
+		delimiter string
+	}{
+		{"a1/", ""},
+		{"b2/a", ""},
+		{"c3/c", "/"},
+		{"a1/", "/"},
+	}
+	for _, testCase := range testCases {
+		expected := listAllPages(t, NewTreeWalkPool(time.Minute), testCase.prefix, testCase.delimiter, 100000, func() {})
+
+		// Ask for the next page around the time the parked walker
+		// expires, so that pages race with the expiry as well.
+		timeout := time.Millisecond
+		var page int
+		got := listAllPages(t, NewTreeWalkPool(timeout), testCase.prefix, testCase.delimiter, 5, func() {
+			page++
+			time.Sleep(time.Duration(page%4) * timeout / 2)
+		})
+
+		seen := make(map[string]bool, len(got))
+		for _, name := range got {
+			if seen[name] {
+				t.Fatalf("%+v: %s listed twice", testCase, name)
+			}
+			seen[name] = true
+		}
+		if len(got) != len(expected) {
+			t.Fatalf("%+v: expected %d entries, got %d", testCase, len(expected), len(got))
+		}
+		for _, name := range expected {
+			if !seen[name] {
+				t.Fatalf("%+v: %s skipped", testCase, name)
+			}
+		}
+	}
+}
+
+// failingResolver - resolves the objects of a MemBackend, failing on one.
+type failingResolver struct {
+	memResolver
+	name string
+}
+
+var errResolve = errors.New("resolve failed")
+
+func (r failingResolver) ResolveObject(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	if name == r.name {
+		return ObjectInfo{}, errResolve
+	}
+	return r.memResolver.ResolveObject(ctx, bucket, name, info)
+}
+
+// waitGoroutines - waits for the number of goroutines to drop to n.
+func waitGoroutines(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d goroutines, %d are lingering", n, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTreeWalkEndsWhenNotPooled(t *testing.T) {
+	// More keys than the walk buffers, the walk blocks unless ended.
+	tree := wideMemBackend(200, 500) // 100000 keys
+	baseline := runtime.NumGoroutine()
+
+	// Failing mid-page.
+	pool := NewTreeWalkPool(time.Hour)
+	resolver := failingResolver{memResolver: memResolver{tree}, name: "d001/f000"}
+	_, err := ListObjectsWithResolver(context.Background(), "", "", "", "", 45000,
+		pool, tree.ListDir, isLeaf, tree.IsLeafDir, resolver, ListOptions{})
+	if !errors.Is(err, errResolve) {
+		t.Fatalf("expected errResolve, got %v", err)
+	}
+	waitGoroutines(t, baseline)
+
+	// Truncated pages without a pool.
+	keys, _, _, truncated, err := ListKeys(context.Background(), "", "", "", "", 10, tree.ListDir, isLeaf, tree.IsLeafDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 10 || !truncated {
+		t.Fatalf("expected a truncated page of 10 keys, got %d", len(keys))
+	}
+	waitGoroutines(t, baseline)
+}
+
+func TestListObjectsNilPool(t *testing.T) {
+	tree := newMemBackend("a/1", "a/2", "b", "c/d/1", "c/e", "f/")
+	for _, delimiter := range []string{"", "/", "d"} {
+		pooled := NewTreeWalkPool(time.Hour)
+		list := func(tpool *TreeWalkPool) []string {
+			return listNames(t, func(marker string) (ListObjectsInfo, error) {
+				return listMem(tree, "", marker, delimiter, 1, tpool, ListOptions{})
+			})
+		}
+		if expected, names := list(pooled), list(nil); strings.Join(names, ",") != strings.Join(expected, ",") {
+			t.Fatalf("%q: expected %v without a pool, got %v", delimiter, expected, names)
+		}
+	}
+
+	// The walks of truncated pages are ended rather than parked, even
+	// blocked on more keys than they buffer.
+	tree = wideMemBackend(200, 500) // 100000 keys
+	baseline := runtime.NumGoroutine()
+	for _, delimiter := range []string{"", "/"} {
+		result, err := listMem(tree, "", "", delimiter, 10, nil, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.IsTruncated {
+			t.Fatalf("%q: expected a truncated page", delimiter)
+		}
+	}
+	waitGoroutines(t, baseline)
+}
+
+func TestTreeWalkPoolWalkOptions(t *testing.T) {
+	tree := newMemBackend("a/1", "b/1", "c/1")
+	pool := NewTreeWalkPool(time.Hour)
+	result, err := listMem(tree, "", "", "", 1, pool, ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.IsTruncated {
+		t.Fatal("expected a truncated page")
+	}
+
+	// The walk parked by the first page does not exclude b/.
+	opts := ListOptions{WalkOptions: WalkOptions{ExcludePrefixes: []string{"b/"}}}
+	result, err = listMem(tree, "", result.NextMarker, "", 10, pool, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Objects) != 1 || result.Objects[0].Name != "c/1" {
+		t.Fatalf("expected c/1 alone, got %+v", result.Objects)
+	}
+
+	// Walks reporting their progress are not parked.
+	baseline := runtime.NumGoroutine()
+	opts = ListOptions{WalkOptions: WalkOptions{Progress: &WalkProgress{}}}
+	if _, err = listMem(tree, "", "", "", 1, NewTreeWalkPool(time.Hour), opts); err != nil {
+		t.Fatal(err)
+	}
+	waitGoroutines(t, baseline)
+}
+
+func TestTreeWalkPoolActiveParams(t *testing.T) {
+	tpool := NewTreeWalkPool(time.Minute)
+	if params := tpool.ActiveParams(); len(params) != 0 {
+		t.Fatalf("expected no walks, got %v", params)
+	}
+	for _, prefix := range []string{"b1/", "a1/"} {
+		result, err := ListObjects(context.Background(), "", prefix, "", "", 1,
+			tpool, listDirFactory(), isLeaf, isLeafDir, getObjectInfo, getObjectInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.IsTruncated {
+			t.Fatalf("%s: expected a truncated page", prefix)
+		}
+	}
+
+	params := tpool.ActiveParams()
+	if len(params) != 2 {
+		t.Fatalf("expected two walks, got %v", params)
+	}
+	for i, prefix := range []string{"a1/", "b1/"} {
+		if params[i].Prefix() != prefix || !params[i].Recursive() || !strings.HasPrefix(params[i].Marker(), prefix) {
+			t.Fatalf("expected the walk of %s, got %v", prefix, params[i])
+		}
+	}
+
+	// The snapshot does not follow the pool.
+	_, endWalkCh := tpool.Release(params[0])
+	close(endWalkCh)
+	if len(params) != 2 || len(tpool.ActiveParams()) != 1 {
+		t.Fatalf("expected a snapshot, got %v then %v", params, tpool.ActiveParams())
+	}
+}
+
+func TestTreeWalkPoolDelimiterSwitch(t *testing.T) {
+	for _, delimiters := range [][2]string{{"", "/"}, {"/", ""}} {
+		first, then := delimiters[0], delimiters[1]
+		tpool := NewTreeWalkPool(time.Minute)
+		result, err := ListObjects(context.Background(), "", "", "", first, 5,
+			tpool, listDirFactory(), isLeaf, isLeafDir, getObjectInfo, getObjectInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.IsTruncated {
+			t.Fatalf("%q: expected a truncated page", first)
+		}
+
+		// The walk parked for the first delimiter is not resumed with
+		// the other one, the pages go on as if listed afresh.
+		list := func(tpool *TreeWalkPool) []string {
+			return listNames(t, func(marker string) (ListObjectsInfo, error) {
+				if marker == "" {
+					marker = result.NextMarker
+				}
+				return ListObjects(context.Background(), "", "", marker, then, 200,
+					tpool, listDirFactory(), isLeaf, isLeafDir, getObjectInfo, getObjectInfo)
+			})
+		}
+		expected := list(nil)
+		if got := list(tpool); !reflect.DeepEqual(got, expected) {
+			t.Fatalf("%q then %q: expected %v, got %v", first, then, expected, got)
+		}
+		for _, params := range tpool.ActiveParams() {
+			if params.Recursive() == (first == "") {
+				t.Fatalf("%q then %q: expected the walk of %q to end, got %v", first, then, first, params)
+			}
+		}
+	}
+}
+
+func TestTreeWalkPoolEvict(t *testing.T) {
+	// More keys than the walk buffers, the walks block until ended.
+	tree := wideMemBackend(200, 500)
+	baseline := runtime.NumGoroutine()
+	pool := NewTreeWalkPool(time.Hour)
+	for i := 0; i < 2; i++ {
+		result, err := ListObjectsWithResolver(context.Background(), "", "", "", "", 10,
+			pool, tree.ListDir, isLeaf, tree.IsLeafDir, memResolver{tree}, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.IsTruncated {
+			t.Fatal("expected a truncated page")
+		}
+	}
+	params := pool.ActiveParams()
+	if len(params) != 1 {
+		t.Fatalf("expected both walks parked under the same params, got %v", params)
+	}
+	parked := runtime.NumGoroutine()
+
+	// One walk at a time, the oldest first.
+	if !pool.Evict(params[0]) {
+		t.Fatal("expected a walk to be evicted")
+	}
+	waitGoroutines(t, baseline+(parked-baseline)/2)
+	if len(pool.ActiveParams()) != 1 {
+		t.Fatal("expected the other walk to be parked still")
+	}
+	if !pool.Evict(params[0]) {
+		t.Fatal("expected the other walk to be evicted")
+	}
+	if pool.Evict(params[0]) {
+		t.Fatal("expected no walk left to evict")
+	}
+	waitGoroutines(t, baseline)
+}
+
+func TestTreeWalkPoolInspect(t *testing.T) {
+	tpool := NewTreeWalkPool(time.Minute)
+	if walkers := tpool.Inspect(); len(walkers) != 0 {
+		t.Fatalf("expected no walkers, got %+v", walkers)
+	}
+	result, err := ListObjects(context.Background(), "", "b1/", "", "/", 1,
+		tpool, listDirFactory(), isLeaf, isLeafDir, getObjectInfo, getObjectInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.IsTruncated {
+		t.Fatal("expected a truncated page")
+	}
+	time.Sleep(time.Millisecond)
+
+	walkers := tpool.Inspect()
+	expected := WalkerInfo{Prefix: "b1/", Marker: result.NextMarker}
+	if len(walkers) != 1 || walkers[0].Age <= 0 {
+		t.Fatalf("expected a walker parked for a while, got %+v", walkers)
+	}
+	if walkers[0].Age = 0; walkers[0] != expected {
+		t.Fatalf("expected %+v, got %+v", expected, walkers[0])
+	}
+}
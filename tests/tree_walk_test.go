@@ -0,0 +1,1293 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/zhaohuxing/s3/cmd"
+	"golang.org/x/time/rate"
+)
+
+// recordingListDir - wraps listDir recording the directories listed.
+func recordingListDir(listDir ListDirFunc) (ListDirFunc, func() []string) {
+	var mu sync.Mutex
+	var dirs []string
+	return func(bucket, prefixDir, prefixEntry string) (bool, []*Entry, bool) {
+			mu.Lock()
+			dirs = append(dirs, prefixDir)
+			mu.Unlock()
+			return listDir(bucket, prefixDir, prefixEntry)
+		}, func() []string {
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]string(nil), dirs...)
+		}
+}
+
+func TestWalkExcludePrefixes(t *testing.T) {
+	listDir, listedDirs := recordingListDir(listDirFactory())
+	opts := ListOptions{WalkOptions: WalkOptions{ExcludePrefixes: []string{"b1/"}}}
+	result, err := ListObjectsWithResolver(context.Background(), "", "", "", "", 10000,
+		NewTreeWalkPool(time.Minute), listDir, isLeaf, isLeafDir,
+		&splitResolver{}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := make(map[string]int)
+	for _, obj := range result.Objects {
+		found[strings.SplitN(obj.Name, "/", 2)[0]]++
+	}
+	if found["b1"] != 0 {
+		t.Fatalf("expected nothing under b1/, got %d objects", found["b1"])
+	}
+	if found["a1"] == 0 || found["c1"] == 0 {
+		t.Fatalf("expected objects under a1/ and c1/, got %v", found)
+	}
+	// Excluded subtrees are not walked at all.
+	for _, dir := range listedDirs() {
+		if strings.HasPrefix(dir, "b1/") {
+			t.Fatalf("excluded directory %s was listed", dir)
+		}
+	}
+}
+
+// listNames - lists all the pages, returning the object names and prefixes in order.
+func listNames(t testing.TB, list func(marker string) (ListObjectsInfo, error)) []string {
+	t.Helper()
+	var names []string
+	var marker string
+	for {
+		result, err := list(marker)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, obj := range result.Objects {
+			names = append(names, obj.Name)
+		}
+		names = append(names, result.Prefixes...)
+		if !result.IsTruncated {
+			return names
+		}
+		marker = result.NextMarker
+	}
+}
+
+// checkNextMarker - checks the page listed after marker is resumed from
+// its NextMarker without listing its names again nor skipping any of
+// all, the sorted names of the whole listing: NextMarker is at or past
+// the names of the page and ahead of the next name of all.
+func checkNextMarker(t testing.TB, all []string, marker string, page []string, nextMarker string) {
+	t.Helper()
+	last := marker
+	for _, name := range page {
+		if name > last {
+			last = name
+		}
+	}
+	if nextMarker < last {
+		t.Fatalf("marker %q: NextMarker %q is ahead of %q listed on the page", marker, nextMarker, last)
+	}
+	i := sort.Search(len(all), func(i int) bool { return all[i] > last })
+	if i < len(all) && all[i] <= nextMarker {
+		t.Fatalf("marker %q: NextMarker %q skips %q", marker, nextMarker, all[i])
+	}
+}
+
+func TestWalkParallelSubtreesOrder(t *testing.T) {
+	tree := newMemBackend(
+		"a/1", "a/b/1", "a/b/c/1", "a/b/c/2", "a/b/d/", "a/e/1",
+		"b/", "c", "d/1", "d/2/3/4/5", "d/2/3/6", "e/f/g", "z",
+	)
+	trees := []*MemBackend{tree, wideMemBackend(40, 5)}
+	for _, tree := range trees {
+		for _, maxKeys := range []int{1000, 3} {
+			for _, prefix := range []string{"", "a", "d/"} {
+				list := func(opts ListOptions) []string {
+					tpool := NewTreeWalkPool(time.Minute)
+					return listNames(t, func(marker string) (ListObjectsInfo, error) {
+						return listMem(tree, prefix, marker, "", maxKeys, tpool, opts)
+					})
+				}
+				serial := list(ListOptions{})
+				parallel := list(ListOptions{WalkOptions: WalkOptions{ParallelSubtrees: 4}})
+				if strings.Join(serial, ",") != strings.Join(parallel, ",") {
+					t.Fatalf("prefix %q maxKeys %d: parallel walk differs\n%v\n%v", prefix, maxKeys, serial, parallel)
+				}
+			}
+		}
+	}
+
+	// Over the testdata as well.
+	list := func(opts ListOptions) []string {
+		tpool := NewTreeWalkPool(time.Minute)
+		return listNames(t, func(marker string) (ListObjectsInfo, error) {
+			return ListObjectsWithResolver(context.Background(), "", "", marker, "", 500,
+				tpool, listDirFactory(), isLeaf, isLeafDir, &splitResolver{}, opts)
+		})
+	}
+	serial := list(ListOptions{})
+	parallel := list(ListOptions{WalkOptions: WalkOptions{ParallelSubtrees: 8}})
+	if strings.Join(serial, ",") != strings.Join(parallel, ",") {
+		t.Fatal("parallel walk over testdata differs")
+	}
+}
+
+func BenchmarkWalkParallelSubtrees(b *testing.B) {
+	tree := wideMemBackend(64, 4)
+	listDir := slowListDir(tree, 200*time.Microsecond)
+	for _, workers := range []int{0, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			opts := ListOptions{WalkOptions: WalkOptions{ParallelSubtrees: workers}}
+			for i := 0; i < b.N; i++ {
+				_, err := ListObjectsWithResolver(context.Background(), "", "", "", "", 1000,
+					NewTreeWalkPool(time.Minute), listDir, tree.IsLeaf, tree.IsLeafDir, memResolver{tree}, opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestWalkSeparator(t *testing.T) {
+	tree := newMemBackend(`a\1`, `a\b\2`, `a\b\c\`, `a\d\3`, `e`)
+	tree.Separator = `\`
+	opts := ListOptions{WalkOptions: WalkOptions{Separator: `\`}}
+
+	testCases := []struct {
+		prefix    string
+		delimiter string
+		expected  []string
+	}{
+		{"", "", []string{"a/1", "a/b/2", "a/b/c/", "a/d/3", "e"}},
+		{"a/b/", "", []string{"a/b/2", "a/b/c/"}},
+		{"", "/", []string{"a/", "e"}},
+		{"a/", "/", []string{"a/1", "a/b/", "a/d/"}},
+	}
+	for _, testCase := range testCases {
+		for _, maxKeys := range []int{1000, 1} {
+			tpool := NewTreeWalkPool(time.Minute)
+			names := listNames(t, func(marker string) (ListObjectsInfo, error) {
+				return listMem(tree, testCase.prefix, marker, testCase.delimiter, maxKeys, tpool, opts)
+			})
+			sort.Strings(names)
+			if strings.Join(names, ",") != strings.Join(testCase.expected, ",") {
+				t.Fatalf("prefix %q delimiter %q: expected %v, got %v", testCase.prefix, testCase.delimiter, testCase.expected, names)
+			}
+		}
+	}
+}
+
+// rewrittenResolver - resolves the objects of b by the keys the walk
+// rewrote, renamed back with unrewrite.
+func rewrittenResolver(b *MemBackend, unrewrite func(name string) string) InfoResolver {
+	return funcResolver(func(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+		objInfo, err := b.GetObjectInfo(ctx, bucket, unrewrite(name), info)
+		objInfo.Name = name
+		return objInfo, err
+	})
+}
+
+func TestWalkRewrite(t *testing.T) {
+	tree := newMemBackend("t42/a", "t42/b/1", "t42/b/c/", "t42/d", "t7/x")
+	opts := ListOptions{WalkOptions: WalkOptions{
+		Rewrite:   func(name string) string { return strings.TrimPrefix(name, "t42/") },
+		Unrewrite: func(name string) string { return "t42/" + name },
+	}}
+	resolver := rewrittenResolver(tree, opts.Unrewrite)
+
+	testCases := []struct {
+		prefix    string
+		delimiter string
+		expected  []string
+	}{
+		{"", "", []string{"a", "b/1", "b/c/", "d"}},
+		{"b/", "", []string{"b/1", "b/c/"}},
+		{"", "/", []string{"a", "b/", "d"}},
+		{"b", "/", []string{"b/"}},
+		{"a", "", []string{"a"}},
+	}
+	for _, testCase := range testCases {
+		for _, maxKeys := range []int{1000, 1} {
+			names := listNames(t, func(marker string) (ListObjectsInfo, error) {
+				return ListObjectsWithResolver(context.Background(), "", testCase.prefix, marker, testCase.delimiter, maxKeys,
+					nil, tree.ListDir, tree.IsLeaf, tree.IsLeafDir, resolver, opts)
+			})
+			sort.Strings(names)
+			if strings.Join(names, ",") != strings.Join(testCase.expected, ",") {
+				t.Fatalf("prefix %q delimiter %q maxKeys %d: expected %v, got %v", testCase.prefix, testCase.delimiter, maxKeys, testCase.expected, names)
+			}
+		}
+	}
+}
+
+func TestWalkSeparatorRewritePrefix(t *testing.T) {
+	// The tenant prefix is joined to the keys without a separator, the
+	// prefixes of the listing which are not directories are matched once
+	// renamed back and translated to the backend.
+	tree := newMemBackend(`t42-a\1`, `t42-a\b\2`, `t42-a\bc`, `t42-ab`, `t7-x`)
+	tree.Separator = `\`
+	opts := ListOptions{WalkOptions: WalkOptions{
+		Separator: `\`,
+		Rewrite:   func(name string) string { return strings.TrimPrefix(name, "t42-") },
+		Unrewrite: func(name string) string { return "t42-" + name },
+	}}
+	resolver := rewrittenResolver(tree, opts.Unrewrite)
+
+	testCases := []struct {
+		prefix    string
+		delimiter string
+		expected  []string
+	}{
+		{"a", "", []string{"a/1", "a/b/2", "a/bc", "ab"}},
+		{"a", "/", []string{"a/", "ab"}},
+		{"a/b", "", []string{"a/b/2", "a/bc"}},
+		{"a/b", "/", []string{"a/b/", "a/bc"}},
+		{"ab", "", []string{"ab"}},
+	}
+	for _, testCase := range testCases {
+		for _, maxKeys := range []int{1000, 1} {
+			for _, tpool := range []*TreeWalkPool{nil, NewTreeWalkPool(time.Minute)} {
+				names := listNames(t, func(marker string) (ListObjectsInfo, error) {
+					return ListObjectsWithResolver(context.Background(), "", testCase.prefix, marker, testCase.delimiter, maxKeys,
+						tpool, tree.ListDir, tree.IsLeaf, tree.IsLeafDir, resolver, opts)
+				})
+				sort.Strings(names)
+				if strings.Join(names, ",") != strings.Join(testCase.expected, ",") {
+					t.Fatalf("prefix %q delimiter %q maxKeys %d: expected %v, got %v", testCase.prefix, testCase.delimiter, maxKeys, testCase.expected, names)
+				}
+			}
+		}
+
+		// Recursive walks resumed from cursors start right in the
+		// directory of the marker.
+		if testCase.delimiter != "" {
+			continue
+		}
+		var names []string
+		var cursor string
+		for {
+			result, nextCursor, err := ListObjectsWithCursor(context.Background(), "", testCase.prefix, cursor, "", 1,
+				nil, tree.ListDir, tree.IsLeaf, tree.IsLeafDir, resolver, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, obj := range result.Objects {
+				names = append(names, obj.Name)
+			}
+			if cursor = nextCursor; cursor == "" {
+				break
+			}
+		}
+		if strings.Join(names, ",") != strings.Join(testCase.expected, ",") {
+			t.Fatalf("prefix %q from cursors: expected %v, got %v", testCase.prefix, testCase.expected, names)
+		}
+	}
+}
+
+func TestWalkLeadingSeparators(t *testing.T) {
+	for _, sep := range []string{"/", `\`} {
+		tree := newMemBackend("a1/1.txt", "a1/b/2.txt", "a1/b/c/", "d")
+		if sep != "/" {
+			tree = newMemBackend(`a1\1.txt`, `a1\b\2.txt`, `a1\b\c\`, `d`)
+			tree.Separator = sep
+		}
+		// The backend prefixes the entry names with separators.
+		listDir := func(bucket, prefixDir, prefixEntry string) (bool, []*Entry, bool) {
+			emptyDir, entries, delayIsLeaf := tree.ListDir(bucket, prefixDir, prefixEntry)
+			for i, entry := range entries {
+				entry.Name = strings.Repeat(sep, i%2+1) + entry.Name
+			}
+			return emptyDir, entries, delayIsLeaf
+		}
+		opts := ListOptions{WalkOptions: WalkOptions{Separator: sep}}
+
+		testCases := []struct {
+			prefix    string
+			delimiter string
+			expected  string
+		}{
+			{"", "", "a1/1.txt,a1/b/2.txt,a1/b/c/,d"},
+			{"a1/", "", "a1/1.txt,a1/b/2.txt,a1/b/c/"},
+			{"", "/", "d,a1/"},
+			{"a1/", "/", "a1/1.txt,a1/b/"},
+		}
+		for _, testCase := range testCases {
+			for _, maxKeys := range []int{1000, 1} {
+				pool := NewTreeWalkPool(time.Minute)
+				names := listNames(t, func(marker string) (ListObjectsInfo, error) {
+					return ListObjectsWithResolver(context.Background(), "", testCase.prefix, marker, testCase.delimiter, maxKeys,
+						pool, listDir, tree.IsLeaf, tree.IsLeafDir, memResolver{tree}, opts)
+				})
+				if maxKeys == 1 {
+					sort.Strings(names)
+					expected := strings.Split(testCase.expected, ",")
+					sort.Strings(expected)
+					testCase.expected = strings.Join(expected, ",")
+				}
+				if strings.Join(names, ",") != testCase.expected {
+					t.Fatalf("%q prefix %q delimiter %q: expected %s, got %v", sep, testCase.prefix, testCase.delimiter, testCase.expected, names)
+				}
+			}
+		}
+	}
+}
+
+func TestWalkParallelSubtreesMarkers(t *testing.T) {
+	tree := newMemBackend(
+		"a.txt", "a/1", "a/b/1", "a/b/c/1", "a/b/c/2", "a/b/d/", "a/b/e", "a/e/1", "a0",
+		"b/", "c", "d/1", "d/2/3/4/5", "d/2/3/6", "d/2/7", "e/f/g", "z",
+	)
+	listDir := slowListDir(tree, 50*time.Microsecond)
+	list := func(marker string, maxKeys int, opts ListOptions) (ListObjectsInfo, error) {
+		return ListObjectsWithResolver(context.Background(), "", "", marker, "", maxKeys,
+			NewTreeWalkPool(time.Minute), listDir, tree.IsLeaf, tree.IsLeafDir, memResolver{tree}, opts)
+	}
+	// Resume from every key, the pages must match the serial walk.
+	for _, marker := range append([]string{""}, tree.Keys()...) {
+		for _, maxKeys := range []int{1, 4, 100} {
+			serial, err := list(marker, maxKeys, ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := ListOptions{WalkOptions: WalkOptions{ParallelSubtrees: 3}}
+			parallel, err := list(marker, maxKeys, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(serial) != fmt.Sprint(parallel) {
+				t.Fatalf("marker %q maxKeys %d: parallel walk differs\n%+v\n%+v", marker, maxKeys, serial, parallel)
+			}
+		}
+	}
+}
+
+// deepMemBackend - a tree of the given fan out and depth, with files
+// objects in every directory.
+func deepMemBackend(fanOut, depth, files int) *MemBackend {
+	var keys []string
+	var gen func(dir string, depth int)
+	gen = func(dir string, depth int) {
+		for j := 0; j < files; j++ {
+			keys = append(keys, fmt.Sprintf("%sf%03d", dir, j))
+		}
+		if depth == 0 {
+			return
+		}
+		for i := 0; i < fanOut; i++ {
+			gen(fmt.Sprintf("%sd%03d/", dir, i), depth-1)
+		}
+	}
+	gen("", depth)
+	return newMemBackend(keys...)
+}
+
+func BenchmarkWalkParallelSubtreesDeep(b *testing.B) {
+	tree := deepMemBackend(6, 3, 2)
+	listDir := slowListDir(tree, 200*time.Microsecond)
+	for _, workers := range []int{0, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			opts := ListOptions{WalkOptions: WalkOptions{ParallelSubtrees: workers}}
+			for i := 0; i < b.N; i++ {
+				_, err := ListObjectsWithResolver(context.Background(), "", "", "", "", 10000,
+					NewTreeWalkPool(time.Minute), listDir, tree.IsLeaf, tree.IsLeafDir, memResolver{tree}, opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestWalkMaxEntriesPerDir(t *testing.T) {
+	var keys []string
+	for i := 0; i < 50; i++ {
+		keys = append(keys, fmt.Sprintf("big/%03d", i), fmt.Sprintf("small/%03d", i%5))
+	}
+	tree := newMemBackend(keys...)
+	opts := ListOptions{WalkOptions: WalkOptions{MaxEntriesPerDir: 10}}
+
+	_, err := listMem(tree, "big/", "", "", 100, NewTreeWalkPool(time.Minute), opts)
+	if !errors.Is(err, ErrDirTooLarge) {
+		t.Fatalf("expected ErrDirTooLarge, got %v", err)
+	}
+	result, err := listMem(tree, "small/", "", "", 100, NewTreeWalkPool(time.Minute), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Objects) != 5 {
+		t.Fatalf("expected 5 objects, got %d", len(result.Objects))
+	}
+
+	// The backend gives up before sorting the directory.
+	filter := FilterOptions{MaxEntries: 10}
+	_, err = ListObjectsWithResolver(context.Background(), "", "big/", "", "", 100,
+		NewTreeWalkPool(time.Minute), filteredListDir(tree, filter), tree.IsLeaf, tree.IsLeafDir, memResolver{tree}, opts)
+	if !errors.Is(err, ErrDirTooLarge) {
+		t.Fatalf("expected ErrDirTooLarge, got %v", err)
+	}
+	var entries []*Entry
+	for i := 49; i >= 0; i-- {
+		entries = append(entries, &Entry{Name: fmt.Sprintf("%03d", i)})
+	}
+	filtered, _ := FilterListEntriesWithOptions("", "big/", entries, "", isLeaf, filter)
+	if names := listEntryNames(filtered); names != "049,048,047,046,045,044,043,042,041,040,039" {
+		t.Fatalf("expected 11 entries left unsorted, got %s", names)
+	}
+}
+
+func TestWalkMaxKeyLength(t *testing.T) {
+	long := strings.Repeat("d/", 400) + strings.Repeat("x", 300)
+	tree := newMemBackend("a", long, "z")
+
+	_, err := listMem(tree, "", "", "", 100, NewTreeWalkPool(time.Minute), ListOptions{})
+	if !errors.Is(err, ErrKeyTooLong) {
+		t.Fatalf("expected ErrKeyTooLong, got %v", err)
+	}
+
+	// Within a raised limit the key is listed.
+	opts := ListOptions{WalkOptions: WalkOptions{MaxKeyLength: 2048}}
+	result, err := listMem(tree, "", "", "", 100, NewTreeWalkPool(time.Minute), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Objects) != 3 || result.Objects[1].Name != long {
+		t.Fatalf("expected 3 objects, got %d", len(result.Objects))
+	}
+}
+
+func TestWalkMaxRecursionDepth(t *testing.T) {
+	deep := strings.Repeat("a/", 1500) + "x"
+	tree := newMemBackend("a/b", deep)
+
+	_, err := listMem(tree, "", "", "", 100, NewTreeWalkPool(time.Minute), ListOptions{})
+	if !errors.Is(err, ErrWalkTooDeep) {
+		t.Fatalf("expected ErrWalkTooDeep, got %v", err)
+	}
+
+	testCases := []struct {
+		prefix   string
+		maxDepth int
+		expected int // -1 for ErrWalkTooDeep.
+	}{
+		{"", 3, -1},
+		{"", 4, 3},
+		{"", -1, 3},
+		// The depth counts from the directory the walk starts from.
+		{"a/c/", 2, 1},
+		{"a/c/", 1, -1},
+	}
+	tree = newMemBackend("a/b", "a/c/d/e/f", "g")
+	for _, testCase := range testCases {
+		opts := ListOptions{WalkOptions: WalkOptions{MaxRecursionDepth: testCase.maxDepth}}
+		result, err := listMem(tree, testCase.prefix, "", "", 100, NewTreeWalkPool(time.Minute), opts)
+		if testCase.expected < 0 {
+			if !errors.Is(err, ErrWalkTooDeep) {
+				t.Fatalf("%+v: expected ErrWalkTooDeep, got %v", testCase, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Objects) != testCase.expected {
+			t.Fatalf("%+v: expected %d objects, got %d", testCase, testCase.expected, len(result.Objects))
+		}
+	}
+}
+
+func TestWalkRateLimit(t *testing.T) {
+	// 20 directories plus the root, 11 listDir calls over the burst.
+	tree := wideMemBackend(20, 2)
+	opts := ListOptions{WalkOptions: WalkOptions{RateLimit: rate.NewLimiter(100, 10)}}
+
+	start := time.Now()
+	result, err := listMem(tree, "", "", "", 1000, NewTreeWalkPool(time.Minute), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Objects) != 40 {
+		t.Fatalf("expected 40 objects, got %d", len(result.Objects))
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("expected the walk to be throttled, took %v", elapsed)
+	}
+
+	// Waiting for the limiter respects the cancellation of the walk.
+	opts.RateLimit = rate.NewLimiter(1, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err = ListObjectsWithResolver(ctx, "", "", "", "", 1000,
+		NewTreeWalkPool(time.Minute), tree.ListDir, isLeaf, tree.IsLeafDir, memResolver{tree}, opts)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the walk to be canceled, took %v", elapsed)
+	}
+
+	// A limiter without burst never allows a listDir call.
+	opts.RateLimit = rate.NewLimiter(1, 0)
+	_, err = listMem(tree, "", "", "", 1000, NewTreeWalkPool(time.Minute), opts)
+	if !errors.Is(err, ErrRateLimitNoBurst) {
+		t.Fatalf("expected ErrRateLimitNoBurst, got %v", err)
+	}
+}
+
+func TestWalkDirsFirst(t *testing.T) {
+	opts := ListOptions{WalkOptions: WalkOptions{DirsFirst: true}}
+	list := func(prefix string, maxKeys int) []string {
+		pool := NewTreeWalkPool(time.Minute)
+		return listNames(t, func(marker string) (ListObjectsInfo, error) {
+			return ListObjectsWithResolver(context.Background(), "", prefix, marker, "", maxKeys,
+				pool, listDirFactory(), isLeaf, isLeafDir, &splitResolver{}, opts)
+		})
+	}
+
+	names := list("a1/", 1000)
+	index := make(map[string]int)
+	for i, name := range names {
+		if _, ok := index[name]; ok {
+			t.Fatalf("%s: listed twice", name)
+		}
+		index[name] = i
+	}
+	if !sort.StringsAreSorted(names) {
+		t.Fatalf("expected sorted names, got %v", names)
+	}
+	for _, dir := range []string{"a1/a1/", "a1/c3/", "a1/c3/a1/"} {
+		if _, ok := index[dir]; !ok {
+			t.Fatalf("%s: expected to be listed", dir)
+		}
+	}
+	if index["a1/a1/"] > index["a1/a1/a1.txt"] || index["a1/c3/a1/"] > index["a1/c3/a1/1.txt"] {
+		t.Fatalf("expected the directories ahead of their contents, got %v", names)
+	}
+
+	// Pages resume after the directories.
+	if paged := list("a1/", 3); strings.Join(paged, ",") != strings.Join(names, ",") {
+		t.Fatalf("expected\n%v\ngot\n%v", names, paged)
+	}
+
+	// Empty directories are listed once.
+	tree := newMemBackend("a/1", "b/", "c/d/")
+	for _, maxKeys := range []int{100, 1} {
+		pool := NewTreeWalkPool(time.Minute)
+		names = listNames(t, func(marker string) (ListObjectsInfo, error) {
+			return ListObjectsWithResolver(context.Background(), "", "", marker, "", maxKeys,
+				pool, tree.ListDir, isLeaf, tree.IsLeafDir, memResolver{tree}, opts)
+		})
+		if strings.Join(names, ",") != "a/,a/1,b/,c/,c/d/" {
+			t.Fatalf("maxKeys %d: unexpected names %v", maxKeys, names)
+		}
+	}
+}
+
+func TestWalkExplicitDirObjects(t *testing.T) {
+	// "a/" and "b/c/" are folders created by a client, zero-byte objects
+	// the backend lists as directories.
+	tree := newMemBackend("a/1", "a/2", "b/c/3", "d")
+	tree.Put(ObjectInfo{Name: "a/", ContentType: "application/x-directory"})
+	tree.Put(ObjectInfo{Name: "b/c/", ContentType: "application/x-directory"})
+	// And resolves them as the objects they are.
+	resolver := funcResolver(func(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+		objInfo, err := tree.GetObjectInfo(ctx, bucket, name, info)
+		if objInfo.ContentType == "application/x-directory" {
+			objInfo.IsDir = false
+		}
+		return objInfo, err
+	})
+	list := func(prefix, delimiter string, maxKeys int, opts ListOptions) []string {
+		pool := NewTreeWalkPool(time.Minute)
+		return listNames(t, func(marker string) (ListObjectsInfo, error) {
+			return ListObjectsWithResolver(context.Background(), "", prefix, marker, delimiter, maxKeys,
+				pool, tree.ListDir, tree.IsLeaf, tree.IsLeafDir, resolver, opts)
+		})
+	}
+
+	if names := list("", "", 100, ListOptions{}); strings.Join(names, ",") != "a/1,a/2,b/c/3,d" {
+		t.Fatalf("expected the folders to be walked through, got %v", names)
+	}
+	opts := ListOptions{WalkOptions: WalkOptions{ExplicitDirObjects: true}}
+	testCases := []struct {
+		prefix    string
+		delimiter string
+		maxKeys   int
+		expected  string
+	}{
+		{"", "", 100, "a/,a/1,a/2,b/c/,b/c/3,d"},
+		{"", "", 1, "a/,a/1,a/2,b/c/,b/c/3,d"},
+		{"b/", "", 1, "b/c/,b/c/3"},
+		// The objects, then the prefixes, the folders are both.
+		{"", "/", 100, "a/,d,a/,b/"},
+		{"b/", "/", 100, "b/c/,b/c/"},
+	}
+	for _, testCase := range testCases {
+		names := list(testCase.prefix, testCase.delimiter, testCase.maxKeys, opts)
+		if strings.Join(names, ",") != testCase.expected {
+			t.Fatalf("%+v: got %v", testCase, names)
+		}
+	}
+}
+
+func TestWalkSelfEntry(t *testing.T) {
+	tree := newMemBackend("a/1", "a/2", "b")
+	// The backend lists "a/" itself, as an entry without a name, at index.
+	listDirAt := func(index int) ListDirFunc {
+		return func(bucket, prefixDir, prefixEntry string) (bool, []*Entry, bool) {
+			emptyDir, entries, delayIsLeaf := tree.ListDir(bucket, prefixDir, prefixEntry)
+			if prefixDir == "a/" && prefixEntry == "" {
+				self := &Entry{Info: &ObjectInfo{Bucket: bucket}}
+				entries = append(entries[:index:index], append([]*Entry{self}, entries[index:]...)...)
+			}
+			return emptyDir, entries, delayIsLeaf
+		}
+	}
+	list := func(listDir ListDirFunc, opts ListOptions) ([]string, error) {
+		result, err := ListObjectsWithResolver(context.Background(), "", "", "", "", 100,
+			NewTreeWalkPool(time.Minute), listDir, isLeaf, tree.IsLeafDir, memResolver{tree}, opts)
+		var names []string
+		for _, obj := range result.Objects {
+			names = append(names, obj.Name)
+		}
+		return names, err
+	}
+
+	names, err := list(listDirAt(0), ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, ",") != "a/,a/1,a/2,b" {
+		t.Fatalf("expected the directory ahead of its contents, got %v", names)
+	}
+	if _, err = list(listDirAt(0), ListOptions{WalkOptions: WalkOptions{NoSelfEntry: true}}); !errors.Is(err, ErrBackendInvariant) {
+		t.Fatalf("expected ErrBackendInvariant, got %v", err)
+	}
+	if _, err = list(listDirAt(1), ListOptions{}); !errors.Is(err, ErrBackendInvariant) || !strings.Contains(err.Error(), "index 1") {
+		t.Fatalf("expected ErrBackendInvariant at index 1, got %v", err)
+	}
+}
+
+func TestWalkOverProducingBackend(t *testing.T) {
+	// The backend ignores the prefix it lists the entries with.
+	tree := newMemBackend("a/1", "a/2", "ab", "b", "c/1", "d")
+	listDir := func(bucket, prefixDir, prefixEntry string) (bool, []*Entry, bool) {
+		return tree.ListDir(bucket, prefixDir, "")
+	}
+	for _, delimiter := range []string{"", "/", "-"} {
+		for _, maxKeys := range []int{1, 100} {
+			_, err := ListObjectsWithResolver(context.Background(), "", "a", "", delimiter, maxKeys,
+				NewTreeWalkPool(time.Minute), listDir, isLeaf, tree.IsLeafDir, memResolver{tree}, ListOptions{})
+			if !errors.Is(err, ErrBackendInvariant) {
+				t.Fatalf("%q %d: expected ErrBackendInvariant, got %v", delimiter, maxKeys, err)
+			}
+		}
+	}
+
+	// Listing the whole directory is fine.
+	result, err := ListObjectsWithResolver(context.Background(), "", "", "", "", 100,
+		NewTreeWalkPool(time.Minute), listDir, isLeaf, tree.IsLeafDir, memResolver{tree}, ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Objects) != 6 {
+		t.Fatalf("expected 6 objects, got %d", len(result.Objects))
+	}
+}
+
+// panickingResolver - resolves the objects of a MemBackend, panicking on
+// the one named name.
+type panickingResolver struct {
+	memResolver
+	name string
+}
+
+func (r panickingResolver) ResolveObject(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	if name == r.name {
+		panic("resolve " + name)
+	}
+	return r.memResolver.ResolveObject(ctx, bucket, name, info)
+}
+
+func (r panickingResolver) ResolveDir(ctx context.Context, bucket, name string, info *ObjectInfo) (ObjectInfo, error) {
+	if name == r.name {
+		panic("resolve " + name)
+	}
+	return r.memResolver.ResolveDir(ctx, bucket, name, info)
+}
+
+func TestWalkBackendPanic(t *testing.T) {
+	tree := newMemBackend("a", "b/1", "b/c/1", "d/1", "e")
+	// Panics on listing b/c/, walked by all the listings.
+	listDir := func(bucket, prefixDir, prefixEntry string) (bool, []*Entry, bool) {
+		if prefixDir == "b/c/" {
+			panic("listDir " + prefixDir)
+		}
+		return tree.ListDir(bucket, prefixDir, prefixEntry)
+	}
+	testCases := []struct {
+		delimiter string
+		listDir   ListDirFunc
+		resolver  InfoResolver
+		opts      ListOptions
+	}{
+		{"", listDir, memResolver{tree}, ListOptions{}},
+		{"-", listDir, memResolver{tree}, ListOptions{}},
+		{"", listDir, memResolver{tree}, ListOptions{WalkOptions: WalkOptions{ParallelSubtrees: 2}}},
+		{"", tree.ListDir, panickingResolver{memResolver{tree}, "b/1"}, ListOptions{}},
+		{"", tree.ListDir, panickingResolver{memResolver{tree}, "b/1"}, ListOptions{StatTimeout: time.Minute}},
+		{"/", tree.ListDir, panickingResolver{memResolver{tree}, "d/"}, ListOptions{}},
+	}
+	baseline := runtime.NumGoroutine()
+	for i, testCase := range testCases {
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := ListObjectsWithResolver(context.Background(), "", "", "", testCase.delimiter, 100,
+				NewTreeWalkPool(time.Minute), testCase.listDir, isLeaf, tree.IsLeafDir, testCase.resolver, testCase.opts)
+			errCh <- err
+		}()
+		select {
+		case err := <-errCh:
+			if !errors.Is(err, ErrBackendPanic) {
+				t.Fatalf("Test %d: expected ErrBackendPanic, got %v", i+1, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Test %d: listing hangs", i+1)
+		}
+	}
+	waitGoroutines(t, baseline)
+}
+
+func TestWalkSkipMarkerSubtree(t *testing.T) {
+	tree := newMemBackend("a/1", "a/2", "b/c/1", "b/c/2", "b/d", "b/e/1", "f")
+	list := func(marker string, maxKeys int, opts ListOptions) []string {
+		pool := NewTreeWalkPool(time.Minute)
+		first := true
+		return listNames(t, func(next string) (ListObjectsInfo, error) {
+			if first {
+				next = marker
+			}
+			// The next pages resume after their marker.
+			pageOpts := opts
+			pageOpts.SkipMarkerSubtree = opts.SkipMarkerSubtree && first
+			first = false
+			return ListObjectsWithResolver(context.Background(), "", "", next, "", maxKeys,
+				pool, tree.ListDir, isLeaf, tree.IsLeafDir, memResolver{tree}, pageOpts)
+		})
+	}
+
+	testCases := []struct {
+		marker  string
+		resumed string // Resuming after the marker.
+		skipped string // Resuming after the directory of the marker.
+	}{
+		{"b/c/1", "b/c/2,b/d,b/e/1,f", "b/d,b/e/1,f"},
+		{"b/c/", "b/c/1,b/c/2,b/d,b/e/1,f", "b/d,b/e/1,f"},
+		{"b/d", "b/e/1,f", "f"},
+		{"a/1", "a/2,b/c/1,b/c/2,b/d,b/e/1,f", "b/c/1,b/c/2,b/d,b/e/1,f"},
+		{"f", "", ""},
+	}
+	for _, testCase := range testCases {
+		for _, parallel := range []int{0, 2} {
+			for _, maxKeys := range []int{1, 100} {
+				opts := ListOptions{WalkOptions: WalkOptions{ParallelSubtrees: parallel}}
+				if names := list(testCase.marker, maxKeys, opts); strings.Join(names, ",") != testCase.resumed {
+					t.Fatalf("%s: expected %s, got %v", testCase.marker, testCase.resumed, names)
+				}
+				opts.SkipMarkerSubtree = true
+				if names := list(testCase.marker, maxKeys, opts); strings.Join(names, ",") != testCase.skipped {
+					t.Fatalf("%s: expected %s skipping, got %v", testCase.marker, testCase.skipped, names)
+				}
+			}
+		}
+	}
+}
+
+func TestWalkCollapseSlashes(t *testing.T) {
+	list := func(prefix, marker, delimiter string, opts ListOptions) []string {
+		pool := NewTreeWalkPool(time.Minute)
+		first := true
+		return listNames(t, func(next string) (ListObjectsInfo, error) {
+			if first {
+				next, first = marker, false
+			}
+			return ListObjectsWithResolver(context.Background(), "", prefix, next, delimiter, 7,
+				pool, listDirFactory(), isLeaf, isLeafDir, funcResolver(getObjectInfo), opts)
+		})
+	}
+
+	opts := ListOptions{WalkOptions: WalkOptions{CollapseSlashes: true}}
+	testCases := []struct {
+		prefix, marker string // As sent by the client.
+		collapsed      string // Prefix and marker collapsed.
+	}{
+		{"a1//b1", "", "a1/b1"},
+		{"a1//b1//", "", "a1/b1/"},
+		{"a1///b1/", "a1//b1//a12.txt", "a1/b1/ a1/b1/a12.txt"},
+	}
+	for _, testCase := range testCases {
+		prefix, marker, _ := strings.Cut(testCase.collapsed, " ")
+		for _, delimiter := range []string{"", "/"} {
+			expected := list(prefix, marker, delimiter, ListOptions{})
+			names := list(testCase.prefix, testCase.marker, delimiter, opts)
+			if len(names) == 0 || strings.Join(names, ",") != strings.Join(expected, ",") {
+				t.Fatalf("%+v %q: expected\n%v\ngot\n%v", testCase, delimiter, expected, names)
+			}
+			for _, name := range names {
+				if !strings.HasPrefix(name, prefix) || strings.Contains(name, "//") {
+					t.Fatalf("%+v %q: unexpected key %s", testCase, delimiter, name)
+				}
+			}
+		}
+	}
+}
+
+func TestWalkProgress(t *testing.T) {
+	// testdata holds 3460 files in 820 directories, the root included.
+	progress := &WalkProgress{}
+	opts := ListOptions{WalkOptions: WalkOptions{Progress: progress}}
+
+	done := make(chan error)
+	go func() {
+		_, err := ListObjectsWithResolver(context.Background(), "", "", "", "", 10000,
+			NewTreeWalkPool(time.Minute), listDirFactory(), isLeaf, isLeafDir, &splitResolver{}, opts)
+		done <- err
+	}()
+	var polled int64
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := progress.DirsVisited.Load(); n != 820 {
+				t.Fatalf("expected 820 directories visited, got %d", n)
+			}
+			if n := progress.EntriesEmitted.Load(); n != 3460 {
+				t.Fatalf("expected 3460 entries emitted, got %d", n)
+			}
+			return
+		case <-time.After(time.Millisecond):
+			n := progress.EntriesEmitted.Load()
+			if n < polled {
+				t.Fatalf("progress went back from %d to %d", polled, n)
+			}
+			polled = n
+		}
+	}
+}
+
+// captureTracer - records the traces of a walk.
+type captureTracer struct {
+	mu     sync.Mutex
+	traces []string
+}
+
+func (c *captureTracer) Tracef(format string, args ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.traces = append(c.traces, fmt.Sprintf(format, args...))
+}
+
+func TestWalkTracer(t *testing.T) {
+	tree := newMemBackend("a/1", "a/2", "b/", "c")
+	tracer := &captureTracer{}
+	opts := ListOptions{WalkOptions: WalkOptions{Tracer: tracer}}
+	if _, err := listMem(tree, "", "a/1", "", 100, NewTreeWalkPool(time.Minute), opts); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`treeWalk: enter "" marker "a/1"`,
+		`treeWalk: recurse "a/"`,
+		`treeWalk: enter "a/" marker "1"`,
+		`treeWalk: skip marker "1"`,
+		`treeWalk: emit "a/2"`,
+		`treeWalk: emit "b/"`,
+		`treeWalk: emit "c"`,
+	}
+	if strings.Join(tracer.traces, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected traces\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(tracer.traces, "\n"))
+	}
+}
+
+func TestFilterListEntriesTombstones(t *testing.T) {
+	tree := newMemBackend("a/1", "a/2~deleted", "b~deleted", "c")
+	filter := FilterOptions{IsTombstone: func(entry *Entry) bool {
+		return strings.HasSuffix(entry.Name, "~deleted")
+	}}
+	list := func() []string {
+		return listNames(t, func(marker string) (ListObjectsInfo, error) {
+			return ListObjectsWithResolver(context.Background(), "", "", marker, "", 100,
+				NewTreeWalkPool(time.Minute), filteredListDir(tree, filter), tree.IsLeaf, tree.IsLeafDir, memResolver{tree}, ListOptions{})
+		})
+	}
+
+	if names := strings.Join(list(), ","); names != "a/1,c" {
+		t.Fatalf("expected tombstones to be hidden, got %s", names)
+	}
+	filter.ShowDeleted = true
+	if names := strings.Join(list(), ","); names != "a/1,a/2~deleted,b~deleted,c" {
+		t.Fatalf("expected tombstones to be shown, got %s", names)
+	}
+}
+
+func TestFilterListEntriesDeleteMarkers(t *testing.T) {
+	tree := newMemBackend("a/1", "c")
+	tree.Put(ObjectInfo{Name: "a/2", DeleteMarker: true})
+	tree.Put(ObjectInfo{Name: "b", DeleteMarker: true})
+	filter := FilterOptions{IsDeleted: func(info *ObjectInfo) bool {
+		return info.DeleteMarker
+	}}
+	list := func() []string {
+		return listNames(t, func(marker string) (ListObjectsInfo, error) {
+			return ListObjectsWithResolver(context.Background(), "", "", marker, "", 100,
+				NewTreeWalkPool(time.Minute), filteredListDir(tree, filter), tree.IsLeaf, tree.IsLeafDir, memResolver{tree}, ListOptions{})
+		})
+	}
+
+	// The current versions.
+	if names := strings.Join(list(), ","); names != "a/1,c" {
+		t.Fatalf("expected deleted objects to be hidden, got %s", names)
+	}
+	// All the versions.
+	filter.ShowDeleted = true
+	if names := strings.Join(list(), ","); names != "a/1,a/2,b,c" {
+		t.Fatalf("expected deleted objects to be shown, got %s", names)
+	}
+}
+
+func TestFilterListEntriesDotEntries(t *testing.T) {
+	entries := []*Entry{{Name: "."}, {Name: "a"}, {Name: ".."}, {Name: "./"}, {Name: ".hidden"}, {Name: "../"}, {Name: "b/"}}
+	filtered, _ := FilterListEntries("", "", entries, "", isLeaf)
+	if names := listEntryNames(filtered); names != ".hidden,a,b/" {
+		t.Fatalf("expected . and .. to be removed, got %s", names)
+	}
+
+	// Through the walk, from a backend listing . and .. in every directory.
+	tree := newMemBackend("a/1", "a/b/2", "c")
+	listDir := func(bucket, prefixDir, prefixEntry string) (bool, []*Entry, bool) {
+		_, entries, _ := tree.ListDir(bucket, prefixDir, "")
+		entries = append(entries, &Entry{Name: "."}, &Entry{Name: "../"})
+		entries, delayIsLeaf := FilterListEntries(bucket, prefixDir, entries, prefixEntry, isLeaf)
+		return len(entries) == 0, entries, delayIsLeaf
+	}
+	keys, _, _, _, err := ListKeys(context.Background(), "", "", "", "", 100, listDir, isLeaf, tree.IsLeafDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := strings.Join(keys, ","); names != "a/1,a/b/2,c" {
+		t.Fatalf("unexpected keys %s", names)
+	}
+}
+
+func TestFilterListEntriesFileAndDir(t *testing.T) {
+	// A file sorts ahead of the directory of the same name, which it is a
+	// prefix of, while the siblings sort around it by byte order.
+	entries := []*Entry{{Name: "foo0"}, {Name: "foo/"}, {Name: "foo.txt"}, {Name: "foo"}}
+	filtered, _ := FilterListEntries("", "", entries, "", isLeaf)
+	if names := listEntryNames(filtered); names != "foo,foo.txt,foo/,foo0" {
+		t.Fatalf("unexpected order %s", names)
+	}
+
+	// Pages resume in the same order, as markers compare bytewise.
+	tree := newMemBackend("foo", "foo/a", "foo/b/", "foo.txt", "foo0")
+	for _, testCase := range []struct{ delimiter, expected string }{
+		{"", "foo,foo.txt,foo/a,foo/b/,foo0"},
+		{"/", "foo,foo.txt,foo/,foo0"},
+	} {
+		delimiter, expected := testCase.delimiter, testCase.expected
+		for _, maxKeys := range []int{1, 100} {
+			var names []string
+			pool := NewTreeWalkPool(time.Minute)
+			listNames(t, func(marker string) (ListObjectsInfo, error) {
+				result, err := ListObjectsWithResolver(context.Background(), "", "", marker, delimiter, maxKeys,
+					pool, tree.ListDir, isLeaf, tree.IsLeafDir, memResolver{tree}, ListOptions{Merged: true})
+				for _, entry := range result.Entries {
+					names = append(names, entry.Name)
+				}
+				return result, err
+			})
+			if strings.Join(names, ",") != expected {
+				t.Fatalf("%q maxKeys %d: expected %s, got %v", delimiter, maxKeys, expected, names)
+			}
+		}
+	}
+}
+
+func TestFilterMatchingPrefix(t *testing.T) {
+	entries := func() []*Entry {
+		var entries []*Entry
+		for _, name := range []string{"a1.txt", "a1/", "a11.txt", "b1/", "a2.txt", "z1.txt"} {
+			entries = append(entries, &Entry{Name: name})
+		}
+		return entries
+	}
+	names := listEntryNames
+
+	// A third party listDir filtering on its own matches the listing.
+	expected, _ := FilterListEntries("", "", entries(), "a1", isLeaf)
+	matching := FilterMatchingPrefix(entries(), "a1")
+	sort.Slice(matching, func(i, j int) bool { return matching[i].Name < matching[j].Name })
+	if names(matching) != names(expected) {
+		t.Fatalf("expected %s, got %s", names(expected), names(matching))
+	}
+
+	// Matching entries are moved to the front of the supplied entries.
+	all := entries()
+	matching = FilterMatchingPrefix(all, "a")
+	if names(matching) != "a1.txt,a1/,a11.txt,a2.txt" || &matching[0] != &all[0] {
+		t.Fatalf("expected the entries to be filtered in place, got %s", names(matching))
+	}
+	if names(FilterMatchingPrefix(entries(), "")) != names(entries()) {
+		t.Fatal("expected an empty prefix to match all the entries")
+	}
+}
+
+func TestFilterListEntriesDelayIsLeaf(t *testing.T) {
+	// Like on erasure backends, objects are directories holding their
+	// parts, an ambiguous "obj/" entry is a leaf.
+	isObjectLeaf := func(bucket, name string) bool {
+		return strings.HasSuffix(name, "obj/") || !strings.HasSuffix(name, "/")
+	}
+	entries := []*Entry{{Name: "obj/"}, {Name: "dir/"}, {Name: "x"}}
+	filtered, delayIsLeaf := FilterListEntries("", "", entries, "", isObjectLeaf)
+	if !delayIsLeaf {
+		t.Fatal("expected the isLeaf check to be delayed")
+	}
+	if names := listEntryNames(filtered); names != "dir/,obj/,x" {
+		t.Fatalf("expected sorted entries, got %s", names)
+	}
+
+	// An entry sharing the prefix of a directory can not be delayed.
+	entries = []*Entry{{Name: "obj/"}, {Name: "obj/part.1"}}
+	filtered, delayIsLeaf = FilterListEntries("", "", entries, "", isObjectLeaf)
+	if delayIsLeaf {
+		t.Fatal("expected the isLeaf check not to be delayed")
+	}
+	if names := listEntryNames(filtered); names != "obj,obj/part.1" {
+		t.Fatalf("expected the leaf to be trimmed, got %s", names)
+	}
+
+	// Nor can entries whose order telling the leaves apart changes,
+	// "obj.txt" < "obj/" but "obj" < "obj.txt".
+	entries = []*Entry{{Name: "obj.txt"}, {Name: "obj/"}, {Name: "x"}}
+	filtered, delayIsLeaf = FilterListEntries("", "", entries, "", isObjectLeaf)
+	if delayIsLeaf {
+		t.Fatal("expected the isLeaf check not to be delayed")
+	}
+	if names := listEntryNames(filtered); names != "obj,obj.txt,x" {
+		t.Fatalf("expected the leaf to be sorted again, got %s", names)
+	}
+	// The same for a directory listed without its trailing "/".
+	isDirLeaf := func(bucket, name string) bool {
+		return !strings.HasSuffix(name, "/") && name != "obj"
+	}
+	entries = []*Entry{{Name: "obj"}, {Name: "obj.txt"}, {Name: "obj0"}}
+	filtered, delayIsLeaf = FilterListEntries("", "", entries, "", isDirLeaf)
+	if delayIsLeaf {
+		t.Fatal("expected the isLeaf check not to be delayed")
+	}
+	if names := listEntryNames(filtered); names != "obj.txt,obj/,obj0" {
+		t.Fatalf("expected the directory to be sorted again, got %s", names)
+	}
+	// Siblings sorting after "obj/" keep the check delayed.
+	entries = []*Entry{{Name: "obj"}, {Name: "obj0"}, {Name: "obj1/"}}
+	if _, delayIsLeaf = FilterListEntries("", "", entries, "", isDirLeaf); !delayIsLeaf {
+		t.Fatal("expected the isLeaf check to be delayed")
+	}
+
+	// The walk resolves the delayed leaves.
+	tree := newMemBackend("dir/x", "obj/part.1", "z")
+	listDir := func(bucket, prefixDir, prefixEntry string) (bool, []*Entry, bool) {
+		emptyDir, entries, _ := tree.ListDir(bucket, prefixDir, prefixEntry)
+		entries, delayIsLeaf := FilterListEntries(bucket, prefixDir, entries, prefixEntry, isObjectLeaf)
+		return emptyDir, entries, delayIsLeaf
+	}
+	keys, _, _, _, err := ListKeys(context.Background(), "", "", "", "", 100, listDir, isObjectLeaf, tree.IsLeafDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := strings.Join(keys, ","); names != "dir/x,obj,z" {
+		t.Fatalf("expected obj to be listed as an object, got %s", names)
+	}
+	tree = newMemBackend("obj.txt", "obj/part.1", "z")
+	keys, _, _, _, err = ListKeys(context.Background(), "", "", "", "", 100, listDir, isObjectLeaf, tree.IsLeafDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := strings.Join(keys, ","); names != "obj,obj.txt,z" {
+		t.Fatalf("expected sorted keys, got %s", names)
+	}
+}
+
+func TestWalkDelayedLeafDirectories(t *testing.T) {
+	testCases := []struct {
+		keys      []string
+		prefix    string
+		delimiter string
+		expected  string // With maxKeys 100, the objects then the prefixes.
+		paged     string // With maxKeys 1, a key per page.
+	}{
+		{[]string{"a/obj/1", "a/obj/2", "a/x", "b"}, "", "", "a/obj/1,a/obj/2,a/x,b", ""},
+		{[]string{"a/obj/1", "a/obj/2", "a/x", "b"}, "a/", "/", "a/x,a/obj/", "a/obj/,a/x"},
+		{[]string{"a/obj/1", "a/obj/2", "a/x", "b"}, "a/o", "", "a/obj/1,a/obj/2", ""},
+		// "a/obj.txt" sorts between "a/obj" and "a/obj/".
+		{[]string{"a/obj/1", "a/obj/2", "a/obj.txt", "a/x"}, "", "", "a/obj.txt,a/obj/1,a/obj/2,a/x", ""},
+		{[]string{"a/obj/1", "a/obj/2", "a/obj.txt", "a/x"}, "a/", "/", "a/obj.txt,a/x,a/obj/", "a/obj.txt,a/obj/,a/x"},
+		// "c/d" sorts after the marker, "c.d", but "c" before it.
+		{[]string{"b", "c/d", "c/e"}, "c", "", "c/d,c/e", ""},
+	}
+	for _, testCase := range testCases {
+		tree := newMemBackend(testCase.keys...)
+		// The backend lists the directories without their trailing slash
+		// and leaves telling them apart to the walk.
+		listDir := func(bucket, prefixDir, prefixEntry string) (bool, []*Entry, bool) {
+			emptyDir, entries, _ := tree.ListDir(bucket, prefixDir, prefixEntry)
+			for _, entry := range entries {
+				entry.Name = strings.TrimSuffix(entry.Name, "/")
+			}
+			sort.Slice(entries, func(i, j int) bool {
+				return entries[i].Name < entries[j].Name
+			})
+			return emptyDir, entries, true
+		}
+		isDirLeaf := func(bucket, name string) bool {
+			dir := strings.TrimSuffix(name, "/") + "/"
+			for _, key := range testCase.keys {
+				if strings.HasPrefix(key, dir) {
+					return false
+				}
+			}
+			return true
+		}
+
+		if testCase.paged == "" {
+			testCase.paged = testCase.expected
+		}
+		backend := ListBackend{ListDir: listDir, IsLeaf: isDirLeaf, IsLeafDir: tree.IsLeafDir, Resolver: memResolver{tree}}
+		for _, maxKeys := range []int{100, 1} {
+			for _, parallel := range []int{0, 2} {
+				// Without a pool every page resumes from its marker.
+				var names []string
+				var marker string
+				if testCase.prefix == "c" {
+					marker = "c.d"
+				}
+				for {
+					opts := ListOptions{Delimiter: testCase.delimiter, Marker: marker, MaxKeys: maxKeys,
+						Projection: ProjectName, WalkOptions: WalkOptions{ParallelSubtrees: parallel}}
+					result, err := ListObjectsWithOptions(context.Background(), "", testCase.prefix, opts, backend)
+					if err != nil {
+						t.Fatal(err)
+					}
+					for _, obj := range result.Objects {
+						names = append(names, obj.Name)
+					}
+					names = append(names, result.Prefixes...)
+					if !result.IsTruncated {
+						break
+					}
+					marker = result.NextMarker
+				}
+				expected := testCase.expected
+				if maxKeys == 1 {
+					expected = testCase.paged
+				}
+				if strings.Join(names, ",") != expected {
+					t.Fatalf("%v prefix %q delimiter %q maxKeys %d parallel %d: expected %s, got %v",
+						testCase.keys, testCase.prefix, testCase.delimiter, maxKeys, parallel, expected, names)
+				}
+			}
+		}
+	}
+}
+
+func listEntryNames(entries []*Entry) string {
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestWalkCheckDirChanges(t *testing.T) {
+	testCases := []struct {
+		name     string
+		modified []string // Keys written right after telling a/b/ a leaf directory.
+		check    bool
+		expected string
+		listed   int // Listings of a/.
+	}{
+		{"unchecked", []string{"a/b/x"}, false, "a/b/,c", 1},
+		// The leaf directory itself changed.
+		{"leaf dir", []string{"a/b/x"}, true, "a/b/x,c", 2},
+		// Its parent changed.
+		{"parent", []string{"a/a"}, true, "a/a,a/b/,c", 2},
+		// Neither of them changed, a directory listed already did.
+		{"unrelated", []string{"d/e"}, true, "a/b/,c", 1},
+	}
+	for _, testCase := range testCases {
+		tree := newMemBackend("a/b/", "c")
+		// The stamp of a directory moves on writing an entry into it.
+		stamps := make(map[string]int)
+		var listed int
+		listDir := func(bucket, prefixDir, prefixEntry string) (bool, []*Entry, bool) {
+			if prefixDir == "a/" {
+				listed++
+			}
+			return tree.ListDir(bucket, prefixDir, prefixEntry)
+		}
+		isLeafDir := func(bucket, name string) bool {
+			leafDir := tree.IsLeafDir(bucket, name)
+			if name == "a/b/" && testCase.modified != nil {
+				for _, key := range testCase.modified {
+					tree.Put(ObjectInfo{Name: key, Size: int64(len(key))})
+					stamps[path.Dir(key)+"/"]++
+				}
+				testCase.modified = nil
+			}
+			return leafDir
+		}
+		limiter := rate.NewLimiter(0.001, 10)
+		opts := ListOptions{WalkOptions: WalkOptions{
+			CheckDirChanges: testCase.check,
+			DirStamp: func(bucket, prefixDir string) string {
+				return fmt.Sprint(stamps[prefixDir])
+			},
+			RateLimit: limiter,
+		}}
+		result, err := ListObjectsWithResolver(context.Background(), "", "", "", "", 100,
+			nil, listDir, tree.IsLeaf, isLeafDir, memResolver{tree}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, obj := range result.Objects {
+			names = append(names, obj.Name)
+		}
+		if strings.Join(names, ",") != testCase.expected {
+			t.Fatalf("%s: expected %s, got %v", testCase.name, testCase.expected, names)
+		}
+		if listed != testCase.listed {
+			t.Fatalf("%s: expected a/ listed %d times, got %d", testCase.name, testCase.listed, listed)
+		}
+		// Every listing, the second one of a/ included, is rate limited.
+		walked := 1 + listed
+		if strings.Contains(testCase.expected, "a/b/x") {
+			walked++
+		}
+		if tokens := int(limiter.Tokens() + 0.5); tokens != 10-walked {
+			t.Fatalf("%s: expected %d listings rate limited, got %d", testCase.name, walked, 10-tokens)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	. "github.com/zhaohuxing/s3/cmd"
+)
+
+func TestVerifyBackend(t *testing.T) {
+	tree := newMemBackend("a/1", "a/b/2", "a/c/", "d", "e/f/3")
+	if errs := VerifyBackend(context.Background(), "", tree.ListDir, tree.IsLeaf, tree.IsLeafDir); len(errs) != 0 {
+		t.Fatalf("expected no violations, got %v", errs)
+	}
+	if errs := VerifyBackend(context.Background(), "", listDirFactory(), isLeaf, isLeafDir); len(errs) != 0 {
+		t.Fatalf("expected no violations, got %v", errs)
+	}
+
+	// Broken in a different way in each directory.
+	broken := func(bucket, prefixDir, prefixEntry string) (bool, []*Entry, bool) {
+		emptyDir, entries, delayIsLeaf := tree.ListDir(bucket, prefixDir, prefixEntry)
+		switch {
+		case prefixDir == "":
+			// Unsorted, and ignoring the prefix.
+			_, entries, _ = tree.ListDir(bucket, prefixDir, "")
+			entries[0], entries[1] = entries[1], entries[0]
+		case prefixDir == "a/" && prefixEntry == "":
+			// A directory without its slash, listed twice.
+			entries[1] = &Entry{Name: "b"}
+			entries = append(entries, entries[len(entries)-1])
+		case prefixDir == "a/c/":
+			// Empty yet listed with an entry.
+			return true, []*Entry{{Name: "x"}}, false
+		}
+		return emptyDir, entries, delayIsLeaf
+	}
+	// Telling e/f/ empty.
+	brokenIsLeafDir := func(bucket, name string) bool {
+		return name == "e/f/" || tree.IsLeafDir(bucket, name)
+	}
+	errs := VerifyBackend(context.Background(), "", broken, tree.IsLeaf, brokenIsLeafDir)
+	expected := []string{
+		`"": entry "a/" is listed after "d"`,
+		`"": entry "d" is listed for prefix "e"`,
+		`"": entry "a/" is listed for prefix "e"`,
+		`"a/": entry "c/" is listed twice`,
+		`"e/": isLeafDir of "f/" is true while it has 1 entries`,
+		`"a/c/": listed as empty with 1 entries`,
+	}
+	var got []string
+	for _, err := range errs {
+		if !errors.Is(err, ErrBackendInvariant) {
+			t.Fatalf("expected ErrBackendInvariant, got %v", err)
+		}
+		got = append(got, err.Error())
+	}
+	if len(got) != len(expected) {
+		t.Errorf("expected %d violations, got:\n%s", len(expected), strings.Join(got, "\n"))
+	}
+	for _, violation := range expected {
+		found := false
+		for _, msg := range got {
+			found = found || strings.HasPrefix(msg, violation)
+		}
+		if !found {
+			t.Errorf("expected violation %s, got:\n%s", violation, strings.Join(got, "\n"))
+		}
+	}
+}